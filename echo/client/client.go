@@ -8,14 +8,21 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"telnet/proxy"
 )
 
 type Client struct {
 	connection.Connection
+	// Outbound proxy (nil to dial directly)
+	Dialer proxy.Dialer
 }
 
 func (c *Client) Call() error {
-	conn, err := net.Dial("tcp", c.IP+":"+strconv.Itoa(c.Port))
+	dial := net.Dial
+	if c.Dialer != nil {
+		dial = c.Dialer.Dial
+	}
+	conn, err := dial("tcp", c.IP+":"+strconv.Itoa(c.Port))
 	c.Conn = conn
 	c.Reader = bufio.NewReader(conn)
 	return err
@@ -28,10 +35,15 @@ func Init(ip string, port int) Client {
 	return client
 }
 
-func Run(ip string, port int) {
+func Run(ip string, port int, proxyURL string) {
 	client := Init(ip, port)
+	var err error
+	client.Dialer, err = proxy.New(proxyURL)
+	if err != nil {
+		log.Fatal("Proxy Error:", err)
+	}
 
-	err := client.Call()
+	err = client.Call()
 	if err != nil {
 		log.Fatal("Call Error:", err)
 	}
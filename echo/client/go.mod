@@ -2,6 +2,14 @@ module echo/client
 
 go 1.18
 
-replace echo/connection => ../connection
+replace (
+	echo/connection => ../connection
+	telnet/proxy => ../../telnet/proxy
+)
 
-require echo/connection v0.0.0-00010101000000-000000000000
+require (
+	echo/connection v0.0.0-00010101000000-000000000000
+	telnet/proxy v0.0.0-00010101000000-000000000000
+)
+
+require golang.org/x/net v0.0.0-20220722155237-a158d28d115b // indirect
@@ -6,6 +6,7 @@ replace (
 	echo/client => ./client
 	echo/connection => ./connection
 	echo/server => ./server
+	telnet/proxy => ../telnet/proxy
 )
 
 require (
@@ -13,4 +14,8 @@ require (
 	echo/server v0.0.0-00010101000000-000000000000
 )
 
-require echo/connection v0.0.0-00010101000000-000000000000 // indirect
+require (
+	echo/connection v0.0.0-00010101000000-000000000000 // indirect
+	golang.org/x/net v0.0.0-20220722155237-a158d28d115b // indirect
+	telnet/proxy v0.0.0-00010101000000-000000000000 // indirect
+)
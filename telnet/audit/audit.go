@@ -0,0 +1,211 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Writes audit events of all sessions as JSON lines
+type Logger struct {
+	w  io.WriteCloser
+	mu sync.Mutex
+}
+
+type Event struct {
+	Time         time.Time `json:"time"`
+	Session      int       `json:"session"`
+	Event        string    `json:"event"`
+	Peer         string    `json:"peer"`
+	User         string    `json:"user,omitempty"`
+	TerminalType string    `json:"terminal_type,omitempty"`
+	Line         string    `json:"line,omitempty"`
+	Redacted     bool      `json:"redacted,omitempty"`
+}
+
+// Opens audit log file, "-" for stdout
+func New(path string) (*Logger, error) {
+	if path == "-" {
+		return &Logger{w: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Logger{w: file}, nil
+}
+
+func (l *Logger) Write(e Event) error {
+	if l == nil {
+		return nil
+	}
+	e.Time = time.Now()
+	return l.Log(e)
+}
+
+// Writes any event type as a JSON line
+func (l *Logger) Log(v interface{}) error {
+	if l == nil {
+		return nil
+	}
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(line, '\n'))
+	return err
+}
+
+func (l *Logger) Close() error {
+	if l == nil || l.w == os.Stdout {
+		return nil
+	}
+	return l.w.Close()
+}
+
+// Rebuilds input lines of a session
+type Session struct {
+	logger *Logger
+	id     int
+	peer   string
+	// Returns authenticated user and terminal type at the time of event
+	info func() (user string, terminalType string)
+	// Current input line
+	line   []rune
+	secret bool
+	// Pending escape sequence or multibyte character
+	escape  int
+	partial []byte
+	lastCR  bool
+}
+
+// Escape sequence states
+const (
+	escapeNone = iota
+	escapeStart
+	escapeParams
+)
+
+func (l *Logger) Session(id int, peer string, info func() (string, string)) *Session {
+	if l == nil {
+		return nil
+	}
+	return &Session{logger: l, id: id, peer: peer, info: info}
+}
+
+func (s *Session) write(event string, line string, redacted bool) error {
+	user, terminalType := s.info()
+	return s.logger.Write(Event{
+		Session:      s.id,
+		Event:        event,
+		Peer:         s.peer,
+		User:         user,
+		TerminalType: terminalType,
+		Line:         line,
+		Redacted:     redacted,
+	})
+}
+
+func (s *Session) Start() error {
+	if s == nil {
+		return nil
+	}
+	return s.write("start", "", false)
+}
+
+func (s *Session) End() error {
+	if s == nil {
+		return nil
+	}
+	if len(s.line) > 0 {
+		s.flush()
+	}
+	return s.write("end", "", false)
+}
+
+// Processes client input, echoOff marks bytes typed while the pty does not echo
+func (s *Session) Input(b []byte, echoOff bool) error {
+	if s == nil {
+		return nil
+	}
+	var err error
+	for _, c := range b {
+		lastCR := s.lastCR
+		s.lastCR = false
+		// Skip escape sequences such as cursor keys
+		switch s.escape {
+		case escapeStart:
+			s.escape = escapeNone
+			if c == '[' || c == 'O' {
+				s.escape = escapeParams
+			}
+			continue
+		case escapeParams:
+			if c >= 0x40 && c <= 0x7e {
+				s.escape = escapeNone
+			}
+			continue
+		}
+		switch c {
+		case '\r':
+			err = s.flush()
+			s.lastCR = true
+		case '\n', 0:
+			// CR LF and CR NUL end a line only once
+			if !lastCR {
+				err = s.flush()
+			}
+		case '\b', '\177':
+			if len(s.line) > 0 {
+				s.line = s.line[:len(s.line)-1]
+			}
+		case 0x15: // Ctrl-U
+			s.line = s.line[:0]
+		case 0x17: // Ctrl-W
+			for len(s.line) > 0 && s.line[len(s.line)-1] == ' ' {
+				s.line = s.line[:len(s.line)-1]
+			}
+			for len(s.line) > 0 && s.line[len(s.line)-1] != ' ' {
+				s.line = s.line[:len(s.line)-1]
+			}
+		case 0x03: // Ctrl-C
+			s.line = s.line[:0]
+			s.secret = false
+		case 0x1b:
+			s.escape = escapeStart
+		default:
+			if c < ' ' {
+				continue
+			}
+			s.partial = append(s.partial, c)
+			if !utf8.FullRune(s.partial) {
+				continue
+			}
+			r, _ := utf8.DecodeRune(s.partial)
+			s.partial = s.partial[:0]
+			s.line = append(s.line, r)
+			if echoOff {
+				s.secret = true
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Session) flush() error {
+	line, secret := string(s.line), s.secret
+	s.line = s.line[:0]
+	s.secret = false
+	if secret {
+		return s.write("input", "", true)
+	}
+	return s.write("input", line, false)
+}
@@ -0,0 +1,3 @@
+module telnet/audit
+
+go 1.18
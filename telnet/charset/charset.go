@@ -0,0 +1,278 @@
+package charset
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	cmd "telnet/command"
+	opt "telnet/option"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/transform"
+)
+
+// RFC 2066 subcommands
+const (
+	REQUEST         byte = 1
+	ACCEPTED        byte = 2
+	REJECTED        byte = 3
+	TTABLE_IS       byte = 4
+	TTABLE_REJECTED byte = 5
+	TTABLE_ACK      byte = 6
+	TTABLE_NAK      byte = 7
+)
+
+// Prefix of a REQUEST offering a translation table, followed by a version byte
+var ttablePrefixes = [][]byte{[]byte("[TTABLE]"), []byte("[TTABLE ]")}
+
+// Returns encoding and canonical IANA name of charset
+func Lookup(name string) (encoding.Encoding, string, error) {
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("unknown charset %s", name)
+	}
+	if enc == nil {
+		return nil, "", fmt.Errorf("charset %s is not supported", name)
+	}
+	// Prefer short MIME names such as EUC-JP
+	canonical, err := ianaindex.MIME.Name(enc)
+	if err != nil {
+		canonical, err = ianaindex.IANA.Name(enc)
+	}
+	if err != nil {
+		canonical = name
+	}
+	return enc, canonical, nil
+}
+
+// Converts a byte stream between charsets, keeping incomplete multibyte sequences for the next call
+type Transcoder struct {
+	t       transform.Transformer
+	pending []byte
+}
+
+func NewTranscoder(from encoding.Encoding, to encoding.Encoding) *Transcoder {
+	return &Transcoder{t: transform.Chain(from.NewDecoder(), encoding.ReplaceUnsupported(to.NewEncoder()))}
+}
+
+func (t *Transcoder) Convert(b []byte) []byte {
+	src := append(t.pending, b...)
+	t.pending = nil
+	out := make([]byte, 0, len(src))
+	dst := make([]byte, 3*len(src)+16)
+	for len(src) > 0 {
+		nDst, nSrc, err := t.t.Transform(dst, src, false)
+		out = append(out, dst[:nDst]...)
+		src = src[nSrc:]
+		switch err {
+		case nil:
+			return out
+		case transform.ErrShortDst:
+			continue
+		case transform.ErrShortSrc:
+			// Rest of the sequence comes with the next read
+			t.pending = append([]byte(nil), src...)
+			return out
+		default:
+			// Skip a byte that cannot be converted
+			out = append(out, '?')
+			src = src[1:]
+			t.t.Reset()
+		}
+	}
+	return out
+}
+
+// Charset negotiated on a connection with transcoders to the local charset
+type Conversion struct {
+	// Charset of the pty (server) or terminal (client)
+	Local string
+	// Charsets offered in REQUEST, in order of preference
+	Offer []string
+	local encoding.Encoding
+	// Agreed charset (empty until ACCEPTED)
+	remote    string
+	requested bool
+	toRemote  *Transcoder
+	toLocal   *Transcoder
+	// Local output and input converted to UTF-8 (nil when local is UTF-8)
+	outputUTF8 *Transcoder
+	inputUTF8  *Transcoder
+	mu         sync.Mutex
+}
+
+func New(local string, offer []string) (*Conversion, error) {
+	enc, canonical, err := Lookup(local)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range offer {
+		_, _, err := Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := &Conversion{Local: canonical, Offer: offer, local: enc}
+	if canonical != "UTF-8" {
+		c.outputUTF8 = NewTranscoder(enc, encoding.Nop)
+		c.inputUTF8 = NewTranscoder(enc, encoding.Nop)
+	}
+	return c, nil
+}
+
+// Returns the agreed charset or empty
+func (c *Conversion) Remote() string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// Forgets the agreed charset, such as for a new connection
+func (c *Conversion) Reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remote = ""
+	c.requested = false
+	c.toRemote, c.toLocal = nil, nil
+}
+
+// Builds IAC SB CHARSET REQUEST ;charset;... IAC SE
+func (c *Conversion) Request() []byte {
+	if c == nil || len(c.Offer) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	c.requested = true
+	c.mu.Unlock()
+	return Build(REQUEST, []byte(";"+strings.Join(c.Offer, ";")))
+}
+
+// Applies a subnegotiation and returns the reply
+func (c *Conversion) Handle(options []byte) []byte {
+	if c == nil || len(options) == 0 {
+		return nil
+	}
+	subCmd, value := options[0], options[1:]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch subCmd {
+	case REQUEST:
+		// Our own outstanding REQUEST takes precedence
+		if c.requested {
+			return Build(REJECTED, nil)
+		}
+		for _, prefix := range ttablePrefixes {
+			if bytes.HasPrefix(value, prefix) && len(value) > len(prefix) {
+				value = value[len(prefix)+1:]
+				break
+			}
+		}
+		if len(value) < 2 {
+			return Build(REJECTED, nil)
+		}
+		name := c.choose(strings.Split(string(value[1:]), string(value[0])))
+		if len(name) == 0 {
+			return Build(REJECTED, nil)
+		}
+		c.set(name)
+		return Build(ACCEPTED, []byte(name))
+	case ACCEPTED:
+		c.requested = false
+		c.set(string(value))
+	case REJECTED:
+		c.requested = false
+	case TTABLE_IS:
+		return Build(TTABLE_REJECTED, nil)
+	}
+	return nil
+}
+
+// Prefers the local charset, then the first supported one
+func (c *Conversion) choose(names []string) string {
+	for _, name := range names {
+		if _, canonical, err := Lookup(name); err == nil && canonical == c.Local {
+			return name
+		}
+	}
+	for _, name := range names {
+		if _, _, err := Lookup(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+func (c *Conversion) set(name string) {
+	enc, canonical, err := Lookup(name)
+	if err != nil {
+		return
+	}
+	c.remote = canonical
+	c.toRemote, c.toLocal = nil, nil
+	if canonical != c.Local {
+		c.toRemote = NewTranscoder(c.local, enc)
+		c.toLocal = NewTranscoder(enc, c.local)
+	}
+}
+
+// Converts local output to the agreed charset
+func (c *Conversion) ToRemote(b []byte) []byte {
+	if c == nil {
+		return b
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.toRemote == nil {
+		return b
+	}
+	return c.toRemote.Convert(b)
+}
+
+// Converts data received in the agreed charset to the local charset
+func (c *Conversion) ToLocal(b []byte) []byte {
+	if c == nil {
+		return b
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.toLocal == nil {
+		return b
+	}
+	return c.toLocal.Convert(b)
+}
+
+// Converts local output to UTF-8, such as for recordings
+func (c *Conversion) OutputToUTF8(b []byte) []byte {
+	if c == nil || c.outputUTF8 == nil {
+		return b
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outputUTF8.Convert(b)
+}
+
+// Converts local input to UTF-8, such as for recordings
+func (c *Conversion) InputToUTF8(b []byte) []byte {
+	if c == nil || c.inputUTF8 == nil {
+		return b
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.inputUTF8.Convert(b)
+}
+
+// Builds IAC SB CHARSET subCmd value IAC SE
+func Build(subCmd byte, value []byte) []byte {
+	buf := bytes.NewBuffer([]byte{cmd.IAC, cmd.SB, opt.CHARSET, subCmd})
+	buf.Write(cmd.Escape(value))
+	buf.Write([]byte{cmd.IAC, cmd.SE})
+	return buf.Bytes()
+}
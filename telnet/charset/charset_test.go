@@ -0,0 +1,71 @@
+package charset
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Multibyte characters split across reads are converted once complete
+func TestConvertSplit(t *testing.T) {
+	tests := []struct {
+		local  string
+		remote string
+		input  []byte
+		output []byte
+	}{
+		// "日本" in UTF-8 and EUC-JP
+		{"UTF-8", "EUC-JP", []byte("日本"), []byte{0xc6, 0xfc, 0xcb, 0xdc}},
+		{"EUC-JP", "UTF-8", []byte{0xc6, 0xfc, 0xcb, 0xdc}, []byte("日本")},
+		// "é€" in UTF-8 and ISO-8859-15
+		{"UTF-8", "ISO-8859-15", []byte("é€"), []byte{0xe9, 0xa4}},
+		{"Shift_JIS", "UTF-8", []byte{0x93, 0xfa, 0x96, 0x7b}, []byte("日本")},
+	}
+	for _, test := range tests {
+		c, err := New(test.local, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.set(test.remote)
+		// One byte per read, as typed input arrives
+		var got []byte
+		for _, b := range test.input {
+			got = append(got, c.ToRemote([]byte{b})...)
+		}
+		if !bytes.Equal(got, test.output) {
+			t.Errorf("%s to %s byte by byte = % x, want % x", test.local, test.remote, got, test.output)
+		}
+		// Split in the middle of the first character
+		got = append(c.ToRemote(test.input[:1]), c.ToRemote(test.input[1:])...)
+		if !bytes.Equal(got, test.output) {
+			t.Errorf("%s to %s in two reads = % x, want % x", test.local, test.remote, got, test.output)
+		}
+	}
+}
+
+func TestInputToUTF8Split(t *testing.T) {
+	c, err := New("EUC-JP", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := []byte{'a', 0xc6, 0xfc, 0xcb, 0xdc}
+	var got []byte
+	for i := range input {
+		got = append(got, c.InputToUTF8(input[i:i+1])...)
+	}
+	if string(got) != "a日本" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// Characters missing in the remote charset become SUB without losing the rest
+func TestConvertInvalid(t *testing.T) {
+	c, err := New("UTF-8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.set("ISO-8859-1")
+	got := c.ToRemote([]byte("a日b"))
+	if string(got) != "a\x1ab" {
+		t.Errorf("got % x", got)
+	}
+}
@@ -0,0 +1,14 @@
+module telnet/charset
+
+go 1.18
+
+replace (
+	telnet/command => ../command
+	telnet/option => ../option
+)
+
+require (
+	golang.org/x/text v0.3.7
+	telnet/command v0.0.0-00010101000000-000000000000
+	telnet/option v0.0.0-00010101000000-000000000000
+)
@@ -2,26 +2,104 @@ package client
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"telnet/audit"
+	"telnet/charset"
 	cmd "telnet/command"
+	"telnet/comport"
 	"telnet/connection"
+	"telnet/mud"
 	opt "telnet/option"
+	"telnet/proxy"
+	"telnet/record"
+	"telnet/screen"
 	"telnet/terminal"
+	"telnet/ttype"
+	"time"
+	"unicode/utf8"
 )
 
 type Client struct {
 	connection.Connection
 	InputLength int
+	Config      Config
+	// Copy of EnableOptions readable from other goroutines
+	options atomic.Value
+	// Guards Conn replaced on reconnect
+	connMu sync.Mutex
+	// Set once server output matched Config.LogoutPattern on the current connection
+	loggedOut     int32
+	logoutPattern *regexp.Regexp
+	// Latest output matched against logoutPattern
+	outputTail []byte
+	// Output copied to the running login script
+	scriptOutput chan []byte
+	scriptMu     sync.Mutex
+	// Virtual screen kept from server output for login script steps (nil to disable)
+	Screen *screen.Screen
+	// Last record marked by the server with IAC EOR
+	lastRecord []byte
+	recordMu   sync.Mutex
 }
 
+type Config struct {
+	// asciicast file for session recording (empty to disable)
+	RecordPath string
+	// RFC 2217 serial settings requested from server (nil to disable)
+	ComPort *comport.Settings
+	// Reconnect with backoff after the connection drops
+	Reconnect bool
+	// Attempts before giving up (0 means unlimited)
+	ReconnectAttempts int
+	// Script sent after reconnecting (empty to disable)
+	LoginScript string
+	// Regular expression for server output after which a closed connection
+	// ends the session instead of reconnecting (empty to always reconnect)
+	LogoutPattern string
+	// Proxy URL for socks5:// or http:// (empty to use ALL_PROXY)
+	Proxy string
+	// Server verification and client certificate for TLS (nil to disable)
+	TLS *tls.Config
+	// Wrap the connection in TLS before negotiation (telnets)
+	ImplicitTLS bool
+	// START_TLS mode: "offer" falls back to plaintext, "require" fails (empty to disable)
+	StartTLS string
+	// Charset of the terminal, converted from the one agreed with CHARSET (empty to disable)
+	Charset string
+	// Types sent in turn for TERMINAL-TYPE (empty for $TERM)
+	TerminalTypes []string
+	// JSON lines file for GMCP messages from server (empty to disable)
+	GMCPLog string
+	// XON/XOFF handling asked of the server with LFLOW: "on", "any" to restart on any key, "off" (empty to disable)
+	FlowControl string
+}
+
+// Deadline for TLS handshake and START_TLS negotiation
+const tlsTimeout = 10 * time.Second
+
+// Output kept to match the logout pattern across reads
+const maxOutputTail = 4096
+
+// Backoff between reconnect attempts
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = time.Minute
+)
+
 func (c *Client) Call() {
 	// Request TELNET Commands
 	err := c.ReqCmds(c.SupportOptions)
@@ -36,6 +114,31 @@ func (c *Client) Call() {
 		c.ErrChan <- err
 	}
 	defer c.Terminal.Close()
+	types := c.Config.TerminalTypes
+	if len(types) == 0 {
+		types = []string{c.Terminal.Type}
+	}
+	c.TermTypes = ttype.NewList(types, c.mtts())
+	// Ctrl-S and Ctrl-Q go to the server
+	if c.FlowControl != nil {
+		c.Terminal.DisableFlowControl()
+	}
+	// Screen for login script steps that wait on what is displayed
+	if len(c.Config.LoginScript) > 0 {
+		height, width, _ := c.Terminal.GetSize()
+		c.Screen = screen.New(width, height)
+	}
+
+	// Record session
+	if len(c.Config.RecordPath) > 0 {
+		c.Recorder, err = record.New(c.Config.RecordPath)
+		if err != nil {
+			c.ErrChan <- err
+		}
+		defer c.Recorder.Close()
+		height, width, _ := c.Terminal.GetSize()
+		c.Recorder.Start(width, height, c.Terminal.Type)
+	}
 
 	// Catch signal
 	go c.CatchSignal()
@@ -45,26 +148,216 @@ func (c *Client) Call() {
 	// Read server message
 	for {
 		byteMessage, err := c.ReadMessage()
+		// Only a closed connection after the logout pattern ends the session
+		if err != nil && c.Config.Reconnect && atomic.LoadInt32(&c.loggedOut) == 0 {
+			err = c.Reconnect(err)
+			if err == nil {
+				continue
+			}
+		}
 		if err != nil {
 			c.ErrChan <- err
 			return
 		}
-		if byteMessage != nil {
+		byteMessage = c.Charset.ToLocal(byteMessage)
+		if len(byteMessage) > 0 {
+			c.matchLogout(byteMessage)
+			c.Recorder.Output(byteMessage)
+			c.copyToScript(byteMessage)
+			c.Screen.Write(byteMessage)
 			fmt.Print(string(byteMessage))
 		}
 	}
 }
 
+// Redials with backoff and renegotiates options on the new connection
+func (c *Client) Reconnect(cause error) error {
+	c.Conn.Close()
+	delay := reconnectBaseDelay
+	for attempt := 1; c.Config.ReconnectAttempts == 0 || attempt <= c.Config.ReconnectAttempts; attempt++ {
+		// Jitter between half and full delay
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		reason := "connection closed by foreign host"
+		if cause != io.EOF {
+			reason = cause.Error()
+		}
+		limit := ""
+		if c.Config.ReconnectAttempts > 0 {
+			limit = "/" + strconv.Itoa(c.Config.ReconnectAttempts)
+		}
+		c.status(fmt.Sprintf("Lost connection: %s. Reconnecting in %s (attempt %d%s), ^] quit to stop...", reason, wait.Round(100*time.Millisecond), attempt, limit))
+		time.Sleep(wait)
+		if delay *= 2; delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+
+		c.connMu.Lock()
+		err := c.connect()
+		c.connMu.Unlock()
+		if err != nil {
+			cause = err
+			continue
+		}
+		// Renegotiate all options, other goroutines read the published copy.
+		// Dial replaced the reader, dropping MCCP2 decompression.
+		c.EnableOptions = map[byte]bool{}
+		c.storeOptions()
+		c.Charset.Reset()
+		c.TermTypes.Reset()
+		atomic.StoreInt32(&c.loggedOut, 0)
+		c.outputTail = nil
+		err = c.ReqCmds(c.SupportOptions)
+		if err != nil {
+			c.Conn.Close()
+			cause = err
+			continue
+		}
+		c.status(fmt.Sprintf("Reconnected to %s:%d.", c.IP, c.Port))
+		if len(c.Config.LoginScript) > 0 {
+			go c.RunScript(c.Config.LoginScript)
+		}
+		return nil
+	}
+	return fmt.Errorf("gave up reconnecting: %w", cause)
+}
+
+// Notes the logout pattern in output, also when split across reads
+func (c *Client) matchLogout(b []byte) {
+	if c.logoutPattern == nil {
+		return
+	}
+	c.outputTail = append(c.outputTail, b...)
+	if len(c.outputTail) > maxOutputTail {
+		c.outputTail = c.outputTail[len(c.outputTail)-maxOutputTail:]
+	}
+	if c.logoutPattern.Match(c.outputTail) {
+		atomic.StoreInt32(&c.loggedOut, 1)
+		c.outputTail = nil
+	}
+}
+
+// Dials and secures the connection as configured
+func (c *Client) connect() error {
+	err := c.Dial()
+	if err != nil {
+		return err
+	}
+	if !c.Config.ImplicitTLS && len(c.Config.StartTLS) == 0 {
+		return nil
+	}
+	c.Conn.SetDeadline(time.Now().Add(tlsTimeout))
+	defer c.Conn.SetDeadline(time.Time{})
+	if c.Config.ImplicitTLS {
+		err = c.UpgradeTLS(c.Config.TLS)
+	} else {
+		err = c.StartTLS(c.Config.TLS)
+		if err == connection.ErrStartTLSRefused && c.Config.StartTLS == "offer" {
+			return nil
+		}
+	}
+	if err != nil {
+		c.Conn.Close()
+	}
+	return err
+}
+
+// GMCP message written to the log
+type gmcpEvent struct {
+	Time    time.Time       `json:"time"`
+	Package string          `json:"package"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Sends a GMCP message if the server enabled GMCP
+func (c *Client) SendGMCP(pkg string, data interface{}) error {
+	if !c.IsEnabled(opt.GMCP) {
+		return fmt.Errorf("GMCP is not enabled by server")
+	}
+	message, err := mud.BuildGMCP(pkg, data)
+	if err != nil {
+		return err
+	}
+	return c.send(message)
+}
+
+// Returns MTTS capability bits of the local terminal
+func (c *Client) mtts() int {
+	bits := ttype.ANSI | ttype.VT100
+	locale := os.Getenv("LC_ALL") + os.Getenv("LC_CTYPE") + os.Getenv("LANG")
+	if c.Charset != nil {
+		locale = c.Charset.Local
+	}
+	if strings.Contains(strings.ToUpper(locale), "UTF-8") || strings.Contains(strings.ToUpper(locale), "UTF8") {
+		bits |= ttype.UTF8
+	}
+	if strings.Contains(c.Terminal.Type, "256color") {
+		bits |= ttype.COLORS_256
+	}
+	if colorterm := os.Getenv("COLORTERM"); colorterm == "truecolor" || colorterm == "24bit" {
+		bits |= ttype.TRUECOLOR
+	}
+	if _, ok := c.Conn.(*tls.Conn); ok {
+		bits |= ttype.SSL
+	}
+	return bits
+}
+
+// Prints a status line on the raw terminal
+func (c *Client) status(message string) {
+	fmt.Print("\r\n[" + message + "]\r\n")
+}
+
+// Publishes a copy of enabled options for the input and signal goroutines
+func (c *Client) storeOptions() {
+	enableOptions := make(map[byte]bool, len(c.EnableOptions))
+	for option, enabled := range c.EnableOptions {
+		enableOptions[option] = enabled
+	}
+	c.options.Store(enableOptions)
+}
+
+// Requests options and publishes the ones enabled
+func (c *Client) ReqCmds(subCmds []byte) error {
+	err := c.Connection.ReqCmds(subCmds)
+	c.storeOptions()
+	return err
+}
+
+// Reads server message and publishes options changed by negotiation
+func (c *Client) ReadMessage() ([]byte, error) {
+	byteMessage, err := c.Connection.ReadMessage()
+	c.storeOptions()
+	return byteMessage, err
+}
+
+// Reports whether option is enabled on the connection
+func (c *Client) IsEnabled(option byte) bool {
+	enableOptions, _ := c.options.Load().(map[byte]bool)
+	return enableOptions[option]
+}
+
+// Writes to the current connection, which may be replaced on reconnect
+func (c *Client) send(b []byte) error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.WriteBytes(b)
+}
+
 func (c *Client) ScanAndWrite() {
 	c.InputLength = 0
 	for {
-		r, _, err := c.Terminal.ReadRune()
+		// Bytes in the terminal charset; ToRemote keeps a partial character until the rest is read
+		b, err := c.Terminal.ReadByte()
 		if err != nil {
 			c.ErrChan <- err
 			return
 		}
-		if !c.EnableOptions[opt.ECHO] {
-			switch r {
+		if b == escapeChar {
+			c.command()
+			continue
+		}
+		if !c.IsEnabled(opt.ECHO) {
+			switch b {
 			case '\r', '\n':
 				c.InputLength = 0
 				fmt.Print("\n")
@@ -74,12 +367,19 @@ func (c *Client) ScanAndWrite() {
 					c.InputLength--
 				}
 			default:
-				fmt.Print(string(r))
-				c.InputLength++
+				os.Stdout.Write([]byte{b})
+				if utf8.RuneStart(b) {
+					c.InputLength++
+				}
 			}
 		}
-		err = c.WriteByte(byte(r))
-		if err != nil {
+		input := c.Charset.ToRemote([]byte{b})
+		if len(input) == 0 {
+			continue
+		}
+		err = c.send(input)
+		// Input is dropped while reconnecting
+		if err != nil && !c.Config.Reconnect {
 			c.ErrChan <- err
 			return
 		}
@@ -88,20 +388,28 @@ func (c *Client) ScanAndWrite() {
 
 func (c *Client) CatchSignal() {
 	var err error
-	signalChan := make(chan os.Signal)
+	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGWINCH)
 	for {
 		switch <-signalChan {
 		case os.Interrupt:
-			err = c.WriteByte(3)
+			err = c.send([]byte{3})
 		case syscall.SIGWINCH:
-			byteNAWSReq, err := BuildCmdRes(c.Connection, cmd.DO, opt.NEGOTIATE_ABOUT_WINDOW_SIZE)
+			// Report new window size
+			if !c.IsEnabled(opt.NEGOTIATE_ABOUT_WINDOW_SIZE) {
+				continue
+			}
+			var height, width int
+			height, width, err = c.Terminal.GetSize()
 			if err != nil {
 				c.ErrChan <- err
+				continue
 			}
-			err = c.WriteBytes(byteNAWSReq)
+			c.Recorder.Resize(width, height)
+			c.Screen.Resize(width, height)
+			err = c.send(BuildNAWS(width, height))
 		}
-		if err != nil {
+		if err != nil && !c.Config.Reconnect {
 			c.ErrChan <- err
 		}
 	}
@@ -118,19 +426,72 @@ func New(ip string, port int, supportOptions []byte) *Client {
 	return c
 }
 
-func Run(ip string, port int) {
+func Run(ip string, port int, config Config) {
 	// New TELNET Client
 	supportOptions := []byte{opt.ECHO, opt.NEGOTIATE_ABOUT_WINDOW_SIZE, opt.TERMINAL_SPEED, opt.TERMINAL_TYPE, opt.SUPPRESS_GO_AHEAD}
+	if config.ComPort != nil {
+		supportOptions = append(supportOptions, opt.COM_PORT_OPTION)
+	}
+	if len(config.Charset) > 0 {
+		supportOptions = append(supportOptions, opt.CHARSET)
+	}
+	supportOptions = append(supportOptions, opt.MCCP2, opt.GMCP, opt.END_OF_RECORD)
+	if len(config.FlowControl) > 0 {
+		supportOptions = append(supportOptions, opt.LFLOW)
+	}
 	c := New(ip, port, supportOptions)
+	c.Config = config
+	c.ComPortSettings = config.ComPort
+	c.TimingMark = new(connection.TimingMark)
+	if len(config.FlowControl) > 0 {
+		c.FlowControl = connection.NewFlowControl(config.FlowControl != "off", config.FlowControl == "any")
+	}
+	c.OnRecord = func(record []byte) {
+		c.recordMu.Lock()
+		c.lastRecord = record
+		c.recordMu.Unlock()
+	}
+	var err error
+	if len(config.LogoutPattern) > 0 {
+		c.logoutPattern, err = regexp.Compile(config.LogoutPattern)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	}
+	if len(config.Charset) > 0 {
+		c.Charset, err = charset.New(config.Charset, nil)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+	}
+	c.Dialer, err = proxy.New(config.Proxy)
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+
+	// Log GMCP messages
+	if len(config.GMCPLog) > 0 {
+		gmcpLog, err := audit.New(config.GMCPLog)
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		defer gmcpLog.Close()
+		c.MUD = &mud.Handler{GMCP: func(message mud.GMCP) {
+			gmcpLog.Log(gmcpEvent{Time: time.Now(), Package: message.Package, Data: message.Data})
+		}}
+	}
 
 	// TCP Dial
 	fmt.Printf("Trying %s:%d...\n", ip, port)
-	err := c.Dial()
+	err = c.connect()
 	if err != nil {
 		log.Fatalln("Error:", err)
 	}
 	defer c.Conn.Close()
 	fmt.Printf("Connected to %s:%d.\n", ip, port)
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+		fmt.Printf("Secured with %s.\n", tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite))
+	}
 
 	// TELNET Call
 	go c.Call()
@@ -139,7 +500,10 @@ func Run(ip string, port int) {
 	c.ErrChan = make(chan error)
 	defer close(c.ErrChan)
 	for err := range c.ErrChan {
-		if err == io.EOF {
+		if err == errQuit {
+			c.Terminal.Close()
+			fmt.Println("Connection closed.")
+		} else if err == io.EOF {
 			fmt.Println("Connection closed by foreign host.")
 		} else {
 			log.Fatalln("Error:", err)
@@ -161,22 +525,38 @@ func BuildCmdRes(c connection.Connection, mainCmd byte, subCmd byte, options ...
 				nextStatus = false
 				break
 			}
-			SEND := byte(1)
-			IS := byte(0)
-			if options[0] != SEND {
-				break
-			}
-			bufOptionRes := bytes.NewBuffer([]byte{cmd.IAC, cmd.SB, subCmd, IS})
 			switch subCmd {
-			case opt.TERMINAL_SPEED:
-				bufOptionRes.Write([]byte(strconv.Itoa(int(c.Terminal.Termios.Ospeed)) + "," + strconv.Itoa(int(c.Terminal.Termios.Ispeed))))
-				_, err = bufCmdsRes.Write(bufOptionRes.Bytes())
-			case opt.TERMINAL_TYPE:
-				bufOptionRes.Write([]byte(strings.ToUpper(c.Terminal.Type)))
-				_, err = bufCmdsRes.Write(bufOptionRes.Bytes())
+			case opt.CHARSET:
+				_, err = bufCmdsRes.Write(c.Charset.Handle(options))
+				nextStatus = true
+			case opt.GMCP:
+				c.MUD.Handle(subCmd, options)
+				nextStatus = true
+			case opt.MCCP2:
+				// Decompression starts in ReadMessage
+				nextStatus = true
+			default:
+				SEND := byte(1)
+				IS := byte(0)
+				if options[0] != SEND {
+					break
+				}
+				bufOptionRes := bytes.NewBuffer([]byte{cmd.IAC, cmd.SB, subCmd, IS})
+				switch subCmd {
+				case opt.TERMINAL_SPEED:
+					bufOptionRes.Write([]byte(strconv.Itoa(int(c.Terminal.Termios.Ospeed)) + "," + strconv.Itoa(int(c.Terminal.Termios.Ispeed))))
+					_, err = bufCmdsRes.Write(bufOptionRes.Bytes())
+				case opt.TERMINAL_TYPE:
+					name := c.TermTypes.Next()
+					if len(name) == 0 {
+						name = strings.ToUpper(c.Terminal.Type)
+					}
+					bufOptionRes.Write([]byte(name))
+					_, err = bufCmdsRes.Write(bufOptionRes.Bytes())
+				}
+				_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.SE})
+				nextStatus = true
 			}
-			_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.SE})
-			nextStatus = true
 		}
 
 		_, ok := c.EnableOptions[subCmd]
@@ -193,13 +573,27 @@ func BuildCmdRes(c connection.Connection, mainCmd byte, subCmd byte, options ...
 			nextStatus = false
 			break
 		}
+		if subCmd == opt.LFLOW {
+			// DO was sent with the initial requests
+			if !c.EnableOptions[subCmd] {
+				_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.DO, subCmd})
+			}
+			_, err = bufCmdsRes.Write(c.FlowControl.Request())
+			c.EnableOptions[subCmd] = true
+			return bufCmdsRes.Bytes(), err
+		}
 		_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.DO, subCmd})
+		if subCmd == opt.GMCP && !c.EnableOptions[subCmd] {
+			hello, _ := mud.BuildGMCP("Core.Hello", map[string]string{"client": "telnet", "version": "1.0"})
+			_, err = bufCmdsRes.Write(hello)
+		}
 		nextStatus = true
 	case cmd.WONT:
 		_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.WONT, subCmd})
 		nextStatus = false
 	case cmd.DO:
-		if !c.IsSupportOption(subCmd) || subCmd == opt.ECHO {
+		// Input is not sent in records, flow control is asked of the server
+		if !c.IsSupportOption(subCmd) || subCmd == opt.ECHO || subCmd == opt.END_OF_RECORD || subCmd == opt.LFLOW {
 			_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.WONT, subCmd})
 			nextStatus = c.IsSupportOption(subCmd) && subCmd == opt.ECHO
 			break
@@ -210,10 +604,9 @@ func BuildCmdRes(c connection.Connection, mainCmd byte, subCmd byte, options ...
 		switch subCmd {
 		case opt.NEGOTIATE_ABOUT_WINDOW_SIZE:
 			height, width, _ := c.Terminal.GetSize()
-			_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.SB, opt.NEGOTIATE_ABOUT_WINDOW_SIZE})
-			binary.Write(bufCmdsRes, binary.BigEndian, int16(width))
-			binary.Write(bufCmdsRes, binary.BigEndian, int16(height))
-			_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.SE})
+			_, err = bufCmdsRes.Write(BuildNAWS(width, height))
+		case opt.COM_PORT_OPTION:
+			_, err = bufCmdsRes.Write(c.ComPortSettings.Build())
 		}
 		nextStatus = true
 	case cmd.DONT:
@@ -222,9 +615,19 @@ func BuildCmdRes(c connection.Connection, mainCmd byte, subCmd byte, options ...
 	}
 
 	status, ok := c.EnableOptions[subCmd]
-	if ok && status == nextStatus && (subCmd != opt.ECHO && subCmd != opt.NEGOTIATE_ABOUT_WINDOW_SIZE) {
+	if ok && status == nextStatus && (subCmd != opt.ECHO && subCmd != opt.NEGOTIATE_ABOUT_WINDOW_SIZE && subCmd != opt.COM_PORT_OPTION) {
 		return nil, err
 	}
 	c.EnableOptions[subCmd] = nextStatus
 	return bufCmdsRes.Bytes(), err
 }
+
+func BuildNAWS(width int, height int) []byte {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint16(size[0:2], uint16(width))
+	binary.BigEndian.PutUint16(size[2:4], uint16(height))
+	bufNAWS := bytes.NewBuffer([]byte{cmd.IAC, cmd.SB, opt.NEGOTIATE_ABOUT_WINDOW_SIZE})
+	bufNAWS.Write(cmd.Escape(size))
+	bufNAWS.Write([]byte{cmd.IAC, cmd.SE})
+	return bufNAWS.Bytes()
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	opt "telnet/option"
+	"time"
+)
+
+// Ctrl-] enters command mode as in BSD telnet
+const escapeChar = '\x1d'
+
+// Reported by the quit command to end the session, also while reconnecting
+var errQuit = errors.New("quit")
+
+// Deadline for the TIMING-MARK reply measured by status
+const timingMarkTimeout = 5 * time.Second
+
+// Reads a command line after the escape character and runs it
+func (c *Client) command() {
+	fmt.Print("\r\ntelnet> ")
+	line := []rune{}
+	for {
+		r, _, err := c.Terminal.ReadRune()
+		if err != nil {
+			return
+		}
+		if r == '\r' || r == '\n' {
+			break
+		}
+		switch r {
+		case '\177', '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				fmt.Print("\b \b")
+			}
+		default:
+			line = append(line, r)
+			fmt.Print(string(r))
+		}
+	}
+	fmt.Print("\r\n")
+	switch strings.TrimSpace(string(line)) {
+	case "":
+	case "status":
+		c.printStatus()
+	case "quit":
+		c.ErrChan <- errQuit
+	default:
+		fmt.Print("Commands: status, quit\r\n")
+	}
+}
+
+// Prints connection, enabled options, round trip time and the last record
+func (c *Client) printStatus() {
+	fmt.Printf("Connected to %s:%d.\r\n", c.IP, c.Port)
+	names := []string{}
+	enableOptions, _ := c.options.Load().(map[byte]bool)
+	for option, enabled := range enableOptions {
+		if enabled {
+			names = append(names, opt.Name(option))
+		}
+	}
+	sort.Strings(names)
+	fmt.Printf("Options: %s\r\n", strings.Join(names, ", "))
+
+	// Application-level round trip through the server's input processing
+	err := c.send(c.TimingMark.Probe())
+	if err == nil {
+		var rtt time.Duration
+		rtt, err = c.TimingMark.Wait(timingMarkTimeout)
+		if err == nil {
+			fmt.Printf("Round trip time: %s\r\n", rtt.Round(time.Microsecond))
+		}
+	}
+	if err != nil {
+		fmt.Printf("Round trip time: %s\r\n", err)
+	}
+
+	c.recordMu.Lock()
+	record := c.lastRecord
+	c.recordMu.Unlock()
+	if c.IsEnabled(opt.END_OF_RECORD) {
+		fmt.Printf("Last record: %q\r\n", record)
+	}
+}
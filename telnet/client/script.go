@@ -0,0 +1,120 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Wait time for text expected by login script
+const expectTimeout = 30 * time.Second
+
+// Step of login script: "expect <text>", "screen <text>", "send <text>",
+// "sleep <duration>" or "quit" to end the session
+type Step struct {
+	Action string
+	Arg    string
+}
+
+// Reads a login script, skipping blank lines and # comments
+func LoadScript(path string) ([]Step, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var steps []Step
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		action, arg, _ := strings.Cut(line, " ")
+		switch action {
+		case "expect", "screen", "send", "quit":
+		case "sleep":
+			if _, err := time.ParseDuration(arg); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown action %q", path, n, action)
+		}
+		steps = append(steps, Step{Action: action, Arg: arg})
+	}
+	return steps, scanner.Err()
+}
+
+// Plays login script against server output
+func (c *Client) RunScript(path string) {
+	steps, err := LoadScript(path)
+	if err != nil {
+		c.status("Login script: " + err.Error())
+		return
+	}
+	output := make(chan []byte, 256)
+	c.scriptMu.Lock()
+	c.scriptOutput = output
+	c.scriptMu.Unlock()
+	defer func() {
+		c.scriptMu.Lock()
+		c.scriptOutput = nil
+		c.scriptMu.Unlock()
+	}()
+
+	var received strings.Builder
+	for _, step := range steps {
+		switch step.Action {
+		case "expect":
+			timer := time.NewTimer(expectTimeout)
+			for !strings.Contains(received.String(), step.Arg) {
+				select {
+				case b := <-output:
+					received.Write(b)
+				case <-timer.C:
+					c.status(fmt.Sprintf("Login script: timed out waiting for %q", step.Arg))
+					return
+				}
+			}
+			timer.Stop()
+			// Keep output after the match for next expect
+			rest := received.String()
+			rest = rest[strings.Index(rest, step.Arg)+len(step.Arg):]
+			received.Reset()
+			received.WriteString(rest)
+		case "screen":
+			// Text anywhere on the screen, also drawn by cursor movement or left from before reconnecting
+			_, err = c.Screen.WaitFor(step.Arg, expectTimeout)
+			if err != nil {
+				c.status(fmt.Sprintf("Login script: timed out waiting for %q on screen", step.Arg))
+				return
+			}
+		case "send":
+			err = c.send([]byte(step.Arg + "\r"))
+			if err != nil {
+				return
+			}
+		case "sleep":
+			duration, _ := time.ParseDuration(step.Arg)
+			time.Sleep(duration)
+		case "quit":
+			c.ErrChan <- errQuit
+			return
+		}
+	}
+}
+
+// Passes server output to the running login script
+func (c *Client) copyToScript(b []byte) {
+	c.scriptMu.Lock()
+	defer c.scriptMu.Unlock()
+	if c.scriptOutput == nil {
+		return
+	}
+	select {
+	case c.scriptOutput <- append([]byte(nil), b...):
+	default:
+	}
+}
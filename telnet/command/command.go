@@ -1,5 +1,10 @@
 package command
 
+import (
+	"bytes"
+	"strconv"
+)
+
 const (
 	SE byte = 240 + iota //	End of subnegotiation parameters.
 	NOP
@@ -21,6 +26,72 @@ const (
 	IAC
 )
 
+// End of record marker of RFC 885
+const EOR byte = 239
+
+var names = map[byte]string{
+	EOR:               "EOR",
+	SE:                "SE",
+	NOP:               "NOP",
+	DATA_MARK:         "DM",
+	BREAK:             "BRK",
+	INTERRUPT_PROCESS: "IP",
+	ABORT_OUTPUT:      "AO",
+	ARE_YOU_THERE:     "AYT",
+	ERASE_CHARACTER:   "EC",
+	ERASE_LINE:        "EL",
+	GO_AHEAD:          "GA",
+	SB:                "SB",
+	WILL:              "WILL",
+	WONT:              "WONT",
+	DO:                "DO",
+	DONT:              "DONT",
+	IAC:               "IAC",
+}
+
+func Name(cmd byte) string {
+	name, ok := names[cmd]
+	if !ok {
+		return strconv.Itoa(int(cmd))
+	}
+	return name
+}
+
 func IsNeedOption(cmd byte) bool {
 	return WILL <= cmd && cmd < IAC
 }
+
+// Doubles IAC bytes in data or subnegotiation parameters
+func Escape(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{IAC}, []byte{IAC, IAC})
+}
+
+func Unescape(b []byte) []byte {
+	return bytes.ReplaceAll(b, []byte{IAC, IAC}, []byte{IAC})
+}
+
+// Returns length of the command starting with IAC at the start of b, 0 if incomplete
+func Length(b []byte) int {
+	if len(b) < 2 {
+		return 0
+	}
+	switch {
+	case b[1] == SB:
+		for j := 2; j+1 < len(b); j++ {
+			if b[j] != IAC {
+				continue
+			}
+			if b[j+1] == SE {
+				return j + 2
+			}
+			j++
+		}
+		return 0
+	case IsNeedOption(b[1]):
+		if len(b) < 3 {
+			return 0
+		}
+		return 3
+	}
+	return 2
+}
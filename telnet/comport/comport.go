@@ -0,0 +1,577 @@
+package comport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	cmd "telnet/command"
+	opt "telnet/option"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// RFC 2217 subcommands sent by client (server replies add 100)
+const (
+	SIGNATURE           byte = 0
+	SET_BAUDRATE        byte = 1
+	SET_DATASIZE        byte = 2
+	SET_PARITY          byte = 3
+	SET_STOPSIZE        byte = 4
+	SET_CONTROL         byte = 5
+	NOTIFY_LINESTATE    byte = 6
+	NOTIFY_MODEMSTATE   byte = 7
+	FLOWCONTROL_SUSPEND byte = 8
+	FLOWCONTROL_RESUME  byte = 9
+	SET_LINESTATE_MASK  byte = 10
+	SET_MODEMSTATE_MASK byte = 11
+	PURGE_DATA          byte = 12
+	SERVER_OFFSET       byte = 100
+)
+
+// SET-PARITY values
+const (
+	PARITY_NONE  byte = 1
+	PARITY_ODD   byte = 2
+	PARITY_EVEN  byte = 3
+	PARITY_MARK  byte = 4
+	PARITY_SPACE byte = 5
+)
+
+// SET-STOPSIZE values
+const (
+	STOPSIZE_ONE  byte = 1
+	STOPSIZE_TWO  byte = 2
+	STOPSIZE_ONE5 byte = 3
+)
+
+// SET-CONTROL values
+const (
+	FLOW_REQUEST          byte = 0
+	FLOW_NONE             byte = 1
+	FLOW_XONXOFF          byte = 2
+	FLOW_HARDWARE         byte = 3
+	BREAK_REQUEST         byte = 4
+	BREAK_ON              byte = 5
+	BREAK_OFF             byte = 6
+	DTR_REQUEST           byte = 7
+	DTR_ON                byte = 8
+	DTR_OFF               byte = 9
+	RTS_REQUEST           byte = 10
+	RTS_ON                byte = 11
+	RTS_OFF               byte = 12
+	INBOUND_FLOW_REQUEST  byte = 13
+	INBOUND_FLOW_NONE     byte = 14
+	INBOUND_FLOW_XONXOFF  byte = 15
+	INBOUND_FLOW_HARDWARE byte = 16
+)
+
+// PURGE-DATA values
+const (
+	PURGE_RX   byte = 1
+	PURGE_TX   byte = 2
+	PURGE_BOTH byte = 3
+)
+
+// NOTIFY-LINESTATE bits
+const (
+	LINE_OVERRUN byte = 1 << 1
+	LINE_PARITY  byte = 1 << 2
+	LINE_FRAMING byte = 1 << 3
+	LINE_BREAK   byte = 1 << 4
+)
+
+// NOTIFY-MODEMSTATE bits
+const (
+	MODEM_DELTA_CTS byte = 1 << 0
+	MODEM_DELTA_DSR byte = 1 << 1
+	MODEM_RI_TRAIL  byte = 1 << 2
+	MODEM_DELTA_CD  byte = 1 << 3
+	MODEM_CTS       byte = 1 << 4
+	MODEM_DSR       byte = 1 << 5
+	MODEM_RI        byte = 1 << 6
+	MODEM_CD        byte = 1 << 7
+)
+
+// Interval for polling modem and line state
+const pollInterval = 100 * time.Millisecond
+
+var baudRates = map[uint32]uint32{
+	50:      unix.B50,
+	75:      unix.B75,
+	110:     unix.B110,
+	134:     unix.B134,
+	150:     unix.B150,
+	200:     unix.B200,
+	300:     unix.B300,
+	600:     unix.B600,
+	1200:    unix.B1200,
+	1800:    unix.B1800,
+	2400:    unix.B2400,
+	4800:    unix.B4800,
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	500000:  unix.B500000,
+	576000:  unix.B576000,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+	1152000: unix.B1152000,
+	1500000: unix.B1500000,
+	2000000: unix.B2000000,
+	2500000: unix.B2500000,
+	3000000: unix.B3000000,
+	3500000: unix.B3500000,
+	4000000: unix.B4000000,
+}
+
+// Serial device controlled by COM-PORT-OPTION (server)
+type Port struct {
+	File      *os.File
+	Signature string
+	// Notification masks set by client
+	lineMask  byte
+	modemMask byte
+	// Output to client paused by FLOWCONTROL-SUSPEND
+	suspended bool
+	closed    bool
+	breakOn   bool
+	mu        sync.Mutex
+	resume    *sync.Cond
+}
+
+// struct serial_icounter_struct
+type icounter struct {
+	cts, dsr, rng, dcd int32
+	rx, tx             int32
+	frame, overrun     int32
+	parity, brk        int32
+	bufOverrun         int32
+	reserved           [9]int32
+}
+
+func New(file *os.File) *Port {
+	p := new(Port)
+	p.File = file
+	p.Signature = file.Name()
+	p.modemMask = 255
+	p.resume = sync.NewCond(&p.mu)
+	return p
+}
+
+// Applies a client subnegotiation and returns the server reply
+func (p *Port) Handle(options []byte) ([]byte, error) {
+	if p == nil || len(options) == 0 {
+		return nil, nil
+	}
+	subCmd, value := options[0], options[1:]
+	var err error
+	switch subCmd {
+	case SIGNATURE:
+		// Text from client is informational only
+		if len(value) > 0 {
+			return nil, nil
+		}
+		return Build(SIGNATURE+SERVER_OFFSET, []byte(p.Signature)), nil
+	case SET_BAUDRATE:
+		if len(value) != 4 {
+			return nil, fmt.Errorf("invalid SET-BAUDRATE length %d", len(value))
+		}
+		if rate := binary.BigEndian.Uint32(value); rate > 0 {
+			err = p.SetBaudRate(rate)
+		}
+		rate, getErr := p.BaudRate()
+		if err == nil {
+			err = getErr
+		}
+		reply := make([]byte, 4)
+		binary.BigEndian.PutUint32(reply, rate)
+		return Build(subCmd+SERVER_OFFSET, reply), err
+	case SET_DATASIZE, SET_PARITY, SET_STOPSIZE, SET_CONTROL:
+		if len(value) != 1 {
+			return nil, fmt.Errorf("invalid COM-PORT subcommand %d length %d", subCmd, len(value))
+		}
+		var current byte
+		current, err = p.set(subCmd, value[0])
+		return Build(subCmd+SERVER_OFFSET, []byte{current}), err
+	case FLOWCONTROL_SUSPEND:
+		p.mu.Lock()
+		p.suspended = true
+		p.mu.Unlock()
+		return nil, nil
+	case FLOWCONTROL_RESUME:
+		p.mu.Lock()
+		p.suspended = false
+		p.resume.Broadcast()
+		p.mu.Unlock()
+		return nil, nil
+	case SET_LINESTATE_MASK, SET_MODEMSTATE_MASK:
+		if len(value) != 1 {
+			return nil, fmt.Errorf("invalid COM-PORT subcommand %d length %d", subCmd, len(value))
+		}
+		p.mu.Lock()
+		if subCmd == SET_LINESTATE_MASK {
+			p.lineMask = value[0]
+		} else {
+			p.modemMask = value[0]
+		}
+		p.mu.Unlock()
+		return Build(subCmd+SERVER_OFFSET, value), nil
+	case PURGE_DATA:
+		if len(value) != 1 {
+			return nil, fmt.Errorf("invalid PURGE-DATA length %d", len(value))
+		}
+		queues := map[byte]int{PURGE_RX: unix.TCIFLUSH, PURGE_TX: unix.TCOFLUSH, PURGE_BOTH: unix.TCIOFLUSH}
+		queue, ok := queues[value[0]]
+		if !ok {
+			return nil, fmt.Errorf("invalid PURGE-DATA value %d", value[0])
+		}
+		err = p.control(func(fd int) error {
+			return unix.IoctlSetInt(fd, unix.TCFLSH, queue)
+		})
+		return Build(subCmd+SERVER_OFFSET, value), err
+	}
+	return nil, nil
+}
+
+// Handles SET-DATASIZE, SET-PARITY, SET-STOPSIZE and SET-CONTROL, returning current value
+func (p *Port) set(subCmd byte, value byte) (byte, error) {
+	var current byte
+	if subCmd == SET_CONTROL {
+		switch value {
+		case BREAK_REQUEST, BREAK_ON, BREAK_OFF:
+			return p.setBreak(value)
+		case DTR_REQUEST, DTR_ON, DTR_OFF:
+			return p.setModemLine(unix.TIOCM_DTR, value, DTR_REQUEST)
+		case RTS_REQUEST, RTS_ON, RTS_OFF:
+			return p.setModemLine(unix.TIOCM_RTS, value, RTS_REQUEST)
+		}
+	}
+	err := p.update(func(t *unix.Termios) bool {
+		switch subCmd {
+		case SET_DATASIZE:
+			sizes := map[byte]uint32{5: unix.CS5, 6: unix.CS6, 7: unix.CS7, 8: unix.CS8}
+			if size, ok := sizes[value]; ok {
+				t.Cflag = t.Cflag&^unix.CSIZE | size
+			}
+			for k, v := range sizes {
+				if t.Cflag&unix.CSIZE == v {
+					current = k
+				}
+			}
+			return value != 0
+		case SET_PARITY:
+			flags := map[byte]uint32{
+				PARITY_NONE:  0,
+				PARITY_ODD:   unix.PARENB | unix.PARODD,
+				PARITY_EVEN:  unix.PARENB,
+				PARITY_MARK:  unix.PARENB | unix.PARODD | unix.CMSPAR,
+				PARITY_SPACE: unix.PARENB | unix.CMSPAR,
+			}
+			mask := uint32(unix.PARENB | unix.PARODD | unix.CMSPAR)
+			if flag, ok := flags[value]; ok {
+				t.Cflag = t.Cflag&^mask | flag
+			}
+			for k, v := range flags {
+				if t.Cflag&mask == v {
+					current = k
+				}
+			}
+			return value != 0
+		case SET_STOPSIZE:
+			// 1.5 stop bits is only used with 5 data bits, where CSTOPB means it
+			switch value {
+			case STOPSIZE_ONE:
+				t.Cflag &^= unix.CSTOPB
+			case STOPSIZE_TWO, STOPSIZE_ONE5:
+				t.Cflag |= unix.CSTOPB
+			}
+			current = STOPSIZE_ONE
+			if t.Cflag&unix.CSTOPB != 0 {
+				current = STOPSIZE_TWO
+			}
+			return value != 0
+		case SET_CONTROL:
+			inbound := value >= INBOUND_FLOW_REQUEST
+			switch value {
+			case FLOW_NONE:
+				t.Iflag &^= unix.IXON
+				t.Cflag &^= unix.CRTSCTS
+			case FLOW_XONXOFF:
+				t.Iflag |= unix.IXON
+				t.Cflag &^= unix.CRTSCTS
+			case FLOW_HARDWARE, INBOUND_FLOW_HARDWARE:
+				t.Iflag &^= unix.IXON | unix.IXOFF
+				t.Cflag |= unix.CRTSCTS
+			case INBOUND_FLOW_NONE:
+				t.Iflag &^= unix.IXOFF
+				t.Cflag &^= unix.CRTSCTS
+			case INBOUND_FLOW_XONXOFF:
+				t.Iflag |= unix.IXOFF
+				t.Cflag &^= unix.CRTSCTS
+			}
+			current = FLOW_NONE
+			xon := uint32(unix.IXON)
+			if inbound {
+				current = INBOUND_FLOW_NONE
+				xon = unix.IXOFF
+			}
+			if t.Cflag&unix.CRTSCTS != 0 {
+				current += 2
+			} else if t.Iflag&xon != 0 {
+				current++
+			}
+			return value != FLOW_REQUEST && value != INBOUND_FLOW_REQUEST
+		}
+		return false
+	})
+	return current, err
+}
+
+func (p *Port) setBreak(value byte) (byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var err error
+	switch value {
+	case BREAK_ON:
+		err = p.control(func(fd int) error {
+			return unix.IoctlSetInt(fd, unix.TIOCSBRK, 0)
+		})
+		if err == nil {
+			p.breakOn = true
+		}
+	case BREAK_OFF:
+		err = p.control(func(fd int) error {
+			return unix.IoctlSetInt(fd, unix.TIOCCBRK, 0)
+		})
+		if err == nil {
+			p.breakOn = false
+		}
+	}
+	if p.breakOn {
+		return BREAK_ON, err
+	}
+	return BREAK_OFF, err
+}
+
+// Sets or reports DTR or RTS, where value is relative to request
+func (p *Port) setModemLine(line int, value byte, request byte) (byte, error) {
+	var err error
+	switch value - request {
+	case 1:
+		err = p.control(func(fd int) error {
+			return unix.IoctlSetPointerInt(fd, unix.TIOCMBIS, line)
+		})
+	case 2:
+		err = p.control(func(fd int) error {
+			return unix.IoctlSetPointerInt(fd, unix.TIOCMBIC, line)
+		})
+	}
+	var bits int
+	getErr := p.control(func(fd int) (err error) {
+		bits, err = unix.IoctlGetInt(fd, unix.TIOCMGET)
+		return err
+	})
+	if err == nil {
+		err = getErr
+	}
+	if bits&line != 0 {
+		return request + 1, err
+	}
+	return request + 2, err
+}
+
+func (p *Port) SetBaudRate(rate uint32) error {
+	speed, ok := baudRates[rate]
+	if !ok {
+		return fmt.Errorf("unsupported baud rate %d", rate)
+	}
+	return p.update(func(t *unix.Termios) bool {
+		t.Cflag = t.Cflag&^unix.CBAUD | speed
+		t.Ispeed = rate
+		t.Ospeed = rate
+		return true
+	})
+}
+
+func (p *Port) BaudRate() (uint32, error) {
+	var rate uint32
+	err := p.update(func(t *unix.Termios) bool {
+		for k, v := range baudRates {
+			if t.Cflag&unix.CBAUD == v {
+				rate = k
+			}
+		}
+		return false
+	})
+	return rate, err
+}
+
+// Reads termios, lets modify change it and writes back if it returns true
+func (p *Port) update(modify func(t *unix.Termios) bool) error {
+	return p.control(func(fd int) error {
+		t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		if err != nil {
+			return err
+		}
+		if !modify(t) {
+			return nil
+		}
+		return unix.IoctlSetTermios(fd, unix.TCSETS, t)
+	})
+}
+
+// Runs f on the device fd without switching it to blocking mode
+func (p *Port) control(f func(fd int) error) error {
+	raw, err := p.File.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ctlErr error
+	err = raw.Control(func(fd uintptr) {
+		ctlErr = f(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return ctlErr
+}
+
+// Blocks while client suspended output with FLOWCONTROL-SUSPEND
+func (p *Port) WaitResume() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.suspended && !p.closed {
+		p.resume.Wait()
+	}
+}
+
+// Releases goroutines waiting for resume
+func (p *Port) Close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.resume.Broadcast()
+}
+
+// Polls modem and line state and sends notifications until done
+func (p *Port) Watch(done <-chan struct{}, notify func([]byte) error) {
+	modem, modemErr := p.modemState()
+	counter, lineErr := p.counters()
+	if modemErr != nil && lineErr != nil {
+		// Neither is supported by the device, such as a pty
+		return
+	}
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		lineMask, modemMask := p.lineMask, p.modemMask
+		p.mu.Unlock()
+
+		if modemErr == nil {
+			state, err := p.modemState()
+			if err == nil && state != modem {
+				changed := state ^ modem
+				deltas := byte(0)
+				if changed&MODEM_CTS != 0 {
+					deltas |= MODEM_DELTA_CTS
+				}
+				if changed&MODEM_DSR != 0 {
+					deltas |= MODEM_DELTA_DSR
+				}
+				if changed&MODEM_RI != 0 && state&MODEM_RI == 0 {
+					deltas |= MODEM_RI_TRAIL
+				}
+				if changed&MODEM_CD != 0 {
+					deltas |= MODEM_DELTA_CD
+				}
+				if (changed|deltas)&modemMask != 0 {
+					notify(Build(NOTIFY_MODEMSTATE+SERVER_OFFSET, []byte{(state | deltas) & modemMask}))
+				}
+				modem = state
+			}
+		}
+
+		if lineErr == nil {
+			next, err := p.counters()
+			if err != nil {
+				continue
+			}
+			state := byte(0)
+			if next.overrun != counter.overrun || next.bufOverrun != counter.bufOverrun {
+				state |= LINE_OVERRUN
+			}
+			if next.parity != counter.parity {
+				state |= LINE_PARITY
+			}
+			if next.frame != counter.frame {
+				state |= LINE_FRAMING
+			}
+			if next.brk != counter.brk {
+				state |= LINE_BREAK
+			}
+			if state&lineMask != 0 {
+				notify(Build(NOTIFY_LINESTATE+SERVER_OFFSET, []byte{state & lineMask}))
+			}
+			counter = next
+		}
+	}
+}
+
+func (p *Port) modemState() (byte, error) {
+	var bits int
+	err := p.control(func(fd int) (err error) {
+		bits, err = unix.IoctlGetInt(fd, unix.TIOCMGET)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	state := byte(0)
+	lines := map[int]byte{unix.TIOCM_CTS: MODEM_CTS, unix.TIOCM_DSR: MODEM_DSR, unix.TIOCM_RNG: MODEM_RI, unix.TIOCM_CAR: MODEM_CD}
+	for line, bit := range lines {
+		if bits&line != 0 {
+			state |= bit
+		}
+	}
+	return state, nil
+}
+
+func (p *Port) counters() (icounter, error) {
+	var counter icounter
+	err := p.control(func(fd int) error {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TIOCGICOUNT, uintptr(unsafe.Pointer(&counter)))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+	return counter, err
+}
+
+// Builds IAC SB COM-PORT-OPTION subCmd value IAC SE
+func Build(subCmd byte, value []byte) []byte {
+	buf := bytes.NewBuffer([]byte{cmd.IAC, cmd.SB, opt.COM_PORT_OPTION, subCmd})
+	buf.Write(cmd.Escape(value))
+	buf.Write([]byte{cmd.IAC, cmd.SE})
+	return buf.Bytes()
+}
@@ -0,0 +1,14 @@
+module telnet/comport
+
+go 1.18
+
+replace (
+	telnet/command => ../command
+	telnet/option => ../option
+)
+
+require (
+	golang.org/x/sys v0.0.0-20220727055044-e65921a090b8
+	telnet/command v0.0.0-00010101000000-000000000000
+	telnet/option v0.0.0-00010101000000-000000000000
+)
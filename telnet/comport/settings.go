@@ -0,0 +1,96 @@
+package comport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Serial settings requested by client (zero values are not sent)
+type Settings struct {
+	BaudRate uint32
+	DataSize byte
+	Parity   byte
+	StopSize byte
+	Control  byte
+}
+
+var parities = map[string]byte{
+	"none":  PARITY_NONE,
+	"odd":   PARITY_ODD,
+	"even":  PARITY_EVEN,
+	"mark":  PARITY_MARK,
+	"space": PARITY_SPACE,
+}
+
+var stopSizes = map[string]byte{
+	"1":   STOPSIZE_ONE,
+	"2":   STOPSIZE_TWO,
+	"1.5": STOPSIZE_ONE5,
+}
+
+var flowControls = map[string]byte{
+	"none":     FLOW_NONE,
+	"xonxoff":  FLOW_XONXOFF,
+	"hardware": FLOW_HARDWARE,
+}
+
+// Returns settings from flag values, or nil if nothing is requested
+func ParseSettings(baudRate uint, dataSize uint, parity string, stopSize string, flow string) (*Settings, error) {
+	if baudRate == 0 && dataSize == 0 && len(parity) == 0 && len(stopSize) == 0 && len(flow) == 0 {
+		return nil, nil
+	}
+	s := new(Settings)
+	var ok bool
+	s.BaudRate = uint32(baudRate)
+	if dataSize != 0 {
+		if dataSize < 5 || dataSize > 8 {
+			return nil, fmt.Errorf("invalid data size %d", dataSize)
+		}
+		s.DataSize = byte(dataSize)
+	}
+	if len(parity) > 0 {
+		if s.Parity, ok = parities[strings.ToLower(parity)]; !ok {
+			return nil, fmt.Errorf("invalid parity %q", parity)
+		}
+	}
+	if len(stopSize) > 0 {
+		if s.StopSize, ok = stopSizes[stopSize]; !ok {
+			return nil, fmt.Errorf("invalid stop size %q", stopSize)
+		}
+	}
+	if len(flow) > 0 {
+		if s.Control, ok = flowControls[strings.ToLower(flow)]; !ok {
+			return nil, fmt.Errorf("invalid flow control %q", flow)
+		}
+	}
+	return s, nil
+}
+
+// Builds subnegotiations applying the settings
+func (s *Settings) Build() []byte {
+	if s == nil {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(Build(SIGNATURE, nil))
+	if s.BaudRate > 0 {
+		rate := make([]byte, 4)
+		binary.BigEndian.PutUint32(rate, s.BaudRate)
+		buf.Write(Build(SET_BAUDRATE, rate))
+	}
+	if s.DataSize > 0 {
+		buf.Write(Build(SET_DATASIZE, []byte{s.DataSize}))
+	}
+	if s.Parity > 0 {
+		buf.Write(Build(SET_PARITY, []byte{s.Parity}))
+	}
+	if s.StopSize > 0 {
+		buf.Write(Build(SET_STOPSIZE, []byte{s.StopSize}))
+	}
+	if s.Control > 0 {
+		buf.Write(Build(SET_CONTROL, []byte{s.Control}))
+	}
+	return buf.Bytes()
+}
@@ -5,9 +5,15 @@ import (
 	"bytes"
 	"net"
 	"strconv"
+	"telnet/charset"
 	cmd "telnet/command"
+	"telnet/comport"
+	"telnet/mud"
 	opt "telnet/option"
+	"telnet/proxy"
+	"telnet/record"
 	"telnet/terminal"
+	"telnet/ttype"
 )
 
 type Connection struct {
@@ -16,6 +22,8 @@ type Connection struct {
 	Port   int
 	Conn   net.Conn
 	Reader *bufio.Reader
+	// Outbound proxy (nil to dial directly)
+	Dialer proxy.Dialer
 	// TELNET Config
 	IsServer       bool
 	SupportOptions []byte
@@ -26,8 +34,45 @@ type Connection struct {
 	ErrChan chan error
 	// Terminal Config
 	Terminal *terminal.Terminal
+	// Session Recording (nil if disabled)
+	Recorder *record.Recorder
+	// RFC 2217 serial device (server) and settings to request (client)
+	ComPort         *comport.Port
+	ComPortSettings *comport.Settings
+	// RFC 2066 negotiated charset and transcoding (nil to disable)
+	Charset *charset.Conversion
+	// RFC 1091 types chosen from (server) and sent in turn (client), nil to take the first type
+	TermCycle *ttype.Cycle
+	TermTypes *ttype.List
+	// MCCP2 compression of output (server, nil to disable)
+	Compressor *Compressor
+	// GMCP and MSDP messages from the peer (nil to ignore)
+	MUD *mud.Handler
+	// RFC 1372 XON/XOFF handling requested (client) and applied (server), nil to disable
+	FlowControl *FlowControl
+	// Round trip time probes sent with TIMING-MARK (nil to only answer)
+	TimingMark *TimingMark
+	// Called with data up to each IAC EOR, such as a prompt (nil to ignore)
+	OnRecord func(record []byte)
+	// Called with each command read, including those answered here such as
+	// TIMING-MARK and EOR (nil to ignore)
+	OnCommand func(command []byte)
+	// Data after the last IAC EOR
+	record []byte
+	// Command split across reads, finished by the next one
+	partial []byte
+	// WILL TIMING-MARK sent by the next ReadMessage, after the data before
+	// the mark was returned, and the data after the mark
+	markReply []byte
+	afterMark []byte
 }
 
+// Data kept for a record without IAC EOR
+const maxRecord = 64 * 1024
+
+// Bytes held for a subnegotiation without IAC SE before dropping it
+const maxPartial = 64 * 1024
+
 func (c *Connection) Accept(ln net.Listener) error {
 	conn, err := ln.Accept()
 	if err != nil {
@@ -39,39 +84,65 @@ func (c *Connection) Accept(ln net.Listener) error {
 }
 
 func (c *Connection) Dial() error {
-	conn, err := net.Dial("tcp", c.IP+":"+strconv.Itoa(c.Port))
+	dial := net.Dial
+	if c.Dialer != nil {
+		dial = c.Dialer.Dial
+	}
+	conn, err := dial("tcp", c.IP+":"+strconv.Itoa(c.Port))
 	if err != nil {
 		return err
 	}
 	c.Conn = conn
 	c.Reader = bufio.NewReader(conn)
+	// Nothing read on an earlier connection carries over
+	c.record, c.partial, c.markReply, c.afterMark = nil, nil, nil, nil
 	return nil
 }
 
 func (c *Connection) WriteByte(message byte) error {
-	_, err := c.Conn.Write([]byte{message})
-	return err
+	return c.WriteBytes([]byte{message})
 }
 
 func (c *Connection) WriteBytes(message []byte) error {
-	_, err := c.Conn.Write(message)
-	return err
+	return c.Compressor.Write(c.Conn, message)
 }
 
 func (c *Connection) ReadMessage() ([]byte, error) {
 	var err error
 	var byteCmdRes []byte
-	byteMessage, err := c.ReadAll()
-	if err != nil {
-		return nil, err
+	if len(c.markReply) > 0 {
+		err = c.WriteBytes(c.markReply)
+		c.markReply = nil
+		if err != nil {
+			return nil, err
+		}
+	}
+	byteMessage := c.afterMark
+	c.afterMark = nil
+	if len(byteMessage) == 0 {
+		byteMessage, err = c.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(c.partial) > 0 {
+			byteMessage = append(c.partial, byteMessage...)
+			c.partial = nil
+		}
 	}
 	subCmd := byte(0)
 	optionStartIndex := -1
 	bufMessage := new(bytes.Buffer)
 	bufCmdsRes := new(bytes.Buffer)
+	recordStart := 0
 	for i := 0; i < len(byteMessage); i++ {
 		b := byteMessage[i]
 		if b == cmd.IAC {
+			if cmd.Length(byteMessage[i:]) == 0 {
+				if len(byteMessage)-i <= maxPartial {
+					c.partial = append([]byte(nil), byteMessage[i:]...)
+				}
+				break
+			}
 			i++
 			mainCmd := byteMessage[i]
 			// subnegotiation
@@ -79,10 +150,15 @@ func (c *Connection) ReadMessage() ([]byte, error) {
 			case cmd.SB:
 				subCmd = byteMessage[i+1]
 				optionStartIndex = i + 2
-				i += 2
+				i++
 				continue
 			case cmd.SE:
-				byteCmdRes, err = c.BuildCmdRes(*c, cmd.SB, subCmd, byteMessage[optionStartIndex:i-1]...)
+				// Rest of a dropped subnegotiation
+				if optionStartIndex < 0 {
+					continue
+				}
+				c.onCommand(byteMessage[optionStartIndex-3 : i+1])
+				byteCmdRes, err = c.BuildCmdRes(*c, cmd.SB, subCmd, cmd.Unescape(byteMessage[optionStartIndex:i-1])...)
 				if err != nil {
 					return nil, err
 				}
@@ -91,8 +167,31 @@ func (c *Connection) ReadMessage() ([]byte, error) {
 					return nil, err
 				}
 				optionStartIndex = -1
+				// Rest of the message is compressed
+				if subCmd == opt.MCCP2 && !c.IsServer && c.IsSupportOption(opt.MCCP2) {
+					c.Reader = inflate(byteMessage[i+1:], c.Reader)
+					byteMessage = byteMessage[:i+1]
+				}
+			case cmd.IAC:
+				// Escaped 255 data byte
+				if optionStartIndex < 0 {
+					bufMessage.WriteByte(cmd.IAC)
+				}
+				continue
 			}
 			// commands
+			if !cmd.IsNeedOption(mainCmd) && mainCmd != cmd.SE {
+				c.onCommand(byteMessage[i-1 : i+1])
+			}
+			if mainCmd == cmd.EOR {
+				if c.OnRecord != nil {
+					record := append(c.record, bufMessage.Bytes()[recordStart:]...)
+					c.record = nil
+					recordStart = bufMessage.Len()
+					c.OnRecord(record)
+				}
+				continue
+			}
 			if !cmd.IsNeedOption(mainCmd) {
 				byteCmdRes, err = c.BuildCmdRes(*c, mainCmd, 0)
 				if err != nil {
@@ -102,6 +201,18 @@ func (c *Connection) ReadMessage() ([]byte, error) {
 			} else {
 				i++
 				subCmd = byteMessage[i]
+				c.onCommand(byteMessage[i-2 : i+1])
+				if subCmd == opt.TIMING_MARK {
+					reply := c.timingMark(mainCmd)
+					if mainCmd != cmd.DO {
+						bufCmdsRes.Write(reply)
+						continue
+					}
+					// Answered once the caller has handled the data before the mark
+					c.markReply = reply
+					c.afterMark = byteMessage[i+1:]
+					break
+				}
 				byteCmdRes, err = c.BuildCmdRes(*c, mainCmd, subCmd)
 				if err != nil {
 					return nil, err
@@ -122,6 +233,12 @@ func (c *Connection) ReadMessage() ([]byte, error) {
 			return nil, err
 		}
 	}
+	if c.OnRecord != nil {
+		c.record = append(c.record, bufMessage.Bytes()[recordStart:]...)
+		if len(c.record) > maxRecord {
+			c.record = c.record[len(c.record)-maxRecord:]
+		}
+	}
 	err = c.WriteBytes(bufCmdsRes.Bytes())
 	if err != nil {
 		return nil, err
@@ -129,6 +246,12 @@ func (c *Connection) ReadMessage() ([]byte, error) {
 	return bufMessage.Bytes(), err
 }
 
+func (c *Connection) onCommand(command []byte) {
+	if c.OnCommand != nil {
+		c.OnCommand(command)
+	}
+}
+
 func (c *Connection) ReadAll() ([]byte, error) {
 	message := make([]byte, c.Reader.Size())
 	n, err := c.Reader.Read(message)
@@ -145,27 +268,42 @@ func (c *Connection) IsSupportOption(option byte) bool {
 }
 
 func (c *Connection) ReqCmds(subCmds []byte) error {
+	err := c.WriteBytes(c.BuildReqCmds(subCmds))
+	if err != nil {
+		return err
+	}
+	for _, subCmd := range subCmds {
+		if !c.IsServer && isServerOffer(subCmd) {
+			continue
+		}
+		c.EnableOptions[subCmd] = true
+	}
+	return nil
+}
+
+func (c *Connection) BuildReqCmds(subCmds []byte) []byte {
 	bufReqCmds := new(bytes.Buffer)
 	for _, subCmd := range subCmds {
 		if c.IsServer {
-			if subCmd == opt.ECHO || subCmd == opt.TERMINAL_TYPE || subCmd == opt.NEGOTIATE_ABOUT_WINDOW_SIZE || subCmd == opt.TERMINAL_SPEED {
+			if subCmd == opt.ECHO || subCmd == opt.TERMINAL_TYPE || subCmd == opt.NEGOTIATE_ABOUT_WINDOW_SIZE || subCmd == opt.TERMINAL_SPEED || subCmd == opt.COM_PORT_OPTION || subCmd == opt.CHARSET {
 				bufReqCmds.Write([]byte{cmd.IAC, cmd.DO, subCmd})
 				continue
 			}
 		} else {
-			if subCmd == opt.ECHO {
+			if subCmd == opt.ECHO || subCmd == opt.LFLOW {
 				bufReqCmds.Write([]byte{cmd.IAC, cmd.DO, subCmd})
 				continue
 			}
+			if isServerOffer(subCmd) {
+				continue
+			}
 		}
 		bufReqCmds.Write([]byte{cmd.IAC, cmd.WILL, subCmd})
 	}
-	err := c.WriteBytes(bufReqCmds.Bytes())
-	if err != nil {
-		return err
-	}
-	for _, subCmd := range subCmds {
-		c.EnableOptions[subCmd] = true
-	}
-	return nil
+	return bufReqCmds.Bytes()
+}
+
+// Options the client enables only when the server offers them
+func isServerOffer(option byte) bool {
+	return option == opt.MCCP2 || option == opt.GMCP || option == opt.MSDP || option == opt.END_OF_RECORD
 }
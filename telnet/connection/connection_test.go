@@ -0,0 +1,112 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	cmd "telnet/command"
+	opt "telnet/option"
+	"testing"
+	"time"
+)
+
+// Connects a Connection to a peer over loopback
+func dialPeer(t *testing.T) (*Connection, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	c := &Connection{Conn: conn, Reader: bufio.NewReader(conn), EnableOptions: map[byte]bool{}}
+	return c, peer
+}
+
+// WILL TIMING-MARK is written only after the data before the mark was returned
+func TestTimingMarkAfterData(t *testing.T) {
+	c, peer := dialPeer(t)
+	_, err := peer.Write([]byte{'d', 'a', 't', 'a', cmd.IAC, cmd.DO, opt.TIMING_MARK, 'm', 'o', 'r', 'e'})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != "data" {
+		t.Fatalf("first message %q, want data", message)
+	}
+	buf := make([]byte, 16)
+	peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _ := peer.Read(buf); n > 0 {
+		t.Fatalf("reply % x written with the data before the mark", buf[:n])
+	}
+
+	message, err = c.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != "more" {
+		t.Fatalf("second message %q, want more", message)
+	}
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte{cmd.IAC, cmd.WILL, opt.TIMING_MARK}) {
+		t.Errorf("reply % x, want IAC WILL TIMING-MARK", buf[:n])
+	}
+}
+
+// XOFF holds output until XON, and neither reaches the pty
+func TestFlowControl(t *testing.T) {
+	f := NewFlowControl(true, false)
+	input := f.Input([]byte{'a', XOFF, 'b'})
+	if !bytes.Equal(input, []byte("ab")) {
+		t.Fatalf("input after XOFF = %q", input)
+	}
+	resumed := make(chan struct{})
+	go func() {
+		f.WaitResume()
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+		t.Fatal("output not held after XOFF")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if input := f.Input([]byte{'c'}); !bytes.Equal(input, []byte("c")) {
+		t.Fatalf("input while paused = %q", input)
+	}
+	select {
+	case <-resumed:
+		t.Fatal("output resumed without XON")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if input := f.Input([]byte{XON}); len(input) != 0 {
+		t.Fatalf("input after XON = %q", input)
+	}
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("output held after XON")
+	}
+
+	// With LFLOW OFF the characters are input for the application
+	f.Handle([]byte{LFLOW_OFF})
+	if input := f.Input([]byte{XOFF, XON}); !bytes.Equal(input, []byte{XOFF, XON}) {
+		t.Fatalf("input with flow control off = %q", input)
+	}
+	f.WaitResume()
+}
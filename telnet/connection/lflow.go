@@ -0,0 +1,138 @@
+package connection
+
+import (
+	"sync"
+	cmd "telnet/command"
+	opt "telnet/option"
+)
+
+// TOGGLE-FLOW-CONTROL subnegotiation of RFC 1372
+const (
+	LFLOW_OFF         byte = 0
+	LFLOW_ON          byte = 1
+	LFLOW_RESTART_ANY byte = 2
+	LFLOW_RESTART_XON byte = 3
+)
+
+const (
+	XON  byte = 0x11
+	XOFF byte = 0x13
+)
+
+// XON/XOFF flow control of output requested by the client (client) and applied to it (server)
+type FlowControl struct {
+	enabled    bool
+	restartAny bool
+	// Output paused by XOFF
+	paused bool
+	closed bool
+	mu     sync.Mutex
+	resume *sync.Cond
+}
+
+func NewFlowControl(enabled bool, restartAny bool) *FlowControl {
+	f := &FlowControl{enabled: enabled, restartAny: restartAny}
+	f.resume = sync.NewCond(&f.mu)
+	return f
+}
+
+// Builds the subnegotiations asking the server for this mode
+func (f *FlowControl) Request() []byte {
+	if f == nil {
+		return nil
+	}
+	enabled, restartAny := f.Mode()
+	state, restart := LFLOW_OFF, LFLOW_RESTART_XON
+	if enabled {
+		state = LFLOW_ON
+	}
+	if restartAny {
+		restart = LFLOW_RESTART_ANY
+	}
+	return []byte{
+		cmd.IAC, cmd.SB, opt.LFLOW, state, cmd.IAC, cmd.SE,
+		cmd.IAC, cmd.SB, opt.LFLOW, restart, cmd.IAC, cmd.SE,
+	}
+}
+
+// Applies a client subnegotiation
+func (f *FlowControl) Handle(options []byte) {
+	if f == nil || len(options) == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch options[0] {
+	case LFLOW_OFF:
+		f.enabled = false
+	case LFLOW_ON:
+		f.enabled = true
+	case LFLOW_RESTART_ANY:
+		f.restartAny = true
+	case LFLOW_RESTART_XON:
+		f.restartAny = false
+	}
+	if !f.enabled && f.paused {
+		f.paused = false
+		f.resume.Broadcast()
+	}
+}
+
+// Returns whether XON/XOFF is handled and whether any input restarts output
+func (f *FlowControl) Mode() (enabled bool, restartAny bool) {
+	if f == nil {
+		return false, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.enabled, f.restartAny
+}
+
+// Pauses output on XOFF and resumes on XON, or any input with RESTART-ANY.
+// Returns input without XON and XOFF, which are handled here and not by the pty.
+func (f *FlowControl) Input(b []byte) []byte {
+	if f == nil {
+		return b
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.enabled {
+		return b
+	}
+	input := make([]byte, 0, len(b))
+	for _, c := range b {
+		if f.paused && (c == XON || f.restartAny) {
+			f.paused = false
+			f.resume.Broadcast()
+		} else if !f.paused && c == XOFF {
+			f.paused = true
+		}
+		if c != XON && c != XOFF {
+			input = append(input, c)
+		}
+	}
+	return input
+}
+
+// Blocks while output is paused, so at most one read is held back
+func (f *FlowControl) WaitResume() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.paused && !f.closed {
+		f.resume.Wait()
+	}
+}
+
+// Releases goroutines waiting for resume
+func (f *FlowControl) Close() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	f.resume.Broadcast()
+}
@@ -0,0 +1,126 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"io"
+	"sync"
+	cmd "telnet/command"
+	opt "telnet/option"
+)
+
+// Server output after this sequence is a zlib stream
+var mccp2Start = []byte{cmd.IAC, cmd.SB, opt.MCCP2, cmd.IAC, cmd.SE}
+
+// MCCP2 compression of server output
+type Compressor struct {
+	// Start sequence sent but not yet written
+	pending bool
+	w       *zlib.Writer
+	mu      sync.Mutex
+}
+
+// Returns IAC SB MCCP2 IAC SE once, compression starts when it is written
+func (z *Compressor) Begin() []byte {
+	if z == nil {
+		return nil
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.pending || z.w != nil {
+		return nil
+	}
+	z.pending = true
+	return mccp2Start
+}
+
+// Ends the zlib stream, later output is sent uncompressed
+func (z *Compressor) End() error {
+	if z == nil {
+		return nil
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.pending = false
+	if z.w == nil {
+		return nil
+	}
+	err := z.w.Close()
+	z.w = nil
+	return err
+}
+
+// Writes b to w, compressing bytes after the start sequence
+func (z *Compressor) Write(w io.Writer, b []byte) error {
+	if z == nil {
+		_, err := w.Write(b)
+		return err
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.pending {
+		if i := bytes.Index(b, mccp2Start); i >= 0 {
+			_, err := w.Write(b[:i+len(mccp2Start)])
+			if err != nil {
+				return err
+			}
+			z.pending = false
+			z.w = zlib.NewWriter(w)
+			b = b[i+len(mccp2Start):]
+		}
+	}
+	if z.w == nil {
+		_, err := w.Write(b)
+		return err
+	}
+	_, err := z.w.Write(b)
+	if err != nil {
+		return err
+	}
+	// Flush so the client can decode each write, including the header on start
+	return z.w.Flush()
+}
+
+// Reads decompressed data until the server ends the stream, then raw data
+type inflater struct {
+	raw   *bufio.Reader
+	z     io.ReadCloser
+	ended bool
+}
+
+// Returns a reader decompressing rest followed by r
+func inflate(rest []byte, r *bufio.Reader) *bufio.Reader {
+	raw := bufio.NewReader(io.MultiReader(bytes.NewReader(rest), r))
+	return bufio.NewReaderSize(&inflater{raw: raw}, r.Size())
+}
+
+func (r *inflater) Read(p []byte) (int, error) {
+	if r.ended {
+		return r.raw.Read(p)
+	}
+	if r.z == nil {
+		// Blocks until the zlib header arrives
+		z, err := zlib.NewReader(r.raw)
+		if err == io.ErrUnexpectedEOF {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, err
+		}
+		r.z = z
+	}
+	n, err := r.z.Read(p)
+	// Server may close the connection without ending the stream
+	if err == io.ErrUnexpectedEOF {
+		return n, io.EOF
+	}
+	if err == io.EOF {
+		r.z.Close()
+		r.ended = true
+		if n == 0 {
+			return r.raw.Read(p)
+		}
+		err = nil
+	}
+	return n, err
+}
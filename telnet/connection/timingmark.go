@@ -0,0 +1,97 @@
+package connection
+
+import (
+	"errors"
+	"sync"
+	cmd "telnet/command"
+	opt "telnet/option"
+	"time"
+)
+
+var ErrTimingMarkTimeout = errors.New("no reply to TIMING-MARK")
+
+// RFC 860 probe measuring round trip time through the peer's input processing
+type TimingMark struct {
+	sent time.Time
+	done chan time.Duration
+	rtt  time.Duration
+	mu   sync.Mutex
+}
+
+// Returns IAC DO TIMING-MARK and starts timing, nil while a probe is outstanding
+func (t *TimingMark) Probe() []byte {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done != nil {
+		return nil
+	}
+	t.sent = time.Now()
+	t.done = make(chan time.Duration, 1)
+	return []byte{cmd.IAC, cmd.DO, opt.TIMING_MARK}
+}
+
+// Waits for the reply to the outstanding probe
+func (t *TimingMark) Wait(timeout time.Duration) (time.Duration, error) {
+	t.mu.Lock()
+	done := t.done
+	t.mu.Unlock()
+	if done == nil {
+		return 0, errors.New("no TIMING-MARK probe sent")
+	}
+	select {
+	case rtt := <-done:
+		return rtt, nil
+	case <-time.After(timeout):
+		t.mu.Lock()
+		if t.done == done {
+			t.done = nil
+		}
+		t.mu.Unlock()
+		return 0, ErrTimingMarkTimeout
+	}
+}
+
+// Returns the last measured round trip time, 0 if none
+func (t *TimingMark) RTT() time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rtt
+}
+
+// Ends the outstanding probe on WILL or WONT, reporting whether there was one
+func (t *TimingMark) reply() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done == nil {
+		return false
+	}
+	t.rtt = time.Since(t.sent)
+	t.done <- t.rtt
+	t.done = nil
+	return true
+}
+
+// Answers TIMING-MARK negotiation, which never stays enabled
+func (c *Connection) timingMark(mainCmd byte) []byte {
+	switch mainCmd {
+	case cmd.DO:
+		// Sent by ReadMessage after the data before the mark was returned
+		return []byte{cmd.IAC, cmd.WILL, opt.TIMING_MARK}
+	case cmd.WILL:
+		if !c.TimingMark.reply() {
+			return []byte{cmd.IAC, cmd.DONT, opt.TIMING_MARK}
+		}
+	case cmd.WONT:
+		c.TimingMark.reply()
+	}
+	return nil
+}
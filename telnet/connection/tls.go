@@ -0,0 +1,249 @@
+package connection
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	cmd "telnet/command"
+	opt "telnet/option"
+)
+
+// START_TLS subnegotiation announcing the handshake
+const tlsFollows byte = 1
+
+var ErrStartTLSRefused = errors.New("peer refused START_TLS")
+
+// Connection with bytes read ahead into a buffered reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Loads server certificate, requiring client certificates signed by clientCAFile if given
+func ServerTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return nil, errors.New("TLS certificate and key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if len(clientCAFile) > 0 {
+		config.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Verifies server with caFile or system roots, presenting client certificate if given
+func ClientTLSConfig(caFile string, certFile string, keyFile string, serverName string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure, MinVersion: tls.VersionTLS12}
+	var err error
+	if len(caFile) > 0 {
+		config.RootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
+}
+
+// Runs TLS handshake over the connection, keeping bytes already buffered
+func (c *Connection) UpgradeTLS(config *tls.Config) error {
+	conn := &bufferedConn{Conn: c.Conn, reader: c.Reader}
+	var tlsConn *tls.Conn
+	if c.IsServer {
+		tlsConn = tls.Server(conn, config)
+	} else {
+		if len(config.ServerName) == 0 {
+			config = config.Clone()
+			config.ServerName = c.IP
+		}
+		tlsConn = tls.Client(conn, config)
+	}
+	err := tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	c.Conn = tlsConn
+	c.Reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// Negotiates START_TLS before other options and upgrades the connection.
+// ErrStartTLSRefused leaves the connection usable in plaintext.
+func (c *Connection) StartTLS(config *tls.Config) error {
+	if c.IsServer {
+		return c.startTLSServer(config)
+	}
+	return c.startTLSClient(config)
+}
+
+func (c *Connection) startTLSServer(config *tls.Config) error {
+	err := c.WriteBytes([]byte{cmd.IAC, cmd.DO, opt.START_TLS})
+	if err != nil {
+		return err
+	}
+	// Other input is replayed when continuing in plaintext
+	saved := new(bytes.Buffer)
+	for {
+		raw := new(bytes.Buffer)
+		mainCmd, option, sb, err := c.readCommand(raw)
+		if err != nil || option != opt.START_TLS {
+			saved.Write(raw.Bytes())
+		}
+		if isTimeout(err) {
+			c.Reader = bufio.NewReader(io.MultiReader(saved, c.Reader))
+			return ErrStartTLSRefused
+		} else if err != nil {
+			return err
+		}
+		if option != opt.START_TLS {
+			continue
+		}
+		switch mainCmd {
+		case cmd.WILL:
+			err = c.WriteBytes([]byte{cmd.IAC, cmd.SB, opt.START_TLS, tlsFollows, cmd.IAC, cmd.SE})
+			if err != nil {
+				return err
+			}
+		case cmd.WONT:
+			c.Reader = bufio.NewReader(io.MultiReader(saved, c.Reader))
+			return ErrStartTLSRefused
+		case cmd.SB:
+			if len(sb) > 0 && sb[0] == tlsFollows {
+				return c.UpgradeTLS(config)
+			}
+		}
+	}
+}
+
+func (c *Connection) startTLSClient(config *tls.Config) error {
+	// Server offering START_TLS asks for it first
+	prefix, err := c.Reader.Peek(3)
+	if isTimeout(err) || (err == nil && !bytes.Equal(prefix, []byte{cmd.IAC, cmd.DO, opt.START_TLS})) {
+		return ErrStartTLSRefused
+	} else if err != nil {
+		return err
+	}
+	c.Reader.Discard(3)
+	err = c.WriteBytes([]byte{cmd.IAC, cmd.WILL, opt.START_TLS})
+	if err != nil {
+		return err
+	}
+	for {
+		// Other commands are dropped, negotiation starts over after the handshake
+		mainCmd, option, sb, err := c.readCommand(new(bytes.Buffer))
+		if err != nil {
+			return err
+		}
+		if option != opt.START_TLS {
+			continue
+		}
+		switch mainCmd {
+		case cmd.DONT:
+			return ErrStartTLSRefused
+		case cmd.SB:
+			if len(sb) == 0 || sb[0] != tlsFollows {
+				continue
+			}
+			err = c.WriteBytes([]byte{cmd.IAC, cmd.SB, opt.START_TLS, tlsFollows, cmd.IAC, cmd.SE})
+			if err != nil {
+				return err
+			}
+			return c.UpgradeTLS(config)
+		}
+	}
+}
+
+// Reads up to the next command, copying consumed bytes to raw
+func (c *Connection) readCommand(raw *bytes.Buffer) (mainCmd byte, option byte, sb []byte, err error) {
+	next := func() (byte, error) {
+		b, err := c.Reader.ReadByte()
+		if err == nil {
+			raw.WriteByte(b)
+		}
+		return b, err
+	}
+	for {
+		b, err := next()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		if b != cmd.IAC {
+			continue
+		}
+		mainCmd, err = next()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		switch {
+		case mainCmd == cmd.IAC:
+			continue
+		case mainCmd == cmd.SB:
+			option, err = next()
+			if err != nil {
+				return 0, 0, nil, err
+			}
+			for {
+				b, err = next()
+				if err != nil {
+					return 0, 0, nil, err
+				}
+				if b == cmd.IAC {
+					b, err = next()
+					if err != nil {
+						return 0, 0, nil, err
+					}
+					if b == cmd.SE {
+						return mainCmd, option, sb, nil
+					}
+				}
+				sb = append(sb, b)
+			}
+		case cmd.IsNeedOption(mainCmd):
+			option, err = next()
+			return mainCmd, option, nil, err
+		default:
+			return mainCmd, 0, nil, nil
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,250 @@
+package gateway
+
+import (
+	"bufio"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"telnet/client"
+	cmd "telnet/command"
+	opt "telnet/option"
+	"telnet/server"
+	"telnet/terminal"
+
+	"golang.org/x/net/websocket"
+)
+
+//go:embed static
+var static embed.FS
+
+type Config struct {
+	// Upstream TELNET server (host:port), empty for local session
+	Upstream string
+	// Config for local session
+	Server server.Config
+	// Directory served as /xterm, or URL, with xterm.js, xterm.css and xterm-addon-fit.js
+	Xterm string
+}
+
+type Gateway struct {
+	Config Config
+	// Listener passing browser connections to local server
+	ln *pipeListener
+}
+
+// Control message from browser in text frame, input is sent in binary frame
+type message struct {
+	Type string `json:"type"`
+	// input
+	Data string `json:"data,omitempty"`
+	// resize
+	Cols uint16 `json:"cols,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+}
+
+type frame struct {
+	binary bool
+	data   []byte
+}
+
+// Sends binary frames and tells frame type of received messages
+var frameCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return v.([]byte), websocket.BinaryFrame, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		f := v.(*frame)
+		f.binary = payloadType == websocket.BinaryFrame
+		f.data = data
+		return nil
+	},
+}
+
+func (g *Gateway) HandleWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+	remoteAddr := ws.Request().RemoteAddr
+	query := ws.Request().URL.Query()
+	log.Printf("Gateway: WebSocket Connected from %s", remoteAddr)
+
+	// TELNET client with browser terminal
+	supportOptions := []byte{opt.ECHO, opt.NEGOTIATE_ABOUT_WINDOW_SIZE, opt.TERMINAL_TYPE, opt.SUPPRESS_GO_AHEAD}
+	c := client.New("", 0, supportOptions)
+	c.Terminal = terminal.New()
+	c.Terminal.Type = "xterm"
+	if len(query.Get("term")) > 0 {
+		c.Terminal.Type = query.Get("term")
+	}
+	cols, _ := strconv.Atoi(query.Get("cols"))
+	rows, _ := strconv.Atoi(query.Get("rows"))
+	if cols > 0 && rows > 0 {
+		c.Terminal.SetSize(uint16(cols), uint16(rows))
+	}
+
+	// Connect to local session or upstream
+	err := g.connect(c, remoteAddr)
+	if err != nil {
+		log.Println("Gateway: Error:", err)
+		frameCodec.Send(ws, []byte("Error: "+err.Error()+"\r\n"))
+		return
+	}
+	defer c.Conn.Close()
+
+	// Request TELNET Commands before the reader goroutine negotiates
+	err = c.ReqCmds(c.SupportOptions)
+	if err != nil {
+		log.Println("Gateway: Error:", err)
+		return
+	}
+
+	// Relay TELNET output to browser
+	go func() {
+		defer ws.Close()
+		for {
+			byteMessage, err := c.ReadMessage()
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+					log.Println("Gateway: Error:", err)
+				}
+				return
+			}
+			if len(byteMessage) == 0 {
+				continue
+			}
+			err = frameCodec.Send(ws, byteMessage)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Relay browser input to TELNET
+	for {
+		var f frame
+		err := frameCodec.Receive(ws, &f)
+		if err != nil {
+			break
+		}
+		if f.binary {
+			err = c.WriteBytes(cmd.Escape(f.data))
+		} else {
+			err = g.control(c, f.data)
+		}
+		if err != nil {
+			log.Println("Gateway: Error:", err)
+			break
+		}
+	}
+	log.Printf("Gateway: WebSocket Disconnected from %s", remoteAddr)
+}
+
+func (g *Gateway) connect(c *client.Client, remoteAddr string) error {
+	if len(g.Config.Upstream) == 0 {
+		conn, err := g.ln.Dial(remoteAddr)
+		if err != nil {
+			return err
+		}
+		c.Conn = conn
+		c.Reader = bufio.NewReader(conn)
+		return nil
+	}
+	host, port, err := net.SplitHostPort(g.Config.Upstream)
+	if err != nil {
+		return err
+	}
+	c.IP = host
+	c.Port, err = strconv.Atoi(port)
+	if err != nil {
+		return err
+	}
+	return c.Dial()
+}
+
+// Handles JSON control message from browser
+func (g *Gateway) control(c *client.Client, data []byte) error {
+	var m message
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return err
+	}
+	switch m.Type {
+	case "input":
+		return c.WriteBytes(cmd.Escape([]byte(m.Data)))
+	case "resize":
+		if m.Cols == 0 || m.Rows == 0 {
+			return nil
+		}
+		c.Terminal.SetSize(m.Cols, m.Rows)
+		if !c.IsEnabled(opt.NEGOTIATE_ABOUT_WINDOW_SIZE) {
+			return nil
+		}
+		return c.WriteBytes(client.BuildNAWS(int(m.Cols), int(m.Rows)))
+	}
+	return fmt.Errorf("unknown message type %q", m.Type)
+}
+
+// Rejects upgrades from pages of other sites, clients without Origin are allowed
+func checkOrigin(config *websocket.Config, req *http.Request) error {
+	origin, err := websocket.Origin(config, req)
+	if err != nil {
+		return err
+	}
+	if origin != nil && origin.Host != req.Host {
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+	config.Origin = origin
+	return nil
+}
+
+// Reports whether xterm.js is loaded from another site rather than a directory
+func isURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "//")
+}
+
+func Run(ip string, port int, config Config) {
+	g := new(Gateway)
+	g.Config = config
+
+	// Local sessions are served through in-memory connections
+	if len(config.Upstream) == 0 {
+		g.ln = newPipeListener()
+		go server.Serve(g.ln, config.Server)
+	}
+
+	// Page loading xterm.js from a URL or the directory served as /xterm
+	xtermURL := config.Xterm
+	if !isURL(xtermURL) {
+		if _, err := os.Stat(filepath.Join(config.Xterm, "xterm.js")); err != nil {
+			log.Printf("Gateway: xterm.js not found in %s, copy it there with xterm.css and xterm-addon-fit.js", config.Xterm)
+		}
+		xtermURL = "/xterm"
+	}
+	page := template.Must(template.ParseFS(static, "static/index.html"))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		page.Execute(w, xtermURL)
+	})
+	if !isURL(config.Xterm) {
+		mux.Handle("/xterm/", http.StripPrefix("/xterm/", http.FileServer(http.Dir(config.Xterm))))
+	}
+	mux.Handle("/ws", websocket.Server{Handler: g.HandleWebSocket, Handshake: checkOrigin})
+	fmt.Printf("Gateway on http://%s:%d/...\n", ip, port)
+	err := http.ListenAndServe(ip+":"+strconv.Itoa(port), mux)
+	if err != nil {
+		log.Fatal("Error:", err)
+	}
+}
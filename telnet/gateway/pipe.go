@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Listener accepting in-memory connections
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Connection reporting browser address as remote address
+type pipeConn struct {
+	net.Conn
+	remoteAddr pipeAddr
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return "websocket"
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Returns client side of a new connection
+func (ln *pipeListener) Dial(remoteAddr string) (net.Conn, error) {
+	serverConn, clientConn, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case ln.conns <- &pipeConn{Conn: serverConn, remoteAddr: pipeAddr(remoteAddr)}:
+		return clientConn, nil
+	case <-ln.closed:
+		serverConn.Close()
+		clientConn.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+// Connected Unix sockets, buffered unlike net.Pipe so both sides can write at once
+func socketPair() (net.Conn, net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socketpair")
+		conns[i], err = net.FileConn(file)
+		file.Close()
+		if err != nil {
+			if i == 0 {
+				syscall.Close(fds[1])
+			} else {
+				conns[0].Close()
+			}
+			return nil, nil, err
+		}
+	}
+	return conns[0], conns[1], nil
+}
+
+func (ln *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *pipeListener) Close() error {
+	ln.once.Do(func() {
+		close(ln.closed)
+	})
+	return nil
+}
+
+func (ln *pipeListener) Addr() net.Addr {
+	return pipeAddr("gateway")
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
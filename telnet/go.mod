@@ -3,24 +3,52 @@ module telnet
 go 1.18
 
 replace (
+	telnet/audit => ./audit
+	telnet/charset => ./charset
 	telnet/client => ./client
 	telnet/command => ./command
+	telnet/comport => ./comport
 	telnet/connection => ./connection
+	telnet/gateway => ./gateway
+	telnet/honeypot => ./honeypot
+	telnet/mud => ./mud
 	telnet/option => ./option
+	telnet/proxy => ./proxy
+	telnet/record => ./record
+	telnet/relay => ./relay
+	telnet/scan => ./scan
+	telnet/screen => ./screen
 	telnet/server => ./server
 	telnet/terminal => ./terminal
+	telnet/tn3270 => ./tn3270
+	telnet/ttype => ./ttype
 )
 
 require (
+	telnet/charset v0.0.0-00010101000000-000000000000
 	telnet/client v0.0.0-00010101000000-000000000000
+	telnet/comport v0.0.0-00010101000000-000000000000
+	telnet/connection v0.0.0-00010101000000-000000000000
+	telnet/gateway v0.0.0-00010101000000-000000000000
+	telnet/honeypot v0.0.0-00010101000000-000000000000
+	telnet/record v0.0.0-00010101000000-000000000000
+	telnet/relay v0.0.0-00010101000000-000000000000
+	telnet/scan v0.0.0-00010101000000-000000000000
 	telnet/server v0.0.0-00010101000000-000000000000
+	telnet/tn3270 v0.0.0-00010101000000-000000000000
 )
 
 require (
 	github.com/pkg/term v1.1.0 // indirect
+	golang.org/x/net v0.0.0-20220722155237-a158d28d115b // indirect
 	golang.org/x/sys v0.0.0-20220727055044-e65921a090b8 // indirect
+	golang.org/x/text v0.3.7 // indirect
+	telnet/audit v0.0.0-00010101000000-000000000000 // indirect
 	telnet/command v0.0.0-00010101000000-000000000000 // indirect
-	telnet/connection v0.0.0-00010101000000-000000000000 // indirect
+	telnet/mud v0.0.0-00010101000000-000000000000 // indirect
 	telnet/option v0.0.0-00010101000000-000000000000 // indirect
+	telnet/proxy v0.0.0-00010101000000-000000000000 // indirect
+	telnet/screen v0.0.0-00010101000000-000000000000 // indirect
 	telnet/terminal v0.0.0-00010101000000-000000000000 // indirect
+	telnet/ttype v0.0.0-00010101000000-000000000000 // indirect
 )
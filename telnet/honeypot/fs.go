@@ -0,0 +1,250 @@
+package honeypot
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errNotFound   = errors.New("No such file or directory")
+	errIsDir      = errors.New("Is a directory")
+	errNotDir     = errors.New("Not a directory")
+	errExists     = errors.New("File exists")
+	errPermission = errors.New("Permission denied")
+	errTooLarge   = errors.New("File too large")
+	errNoSpace    = errors.New("No space left on device")
+)
+
+// Limits on what a session can store
+const (
+	maxFileSize       = 1 << 20
+	maxFilesystemSize = 4 << 20
+	// Bytes counted for each file or directory created
+	nodeSize = 256
+)
+
+// File or directory of the fake filesystem
+type node struct {
+	dir      bool
+	mode     string
+	owner    string
+	content  string
+	modTime  time.Time
+	children map[string]*node
+}
+
+// In-memory filesystem private to one session
+type Filesystem struct {
+	root *node
+	// Bytes stored by the session, counted against maxFilesystemSize
+	used int
+}
+
+// Boot time shown in file times and uptime
+var bootTime = time.Now().Add(-37*24*time.Hour - 5*time.Hour - 12*time.Minute)
+
+func NewFilesystem(hostname string, user string) *Filesystem {
+	fs := &Filesystem{root: newDir("root")}
+	for _, dir := range []string{"/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/mnt", "/opt", "/proc", "/root", "/run", "/sbin", "/srv", "/sys", "/tmp", "/usr", "/usr/bin", "/usr/lib", "/usr/local", "/usr/sbin", "/var", "/var/log", "/var/tmp", "/var/www"} {
+		fs.mkdir(dir, "root")
+	}
+	fs.lookup("/tmp").mode = "drwxrwxrwt"
+	fs.lookup("/var/tmp").mode = "drwxrwxrwt"
+	fs.lookup("/root").mode = "drwx------"
+	for _, name := range []string{"bash", "busybox", "cat", "chmod", "cp", "echo", "grep", "ls", "mkdir", "mv", "ps", "rm", "sh", "touch", "uname"} {
+		fs.install("/bin/"+name, "rwxr-xr-x", "root", "")
+	}
+	for _, name := range []string{"curl", "free", "id", "uptime", "wget", "whoami"} {
+		fs.install("/usr/bin/"+name, "rwxr-xr-x", "root", "")
+	}
+
+	passwd := "root:x:0:0:root:/root:/bin/bash\n" +
+		"daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin\n" +
+		"bin:x:2:2:bin:/bin:/usr/sbin/nologin\n" +
+		"sys:x:3:3:sys:/dev:/usr/sbin/nologin\n" +
+		"www-data:x:33:33:www-data:/var/www:/usr/sbin/nologin\n" +
+		"sshd:x:110:65534::/run/sshd:/usr/sbin/nologin\n"
+	if user != "root" {
+		passwd += user + ":x:1000:1000:" + user + ",,,:/home/" + user + ":/bin/bash\n"
+		fs.mkdir("/home/"+user, user)
+		fs.install("/home/"+user+"/.bashrc", "rw-r--r--", user, "# ~/.bashrc\n")
+	}
+	fs.install("/etc/passwd", "rw-r--r--", "root", passwd)
+	fs.install("/etc/shadow", "rw-r-----", "root", "root:$6$Jx1bK2Qe$VwY3u8GQ0c1p4wU6n2m9d7sXk5yT0aZ8bN1eR4tH6jL3fD9gS2qW5vC7xM0iO8pA1uE4rT6yU9oP3lK5jH8gF0:19000:0:99999:7:::\n")
+	fs.install("/etc/hostname", "rw-r--r--", "root", hostname+"\n")
+	fs.install("/etc/hosts", "rw-r--r--", "root", "127.0.0.1\tlocalhost\n127.0.1.1\t"+hostname+"\n")
+	fs.install("/etc/issue", "rw-r--r--", "root", "Ubuntu 20.04.6 LTS \\n \\l\n")
+	fs.install("/etc/os-release", "rw-r--r--", "root", "NAME=\"Ubuntu\"\nVERSION=\"20.04.6 LTS (Focal Fossa)\"\nID=ubuntu\nID_LIKE=debian\nPRETTY_NAME=\"Ubuntu 20.04.6 LTS\"\nVERSION_ID=\"20.04\"\n")
+	fs.install("/etc/resolv.conf", "rw-r--r--", "root", "nameserver 127.0.0.53\noptions edns0 trust-ad\n")
+	fs.install("/proc/version", "r--r--r--", "root", "Linux version "+kernelRelease+" (buildd@lcy02-amd64-001) (gcc (Ubuntu 9.4.0-1ubuntu1~20.04.1) 9.4.0, GNU ld (GNU Binutils for Ubuntu) 2.34) #166-Ubuntu SMP Tue Oct 10 09:30:29 UTC 2023\n")
+	fs.install("/proc/cpuinfo", "r--r--r--", "root", cpuinfo(0)+"\n"+cpuinfo(1))
+	fs.install("/proc/meminfo", "r--r--r--", "root", "MemTotal:        2035452 kB\nMemFree:          315008 kB\nMemAvailable:    1423612 kB\nBuffers:           91232 kB\nCached:          1089516 kB\nSwapTotal:       2097148 kB\nSwapFree:        2093308 kB\n")
+	fs.install("/proc/mounts", "r--r--r--", "root", "/dev/sda1 / ext4 rw,relatime 0 0\nproc /proc proc rw,nosuid,nodev,noexec,relatime 0 0\ntmpfs /run tmpfs rw,nosuid,nodev,noexec,relatime,size=203548k,mode=755 0 0\n")
+	fs.install("/var/log/auth.log", "rw-r-----", "root", "")
+	fs.install("/dev/null", "rw-rw-rw-", "root", "")
+	fs.used = 0
+	return fs
+}
+
+func cpuinfo(processor int) string {
+	return "processor\t: " + string(rune('0'+processor)) + "\n" +
+		"vendor_id\t: GenuineIntel\n" +
+		"cpu family\t: 6\n" +
+		"model\t\t: 85\n" +
+		"model name\t: Intel(R) Xeon(R) Gold 6148 CPU @ 2.40GHz\n" +
+		"cpu MHz\t\t: 2394.374\n" +
+		"cache size\t: 28160 KB\n" +
+		"cpu cores\t: 2\n" +
+		"flags\t\t: fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov pat pse36 clflush mmx fxsr sse sse2 ss ht syscall nx pdpe1gb rdtscp lm constant_tsc rep_good nopl xtopology cpuid pni pclmulqdq ssse3 fma cx16 pcid sse4_1 sse4_2 x2apic movbe popcnt aes xsave avx f16c rdrand hypervisor lahf_lm abm 3dnowprefetch avx2 avx512f\n"
+}
+
+func newDir(owner string) *node {
+	return &node{dir: true, mode: "drwxr-xr-x", owner: owner, modTime: bootTime, children: map[string]*node{}}
+}
+
+// Adds a file with permission bits such as rw-r--r--
+func (fs *Filesystem) install(p string, mode string, owner string, content string) {
+	parent := fs.lookup(path.Dir(p))
+	parent.children[path.Base(p)] = &node{mode: "-" + mode, owner: owner, content: content, modTime: bootTime}
+}
+
+// Returns the node at absolute path p or nil
+func (fs *Filesystem) lookup(p string) *node {
+	n := fs.root
+	for _, name := range strings.Split(strings.Trim(path.Clean(p), "/"), "/") {
+		if len(name) == 0 {
+			continue
+		}
+		if !n.dir {
+			return nil
+		}
+		n = n.children[name]
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+func (fs *Filesystem) mkdir(p string, owner string) error {
+	parent := fs.lookup(path.Dir(p))
+	if parent == nil {
+		return errNotFound
+	}
+	if !parent.dir {
+		return errNotDir
+	}
+	if parent.children[path.Base(p)] != nil {
+		return errExists
+	}
+	err := fs.allocate(nodeSize)
+	if err != nil {
+		return err
+	}
+	parent.children[path.Base(p)] = newDir(owner)
+	return nil
+}
+
+func (fs *Filesystem) readFile(p string, user string) (string, error) {
+	n := fs.lookup(p)
+	if n == nil {
+		return "", errNotFound
+	}
+	if n.dir {
+		return "", errIsDir
+	}
+	if user != "root" && user != n.owner && n.mode[7] != 'r' {
+		return "", errPermission
+	}
+	return n.content, nil
+}
+
+func (fs *Filesystem) writeFile(p string, user string, content string, appendContent bool) error {
+	if path.Clean(p) == "/dev/null" {
+		return nil
+	}
+	n := fs.lookup(p)
+	var parent *node
+	growth := 0
+	if n == nil {
+		parent = fs.lookup(path.Dir(p))
+		if parent == nil {
+			return errNotFound
+		}
+		if !parent.dir {
+			return errNotDir
+		}
+		n = &node{mode: "-rw-r--r--", owner: user}
+		growth = nodeSize
+	} else if n.dir {
+		return errIsDir
+	}
+	if appendContent {
+		content = n.content + content
+	}
+	if len(content) > maxFileSize {
+		return errTooLarge
+	}
+	err := fs.allocate(growth + len(content) - len(n.content))
+	if err != nil {
+		return err
+	}
+	if parent != nil {
+		parent.children[path.Base(p)] = n
+	}
+	n.content = content
+	n.modTime = time.Now()
+	return nil
+}
+
+// Counts size bytes against the limit, negative size frees them
+func (fs *Filesystem) allocate(size int) error {
+	if size > 0 && fs.used+size > maxFilesystemSize {
+		return errNoSpace
+	}
+	fs.used += size
+	// Removing installed files frees nothing
+	if fs.used < 0 {
+		fs.used = 0
+	}
+	return nil
+}
+
+func (fs *Filesystem) remove(p string) error {
+	parent := fs.lookup(path.Dir(p))
+	if parent == nil || parent.children[path.Base(p)] == nil || path.Clean(p) == "/" {
+		return errNotFound
+	}
+	fs.allocate(-parent.children[path.Base(p)].usage())
+	delete(parent.children, path.Base(p))
+	return nil
+}
+
+// Returns bytes counted for the node and everything under it
+func (n *node) usage() int {
+	size := nodeSize + len(n.content)
+	for _, child := range n.children {
+		size += child.usage()
+	}
+	return size
+}
+
+// Returns sorted names in directory
+func (n *node) names() []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (n *node) size() int {
+	if n.dir {
+		return 4096
+	}
+	return len(n.content)
+}
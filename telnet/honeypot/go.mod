@@ -0,0 +1,40 @@
+module telnet/honeypot
+
+go 1.18
+
+replace (
+	telnet/audit => ../audit
+	telnet/charset => ../charset
+	telnet/command => ../command
+	telnet/comport => ../comport
+	telnet/connection => ../connection
+	telnet/mud => ../mud
+	telnet/option => ../option
+	telnet/proxy => ../proxy
+	telnet/record => ../record
+	telnet/server => ../server
+	telnet/terminal => ../terminal
+	telnet/ttype => ../ttype
+)
+
+require (
+	telnet/audit v0.0.0-00010101000000-000000000000
+	telnet/command v0.0.0-00010101000000-000000000000
+	telnet/connection v0.0.0-00010101000000-000000000000
+	telnet/option v0.0.0-00010101000000-000000000000
+	telnet/server v0.0.0-00010101000000-000000000000
+	telnet/terminal v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/pkg/term v1.1.0 // indirect
+	golang.org/x/net v0.0.0-20220722155237-a158d28d115b // indirect
+	golang.org/x/sys v0.0.0-20220727055044-e65921a090b8 // indirect
+	golang.org/x/text v0.3.7 // indirect
+	telnet/charset v0.0.0-00010101000000-000000000000 // indirect
+	telnet/comport v0.0.0-00010101000000-000000000000 // indirect
+	telnet/mud v0.0.0-00010101000000-000000000000 // indirect
+	telnet/proxy v0.0.0-00010101000000-000000000000 // indirect
+	telnet/record v0.0.0-00010101000000-000000000000 // indirect
+	telnet/ttype v0.0.0-00010101000000-000000000000 // indirect
+)
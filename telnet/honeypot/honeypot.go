@@ -0,0 +1,533 @@
+package honeypot
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"telnet/audit"
+	cmd "telnet/command"
+	"telnet/connection"
+	opt "telnet/option"
+	"telnet/server"
+	"telnet/terminal"
+	"time"
+)
+
+type Config struct {
+	// Host name shown in login and shell prompts
+	Hostname string
+	Policy   Policy
+	// JSON lines event log ("-" for stdout)
+	Log string
+	// Deadline for TERMINAL-TYPE negotiation before showing the login prompt
+	NegotiationTimeout time.Duration
+	DefaultType        string
+	// Disconnect after no input (0 to disable)
+	IdleTimeout time.Duration
+	// Concurrent sessions overall and from one client IP (0 for unlimited)
+	MaxSessions      int
+	MaxSessionsPerIP int
+}
+
+// Decides which credentials are accepted
+type Policy struct {
+	// "any", "none", "attempts" or "file"
+	Mode string
+	// Login attempt that succeeds in "attempts" mode
+	Attempts int
+	// User and password pairs accepted in "file" mode, "*" matches anything
+	Credentials [][2]string
+}
+
+type Event struct {
+	Time         time.Time `json:"time"`
+	Session      int       `json:"session"`
+	Event        string    `json:"event"`
+	Peer         string    `json:"peer"`
+	Fingerprint  string    `json:"fingerprint,omitempty"`
+	TerminalType string    `json:"terminal_type,omitempty"`
+	User         string    `json:"user,omitempty"`
+	Password     string    `json:"password,omitempty"`
+	Command      string    `json:"command,omitempty"`
+	// Raw bytes received or sent, base64 encoded
+	Data     []byte  `json:"data,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+}
+
+// Connection emulating login and shell
+type Session struct {
+	connection.Connection
+	ID        int
+	Config    Config
+	Logger    *audit.Logger
+	StartTime time.Time
+	peer      string
+	// Client commands in order received and values logged with every event
+	negotiation  []string
+	terminalType string
+	user         string
+	mu           sync.Mutex
+	// Client input read by the reader goroutine
+	input   chan []byte
+	closed  chan struct{}
+	done    chan struct{}
+	pending []byte
+	skipLF  bool
+	// Set while the client let us echo
+	echo int32
+}
+
+// Conn logging every byte
+type loggingConn struct {
+	net.Conn
+	session *Session
+}
+
+// Counts live sessions against MaxSessions and MaxSessionsPerIP
+type sessionLimit struct {
+	maxSessions      int
+	maxSessionsPerIP int
+	total            int
+	perIP            map[string]int
+	mu               sync.Mutex
+}
+
+// Logins allowed per connection before disconnecting
+const maxLoginAttempts = 3
+
+// Delay after failed login
+const loginFailDelay = 2 * time.Second
+
+// Longest input line kept
+const maxLine = 64 * 1024
+
+var errInterrupt = errors.New("interrupt")
+
+// Parses policy "any", "none", "attempts:N" or "file:PATH" with user:password lines
+func ParsePolicy(s string) (Policy, error) {
+	mode, arg, _ := strings.Cut(s, ":")
+	policy := Policy{Mode: mode}
+	switch mode {
+	case "any", "none":
+	case "attempts":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return policy, fmt.Errorf("invalid attempts %q", arg)
+		}
+		policy.Attempts = n
+	case "file":
+		file, err := os.Open(arg)
+		if err != nil {
+			return policy, err
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if len(line) == 0 || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, password, ok := strings.Cut(line, ":")
+			if !ok {
+				return policy, fmt.Errorf("%s: invalid line %q", arg, line)
+			}
+			policy.Credentials = append(policy.Credentials, [2]string{user, password})
+		}
+		if err := scanner.Err(); err != nil {
+			return policy, err
+		}
+	default:
+		return policy, fmt.Errorf("unknown policy %q", s)
+	}
+	return policy, nil
+}
+
+func (p Policy) Accept(user string, password string, attempt int) bool {
+	switch p.Mode {
+	case "any":
+		return true
+	case "attempts":
+		return attempt >= p.Attempts
+	case "file":
+		for _, c := range p.Credentials {
+			if (c[0] == "*" || c[0] == user) && (c[1] == "*" || c[1] == password) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func New(ip string, port int, supportOptions []byte) *Session {
+	s := new(Session)
+	s.IsServer = true
+	s.IP = ip
+	s.Port = port
+	s.SupportOptions = supportOptions
+	s.EnableOptions = map[byte]bool{}
+	// Record client negotiation and answer like the real server
+	s.BuildCmdRes = func(c connection.Connection, mainCmd byte, subCmd byte, options ...byte) ([]byte, error) {
+		s.record(mainCmd, subCmd, options)
+		return server.BuildCmdRes(c, mainCmd, subCmd, options...)
+	}
+	return s
+}
+
+func Run(ip string, port int, config Config) {
+	ln, err := net.Listen("tcp", ip+":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatal("Error:", err)
+	}
+	defer ln.Close()
+	fmt.Printf("Honeypot listen on %s:%d...\n", ip, port)
+
+	logger, err := audit.New(config.Log)
+	if err != nil {
+		log.Fatal("Error:", err)
+	}
+	defer logger.Close()
+
+	// Same options as the real server
+	supportOptions := []byte{opt.ECHO, opt.SUPPRESS_GO_AHEAD, opt.TERMINAL_TYPE, opt.NEGOTIATE_ABOUT_WINDOW_SIZE, opt.TERMINAL_SPEED}
+	limit := &sessionLimit{maxSessions: config.MaxSessions, maxSessionsPerIP: config.MaxSessionsPerIP, perIP: map[string]int{}}
+	for id := 1; ; id++ {
+		s := New(ip, port, supportOptions)
+		s.ID = id
+		s.Config = config
+		s.Logger = logger
+		err := s.Accept(ln)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Println("Error:", err)
+			continue
+		}
+		host, _, _ := net.SplitHostPort(s.Conn.RemoteAddr().String())
+		err = limit.acquire(host)
+		if err != nil {
+			log.Printf("Honeypot %d: Refused %s: %s", s.ID, s.Conn.RemoteAddr(), err)
+			s.Conn.Close()
+			continue
+		}
+		go func() {
+			defer limit.release(host)
+			s.Handle()
+		}()
+	}
+}
+
+// Counts a session from host if limits allow
+func (l *sessionLimit) acquire(host string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSessions > 0 && l.total >= l.maxSessions {
+		return fmt.Errorf("too many sessions")
+	}
+	if l.maxSessionsPerIP > 0 && l.perIP[host] >= l.maxSessionsPerIP {
+		return fmt.Errorf("too many sessions from %s", host)
+	}
+	l.total++
+	l.perIP[host]++
+	return nil
+}
+
+func (l *sessionLimit) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[host]--; l.perIP[host] <= 0 {
+		delete(l.perIP, host)
+	}
+}
+
+func (s *Session) Handle() {
+	s.StartTime = time.Now()
+	s.peer = s.Conn.RemoteAddr().String()
+	s.Conn = &loggingConn{Conn: s.Conn, session: s}
+	s.Reader = bufio.NewReader(s.Conn)
+	s.Terminal = terminal.New()
+	s.Terminal.EnvChan = make(chan []string, 1)
+	s.Terminal.Type = s.Config.DefaultType
+	s.ErrChan = make(chan error, 8)
+	s.input = make(chan []byte)
+	s.closed = make(chan struct{})
+	s.done = make(chan struct{})
+	defer s.Conn.Close()
+	defer close(s.done)
+	log.Printf("Honeypot %d: Client Connected from %s", s.ID, s.peer)
+	s.log(Event{Event: "connect"})
+
+	go func() {
+		for err := range s.ErrChan {
+			log.Printf("Honeypot %d: Error: %s", s.ID, err)
+		}
+	}()
+	defer close(s.ErrChan)
+
+	err := s.ReqCmds(s.SupportOptions)
+	if err != nil {
+		return
+	}
+	go s.read()
+
+	// Wait for terminal type like the real server before the login prompt
+	timer := time.NewTimer(s.Config.NegotiationTimeout)
+	select {
+	case <-s.Terminal.EnvChan:
+	case <-timer.C:
+	case <-s.closed:
+	}
+	timer.Stop()
+	s.log(Event{Event: "negotiation"})
+
+	user, ok := s.login()
+	if ok {
+		s.mu.Lock()
+		s.user = user
+		s.mu.Unlock()
+		s.shell(NewShell(user, s.Config.Hostname))
+	}
+	s.log(Event{Event: "disconnect", Duration: time.Since(s.StartTime).Seconds()})
+	log.Printf("Honeypot %d: Ended after %s", s.ID, time.Since(s.StartTime).Round(time.Second))
+}
+
+// Reads client messages, answering negotiation, until disconnect or idle timeout
+func (s *Session) read() {
+	defer close(s.closed)
+	for {
+		if s.Config.IdleTimeout > 0 {
+			s.Conn.SetReadDeadline(time.Now().Add(s.Config.IdleTimeout))
+		}
+		byteMessage, err := s.ReadMessage()
+		if err != nil {
+			return
+		}
+		echo := int32(0)
+		if s.EnableOptions[opt.ECHO] {
+			echo = 1
+		}
+		atomic.StoreInt32(&s.echo, echo)
+		if len(byteMessage) == 0 {
+			continue
+		}
+		select {
+		case s.input <- byteMessage:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Session) login() (string, bool) {
+	attempts := maxLoginAttempts
+	if s.Config.Policy.Attempts > attempts {
+		attempts = s.Config.Policy.Attempts
+	}
+	for attempt := 1; attempt <= attempts; {
+		s.write(s.Config.Hostname + " login: ")
+		user, err := s.readLine(true)
+		if err == errInterrupt {
+			continue
+		} else if err != nil {
+			return "", false
+		}
+		user = strings.TrimSpace(user)
+		if len(user) == 0 {
+			continue
+		}
+		s.write("Password: ")
+		password, err := s.readLine(false)
+		if err != nil && err != errInterrupt {
+			s.log(Event{Event: "login_failed", User: user})
+			return "", false
+		}
+		if s.Config.Policy.Accept(user, password, attempt) {
+			s.log(Event{Event: "login_success", User: user, Password: password})
+			return user, true
+		}
+		s.log(Event{Event: "login_failed", User: user, Password: password})
+		time.Sleep(loginFailDelay)
+		s.write("\r\nLogin incorrect\r\n")
+		attempt++
+	}
+	return "", false
+}
+
+func (s *Session) shell(sh *Shell) {
+	host, _, _ := net.SplitHostPort(s.peer)
+	s.write(fmt.Sprintf("Welcome to Ubuntu 20.04.6 LTS (GNU/Linux %s x86_64)\r\n\r\n"+
+		" * Documentation:  https://help.ubuntu.com\r\n"+
+		" * Management:     https://landscape.canonical.com\r\n"+
+		" * Support:        https://ubuntu.com/advantage\r\n\r\n"+
+		"Last login: %s from %s\r\n", kernelRelease, s.StartTime.Add(-26*time.Hour).Format("Mon Jan _2 15:04:05 2006"), host))
+	for !sh.exited {
+		s.write(sh.Prompt())
+		line, err := s.readLine(true)
+		if err == errInterrupt {
+			continue
+		} else if err != nil {
+			return
+		}
+		if len(strings.TrimSpace(line)) > 0 {
+			s.log(Event{Event: "command", Command: line})
+		}
+		output := sh.Run(line)
+		if sh.clear {
+			s.write("\x1b[H\x1b[2J")
+			sh.clear = false
+		}
+		s.write(strings.ReplaceAll(output, "\n", "\r\n"))
+	}
+}
+
+// Reads a line of input, echoing it if echo is true and the client does not
+func (s *Session) readLine(echo bool) (string, error) {
+	var line []byte
+	const (
+		escapeNone = iota
+		escapeStart
+		escapeParams
+	)
+	escape := escapeNone
+	for {
+		if len(s.pending) == 0 {
+			select {
+			case s.pending = <-s.input:
+			case <-s.closed:
+				return "", io.EOF
+			}
+			continue
+		}
+		c := s.pending[0]
+		s.pending = s.pending[1:]
+		if s.skipLF {
+			s.skipLF = false
+			if c == '\n' || c == 0 {
+				continue
+			}
+		}
+		serverEcho := atomic.LoadInt32(&s.echo) == 1
+
+		// Skip escape sequences such as cursor keys
+		switch escape {
+		case escapeStart:
+			escape = escapeNone
+			if c == '[' || c == 'O' {
+				escape = escapeParams
+			}
+			continue
+		case escapeParams:
+			if c >= 0x40 && c <= 0x7e {
+				escape = escapeNone
+			}
+			continue
+		}
+
+		switch {
+		case c == '\r' || c == '\n':
+			s.skipLF = c == '\r'
+			if serverEcho {
+				s.write("\r\n")
+			}
+			return string(line), nil
+		case c == 3:
+			s.write("^C\r\n")
+			return "", errInterrupt
+		case c == 4 && len(line) == 0:
+			return "", io.EOF
+		case c == '\b' || c == 0x7f:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				if echo && serverEcho {
+					s.write("\b \b")
+				}
+			}
+		case c == 0x1b:
+			escape = escapeStart
+		case c < 0x20 && c != '\t':
+		case len(line) < maxLine:
+			line = append(line, c)
+			if echo && serverEcho {
+				s.write(string(c))
+			}
+		}
+	}
+}
+
+func (s *Session) write(text string) error {
+	return s.WriteBytes(cmd.Escape([]byte(text)))
+}
+
+// Describes a command received from client for the fingerprint
+func (s *Session) record(mainCmd byte, subCmd byte, options []byte) {
+	// SE is described with its subnegotiation
+	if mainCmd == cmd.SE {
+		return
+	}
+	var description string
+	switch {
+	case mainCmd == cmd.SB && subCmd == opt.NEGOTIATE_ABOUT_WINDOW_SIZE && len(options) == 4:
+		description = fmt.Sprintf("SB NAWS %dx%d", int(options[0])<<8|int(options[1]), int(options[2])<<8|int(options[3]))
+	case mainCmd == cmd.SB && (subCmd == opt.TERMINAL_TYPE || subCmd == opt.TERMINAL_SPEED) && len(options) > 0 && options[0] == 0:
+		description = "SB " + opt.Name(subCmd) + " IS " + string(options[1:])
+	case mainCmd == cmd.SB:
+		description = fmt.Sprintf("SB %s % x", opt.Name(subCmd), options)
+	case cmd.IsNeedOption(mainCmd):
+		description = cmd.Name(mainCmd) + " " + opt.Name(subCmd)
+	default:
+		description = cmd.Name(mainCmd)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.negotiation = append(s.negotiation, strings.TrimSpace(description))
+	if mainCmd == cmd.SB && subCmd == opt.TERMINAL_TYPE && len(options) > 0 && options[0] == 0 && len(s.terminalType) == 0 {
+		s.terminalType = string(options[1:])
+	}
+}
+
+// Returns client negotiation received so far
+func (s *Session) Fingerprint() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strings.Join(s.negotiation, ", ")
+}
+
+func (s *Session) log(e Event) {
+	e.Time = time.Now()
+	e.Session = s.ID
+	e.Peer = s.peer
+	e.Fingerprint = s.Fingerprint()
+	s.mu.Lock()
+	e.TerminalType = s.terminalType
+	if len(e.User) == 0 {
+		e.User = s.user
+	}
+	s.mu.Unlock()
+	err := s.Logger.Log(e)
+	if err != nil {
+		log.Printf("Honeypot %d: Error: %s", s.ID, err)
+	}
+}
+
+func (c *loggingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.session.log(Event{Event: "recv", Data: append([]byte(nil), p[:n]...)})
+	}
+	return n, err
+}
+
+func (c *loggingConn) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		c.session.log(Event{Event: "send", Data: append([]byte(nil), p...)})
+	}
+	return c.Conn.Write(p)
+}
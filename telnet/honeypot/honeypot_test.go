@@ -0,0 +1,184 @@
+package honeypot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"telnet/audit"
+	opt "telnet/option"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials")
+	err := os.WriteFile(path, []byte("# accepted logins\nroot:admin\n\nguest:*\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		policy   string
+		user     string
+		password string
+		attempt  int
+		accept   bool
+	}{
+		{"any", "root", "x", 1, true},
+		{"none", "root", "admin", 5, false},
+		{"attempts:3", "root", "x", 2, false},
+		{"attempts:3", "root", "x", 3, true},
+		{"file:" + path, "root", "admin", 1, true},
+		{"file:" + path, "root", "root", 1, false},
+		{"file:" + path, "guest", "anything", 1, true},
+		{"file:" + path, "admin", "admin", 1, false},
+	}
+	for _, test := range tests {
+		policy, err := ParsePolicy(test.policy)
+		if err != nil {
+			t.Fatalf("%s: %v", test.policy, err)
+		}
+		if got := policy.Accept(test.user, test.password, test.attempt); got != test.accept {
+			t.Errorf("%s accepts %s:%s on attempt %d = %v", test.policy, test.user, test.password, test.attempt, got)
+		}
+	}
+
+	for _, s := range []string{"some", "attempts:0", "attempts:x", "file:" + filepath.Join(t.TempDir(), "missing")} {
+		if _, err := ParsePolicy(s); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
+
+func TestShellCommands(t *testing.T) {
+	tests := []struct {
+		line   string
+		output string
+	}{
+		{"whoami", "root\n"},
+		{"id", "uid=0(root) gid=0(root) groups=0(root)\n"},
+		{"hostname", "web01\n"},
+		{"pwd", "/root\n"},
+		{"echo hello | wc -c", "6\n"},
+		{"false || echo fallback", "fallback\n"},
+		{"nosuch", "nosuch: command not found\n"},
+	}
+	for _, test := range tests {
+		sh := NewShell("root", "web01")
+		if got := sh.Run(test.line); got != test.output {
+			t.Errorf("%q output %q, want %q", test.line, got, test.output)
+		}
+	}
+}
+
+// Logs in over a pipe, runs one command and checks the events logged
+func TestSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events")
+	logger, err := audit.New(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	s := New("127.0.0.1", 23, []byte{opt.ECHO, opt.SUPPRESS_GO_AHEAD, opt.TERMINAL_TYPE})
+	s.ID = 1
+	s.Config = Config{Hostname: "web01", Policy: Policy{Mode: "any"}, NegotiationTimeout: 10 * time.Millisecond}
+	s.Logger = logger
+	s.Conn = serverConn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Handle()
+	}()
+
+	var mu sync.Mutex
+	var output bytes.Buffer
+	received := make(chan struct{}, 1)
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, err := clientConn.Read(b)
+			mu.Lock()
+			output.Write(b[:n])
+			mu.Unlock()
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	expect := func(text string) {
+		t.Helper()
+		timer := time.NewTimer(5 * time.Second)
+		defer timer.Stop()
+		for {
+			mu.Lock()
+			found := strings.Contains(output.String(), text)
+			mu.Unlock()
+			if found {
+				return
+			}
+			select {
+			case <-received:
+			case <-timer.C:
+				t.Fatalf("timed out waiting for %q", text)
+			}
+		}
+	}
+
+	expect("web01 login: ")
+	clientConn.Write([]byte("root\r\n"))
+	expect("Password: ")
+	clientConn.Write([]byte("secret\r\n"))
+	expect("root@web01:~# ")
+	clientConn.Write([]byte("uname -s\r\n"))
+	expect("Linux\r\n")
+	clientConn.Write([]byte("exit\r\n"))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end")
+	}
+	clientConn.Close()
+	logger.Close()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Event == "recv" || e.Event == "send" {
+			continue
+		}
+		events = append(events, e)
+	}
+	want := []Event{
+		{Event: "connect"},
+		{Event: "negotiation"},
+		{Event: "login_success", User: "root", Password: "secret"},
+		{Event: "command", User: "root", Command: "uname -s"},
+		{Event: "command", User: "root", Command: "exit"},
+		{Event: "disconnect", User: "root"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events %+v, want %d", len(events), events, len(want))
+	}
+	for i, e := range events {
+		if e.Event != want[i].Event || e.User != want[i].User || e.Password != want[i].Password || e.Command != want[i].Command || e.Session != 1 {
+			t.Errorf("event %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+}
@@ -0,0 +1,826 @@
+package honeypot
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const kernelRelease = "5.4.0-166-generic"
+
+// Lines kept by history, as HISTSIZE in bash
+const maxHistory = 500
+
+// Emulated shell, nothing is ever executed
+type Shell struct {
+	User     string
+	Hostname string
+	Home     string
+	Cwd      string
+	FS       *Filesystem
+	history  []string
+	// Lines dropped from the start of history
+	historyStart int
+	exited       bool
+	// Output that clears the screen
+	clear bool
+}
+
+type command func(sh *Shell, args []string, stdin string) (string, int)
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"busybox":  busybox,
+		"cat":      cat,
+		"cd":       cd,
+		"clear":    clear,
+		"curl":     curl,
+		"echo":     echo,
+		"env":      env,
+		"exit":     exit,
+		"free":     free,
+		"grep":     grep,
+		"head":     head,
+		"history":  history,
+		"hostname": hostname,
+		"id":       id,
+		"ifconfig": ifconfig,
+		"logout":   exit,
+		"ls":       ls,
+		"mkdir":    mkdir,
+		"nproc":    constant("2\n"),
+		"ps":       ps,
+		"pwd":      pwd,
+		"rm":       rm,
+		"tail":     tail,
+		"touch":    touch,
+		"uname":    uname,
+		"uptime":   uptime,
+		"w":        w,
+		"wc":       wc,
+		"wget":     wget,
+		"which":    which,
+		"whoami":   whoami,
+	}
+	// Accepted without output
+	for _, name := range []string{"cp", "chmod", "chown", "export", "kill", "killall", "mv", "nohup", "set", "sleep", "sync", "ulimit", "unset", ":", "true"} {
+		commands[name] = constant("")
+	}
+	commands["false"] = func(sh *Shell, args []string, stdin string) (string, int) { return "", 1 }
+	commands["sudo"] = func(sh *Shell, args []string, stdin string) (string, int) { return sh.run(args[1:], stdin) }
+}
+
+func NewShell(user string, hostname string) *Shell {
+	sh := &Shell{User: user, Hostname: hostname, Home: "/home/" + user}
+	if user == "root" {
+		sh.Home = "/root"
+	}
+	sh.Cwd = sh.Home
+	sh.FS = NewFilesystem(hostname, user)
+	return sh
+}
+
+func (sh *Shell) Prompt() string {
+	cwd := sh.Cwd
+	if cwd == sh.Home {
+		cwd = "~"
+	} else if strings.HasPrefix(cwd, sh.Home+"/") {
+		cwd = "~" + cwd[len(sh.Home):]
+	}
+	sign := "$"
+	if sh.User == "root" {
+		sign = "#"
+	}
+	return fmt.Sprintf("%s@%s:%s%s ", sh.User, sh.Hostname, cwd, sign)
+}
+
+// Runs a command line and returns its output
+func (sh *Shell) Run(line string) string {
+	if len(strings.TrimSpace(line)) > 0 {
+		sh.history = append(sh.history, line)
+		if len(sh.history) > maxHistory {
+			sh.historyStart += len(sh.history) - maxHistory
+			sh.history = sh.history[len(sh.history)-maxHistory:]
+		}
+	}
+	var output strings.Builder
+	status := 0
+	// Operator before the pipeline decides whether it runs
+	operator := ";"
+	for _, pipeline := range parse(line) {
+		skip := (operator == "&&" && status != 0) || (operator == "||" && status == 0)
+		operator = pipeline.operator
+		if skip {
+			continue
+		}
+		var out string
+		out, status = sh.pipeline(pipeline.stages)
+		output.WriteString(out)
+		if sh.exited {
+			break
+		}
+	}
+	return output.String()
+}
+
+// Runs stages passing output as input of the next stage
+func (sh *Shell) pipeline(stages []stage) (string, int) {
+	var output string
+	status := 0
+	for _, st := range stages {
+		if len(st.args) == 0 {
+			continue
+		}
+		output, status = sh.run(st.args, output)
+		if len(st.redirect) > 0 {
+			err := sh.FS.writeFile(sh.abs(st.redirect), sh.User, output, st.appendRedirect)
+			if err != nil {
+				return "-bash: " + st.redirect + ": " + err.Error() + "\n", 1
+			}
+			output = ""
+		}
+	}
+	return output, status
+}
+
+func (sh *Shell) run(args []string, stdin string) (string, int) {
+	if len(args) == 0 {
+		return "", 0
+	}
+	name := args[0]
+	if strings.Contains(name, "/") {
+		n := sh.FS.lookup(sh.abs(name))
+		if n == nil {
+			return "-bash: " + name + ": " + errNotFound.Error() + "\n", 127
+		}
+		if n.dir {
+			return "-bash: " + name + ": " + errIsDir.Error() + "\n", 126
+		}
+		if !strings.Contains(n.mode, "x") {
+			return "-bash: " + name + ": " + errPermission.Error() + "\n", 126
+		}
+		name = path.Base(name)
+	}
+	c, ok := commands[name]
+	if !ok {
+		// Scripts and binaries dropped by the client run without output
+		if name == "sh" || name == "bash" || strings.HasPrefix(args[0], "./") {
+			return "", 0
+		}
+		return name + ": command not found\n", 127
+	}
+	return c(sh, args, stdin)
+}
+
+// Returns absolute path relative to the working directory
+func (sh *Shell) abs(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		p = sh.Home + p[1:]
+	}
+	if !path.IsAbs(p) {
+		p = path.Join(sh.Cwd, p)
+	}
+	return path.Clean(p)
+}
+
+type stage struct {
+	args           []string
+	redirect       string
+	appendRedirect bool
+}
+
+type pipeline struct {
+	stages []stage
+	// Operator following the pipeline: ";", "&&", "||" or "&"
+	operator string
+}
+
+// Splits a command line into pipelines, honoring quotes and backslashes
+func parse(line string) []pipeline {
+	var pipelines []pipeline
+	var current pipeline
+	var st stage
+	var word strings.Builder
+	inWord := false
+	redirect := ""
+	quote := rune(0)
+
+	endWord := func() {
+		if !inWord {
+			return
+		}
+		if redirect == "2>" {
+			// Error output is not separated
+			redirect = ""
+		} else if len(redirect) > 0 {
+			st.redirect = word.String()
+			st.appendRedirect = redirect == ">>"
+			redirect = ""
+		} else {
+			st.args = append(st.args, word.String())
+		}
+		word.Reset()
+		inWord = false
+	}
+	endStage := func() {
+		endWord()
+		current.stages = append(current.stages, st)
+		st = stage{}
+	}
+	endPipeline := func(operator string) {
+		endStage()
+		current.operator = operator
+		pipelines = append(pipelines, current)
+		current = pipeline{}
+	}
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		next := rune(0)
+		if i+1 < len(runes) {
+			next = runes[i+1]
+		}
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\' && next != 0:
+			word.WriteRune(next)
+			inWord = true
+			i++
+		case r == ' ' || r == '\t':
+			endWord()
+		case r == ';':
+			endPipeline(";")
+		case r == '&' && next == '&':
+			endPipeline("&&")
+			i++
+		case r == '&':
+			endPipeline("&")
+		case r == '|' && next == '|':
+			endPipeline("||")
+			i++
+		case r == '|':
+			endStage()
+		case r == '>':
+			fd := ""
+			if inWord && (word.String() == "1" || word.String() == "2") {
+				fd = word.String()
+				word.Reset()
+				inWord = false
+			}
+			endWord()
+			redirect = ">"
+			if next == '>' {
+				redirect = ">>"
+				i++
+			}
+			if fd == "2" {
+				redirect = "2>"
+			}
+			// Ignore 2>&1
+			if i+2 < len(runes) && runes[i+1] == '&' {
+				redirect = ""
+				i += 2
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	endPipeline(";")
+	return pipelines
+}
+
+func constant(output string) command {
+	return func(sh *Shell, args []string, stdin string) (string, int) {
+		return output, 0
+	}
+}
+
+// Splits arguments into flags and operands
+func flags(args []string) (string, []string) {
+	var letters strings.Builder
+	var operands []string
+	for _, arg := range args[1:] {
+		if len(arg) > 1 && arg[0] == '-' {
+			letters.WriteString(strings.TrimLeft(arg, "-"))
+			continue
+		}
+		operands = append(operands, arg)
+	}
+	return letters.String(), operands
+}
+
+func busybox(sh *Shell, args []string, stdin string) (string, int) {
+	if len(args) == 1 {
+		return "BusyBox v1.30.1 (Ubuntu 1:1.30.1-4ubuntu6.4) multi-call binary.\nBusyBox is copyrighted by many authors between 1998-2015.\n\nUsage: busybox [function [arguments]...]\n", 0
+	}
+	if _, ok := commands[args[1]]; !ok {
+		return args[1] + ": applet not found\n", 127
+	}
+	return sh.run(args[1:], stdin)
+}
+
+func cat(sh *Shell, args []string, stdin string) (string, int) {
+	_, files := flags(args)
+	if len(files) == 0 {
+		return stdin, 0
+	}
+	var output strings.Builder
+	status := 0
+	for _, file := range files {
+		content, err := sh.FS.readFile(sh.abs(file), sh.User)
+		if err != nil {
+			output.WriteString("cat: " + file + ": " + err.Error() + "\n")
+			status = 1
+			continue
+		}
+		output.WriteString(content)
+	}
+	return output.String(), status
+}
+
+func cd(sh *Shell, args []string, stdin string) (string, int) {
+	dir := sh.Home
+	if len(args) > 1 {
+		dir = sh.abs(args[1])
+	}
+	n := sh.FS.lookup(dir)
+	if n == nil {
+		return "-bash: cd: " + args[1] + ": " + errNotFound.Error() + "\n", 1
+	}
+	if !n.dir {
+		return "-bash: cd: " + args[1] + ": " + errNotDir.Error() + "\n", 1
+	}
+	if sh.User != "root" && n.mode == "drwx------" && n.owner != sh.User {
+		return "-bash: cd: " + args[1] + ": " + errPermission.Error() + "\n", 1
+	}
+	sh.Cwd = dir
+	return "", 0
+}
+
+func clear(sh *Shell, args []string, stdin string) (string, int) {
+	sh.clear = true
+	return "", 0
+}
+
+func curl(sh *Shell, args []string, stdin string) (string, int) {
+	_, operands := flags(args)
+	if len(operands) == 0 {
+		return "curl: try 'curl --help' or 'curl --manual' for more information\n", 2
+	}
+	return "curl: (6) Could not resolve host: " + host(operands[0]) + "\n", 6
+}
+
+func wget(sh *Shell, args []string, stdin string) (string, int) {
+	_, operands := flags(args)
+	if len(operands) == 0 {
+		return "wget: missing URL\nUsage: wget [OPTION]... [URL]...\n", 1
+	}
+	target := host(operands[0])
+	return fmt.Sprintf("--%s--  %s\nResolving %s (%s)... failed: Temporary failure in name resolution.\nwget: unable to resolve host address '%s'\n", time.Now().Format("2006-01-02 15:04:05"), operands[0], target, target, target), 4
+}
+
+// Returns host part of URL given to downloaders
+func host(rawURL string) string {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || len(u.Hostname()) == 0 {
+		return rawURL
+	}
+	return u.Hostname()
+}
+
+func echo(sh *Shell, args []string, stdin string) (string, int) {
+	newline := true
+	interpret := false
+	words := args[1:]
+	for len(words) > 0 && (words[0] == "-n" || words[0] == "-e" || words[0] == "-ne" || words[0] == "-en") {
+		newline = newline && !strings.Contains(words[0], "n")
+		interpret = interpret || strings.Contains(words[0], "e")
+		words = words[1:]
+	}
+	output := strings.Join(words, " ")
+	if interpret {
+		output = unescape(output)
+	}
+	if newline {
+		output += "\n"
+	}
+	return output, 0
+}
+
+// Interprets backslash escapes of echo -e, including \xHH used by bots
+func unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '\\':
+			b.WriteByte('\\')
+		case 'x':
+			if i+2 < len(s) {
+				if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+					b.WriteByte(byte(v))
+					i += 2
+					continue
+				}
+			}
+			b.WriteString("\\x")
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func env(sh *Shell, args []string, stdin string) (string, int) {
+	return fmt.Sprintf("SHELL=/bin/bash\nPWD=%s\nLOGNAME=%s\nHOME=%s\nLANG=C.UTF-8\nTERM=xterm\nUSER=%s\nSHLVL=1\nPATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin\n_=/usr/bin/env\n", sh.Cwd, sh.User, sh.Home, sh.User), 0
+}
+
+func exit(sh *Shell, args []string, stdin string) (string, int) {
+	sh.exited = true
+	return "logout\n", 0
+}
+
+func free(sh *Shell, args []string, stdin string) (string, int) {
+	return "              total        used        free      shared  buff/cache   available\n" +
+		"Mem:        2035452      430676      315008        1168     1289768     1423612\n" +
+		"Swap:       2097148        3840     2093308\n", 0
+}
+
+// Reads operand files or stdin for filters
+func (sh *Shell) input(name string, files []string, stdin string) (string, string, int) {
+	if len(files) == 0 {
+		return stdin, "", 0
+	}
+	var input, errors strings.Builder
+	status := 0
+	for _, file := range files {
+		content, err := sh.FS.readFile(sh.abs(file), sh.User)
+		if err != nil {
+			errors.WriteString(name + ": " + file + ": " + err.Error() + "\n")
+			status = 1
+			continue
+		}
+		input.WriteString(content)
+	}
+	return input.String(), errors.String(), status
+}
+
+func lines(s string) []string {
+	return strings.SplitAfter(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+func grep(sh *Shell, args []string, stdin string) (string, int) {
+	letters, operands := flags(args)
+	if len(operands) == 0 {
+		return "Usage: grep [OPTION]... PATTERNS [FILE]...\n", 2
+	}
+	pattern := operands[0]
+	input, errors, status := sh.input("grep", operands[1:], stdin)
+	ignoreCase := strings.Contains(letters, "i")
+	invert := strings.Contains(letters, "v")
+	var output strings.Builder
+	found := false
+	for _, line := range lines(input) {
+		subject, p := line, pattern
+		if ignoreCase {
+			subject, p = strings.ToLower(line), strings.ToLower(pattern)
+		}
+		if len(line) > 0 && strings.Contains(subject, p) != invert {
+			output.WriteString(strings.TrimSuffix(line, "\n") + "\n")
+			found = true
+		}
+	}
+	if status == 0 && !found {
+		status = 1
+	}
+	return errors + output.String(), status
+}
+
+// Parses -n N and -N of head and tail
+func count(args []string) (int, []string) {
+	n := 10
+	var files []string
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "-n" && i+1 < len(args):
+			n, _ = strconv.Atoi(args[i+1])
+			i++
+		case strings.HasPrefix(args[i], "-"):
+			if v, err := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(args[i], "-n"), "-")); err == nil {
+				n = v
+			}
+		default:
+			files = append(files, args[i])
+		}
+	}
+	return n, files
+}
+
+func head(sh *Shell, args []string, stdin string) (string, int) {
+	n, files := count(args)
+	input, errors, status := sh.input("head", files, stdin)
+	all := lines(input)
+	if n < len(all) {
+		all = all[:n]
+	}
+	return errors + strings.Join(all, ""), status
+}
+
+func tail(sh *Shell, args []string, stdin string) (string, int) {
+	n, files := count(args)
+	input, errors, status := sh.input("tail", files, stdin)
+	all := lines(input)
+	if n < len(all) {
+		all = all[len(all)-n:]
+	}
+	return errors + strings.Join(all, ""), status
+}
+
+func wc(sh *Shell, args []string, stdin string) (string, int) {
+	letters, files := flags(args)
+	input, errors, status := sh.input("wc", files, stdin)
+	counts := map[byte]int{
+		'l': strings.Count(input, "\n"),
+		'w': len(strings.Fields(input)),
+		'c': len(input),
+	}
+	if len(letters) == 0 {
+		letters = "lwc"
+	}
+	var fields []string
+	for _, c := range []byte("lwc") {
+		if strings.IndexByte(letters, c) >= 0 {
+			fields = append(fields, strconv.Itoa(counts[c]))
+		}
+	}
+	return errors + strings.Join(fields, " ") + "\n", status
+}
+
+func history(sh *Shell, args []string, stdin string) (string, int) {
+	var output strings.Builder
+	for i, line := range sh.history {
+		fmt.Fprintf(&output, "%5d  %s\n", sh.historyStart+i+1, line)
+	}
+	return output.String(), 0
+}
+
+func hostname(sh *Shell, args []string, stdin string) (string, int) {
+	return sh.Hostname + "\n", 0
+}
+
+func id(sh *Shell, args []string, stdin string) (string, int) {
+	if sh.User == "root" {
+		return "uid=0(root) gid=0(root) groups=0(root)\n", 0
+	}
+	return fmt.Sprintf("uid=1000(%s) gid=1000(%s) groups=1000(%s),4(adm),24(cdrom),27(sudo),30(dip),46(plugdev)\n", sh.User, sh.User, sh.User), 0
+}
+
+func ifconfig(sh *Shell, args []string, stdin string) (string, int) {
+	return "eth0: flags=4163<UP,BROADCAST,RUNNING,MULTICAST>  mtu 1500\n" +
+		"        inet 10.0.2.15  netmask 255.255.255.0  broadcast 10.0.2.255\n" +
+		"        ether 52:54:00:12:34:56  txqueuelen 1000  (Ethernet)\n" +
+		"        RX packets 1845213  bytes 1893022371 (1.8 GB)\n" +
+		"        TX packets 902144  bytes 71293311 (71.2 MB)\n\n" +
+		"lo: flags=73<UP,LOOPBACK,RUNNING>  mtu 65536\n" +
+		"        inet 127.0.0.1  netmask 255.0.0.0\n" +
+		"        loop  txqueuelen 1000  (Local Loopback)\n", 0
+}
+
+func ls(sh *Shell, args []string, stdin string) (string, int) {
+	letters, operands := flags(args)
+	long := strings.Contains(letters, "l")
+	all := strings.Contains(letters, "a")
+	if len(operands) == 0 {
+		operands = []string{"."}
+	}
+	var output strings.Builder
+	status := 0
+	for _, operand := range operands {
+		dir := sh.abs(operand)
+		n := sh.FS.lookup(dir)
+		if n == nil {
+			output.WriteString("ls: cannot access '" + operand + "': " + errNotFound.Error() + "\n")
+			status = 2
+			continue
+		}
+		if !n.dir {
+			output.WriteString(entry(operand, n, long))
+			continue
+		}
+		if sh.User != "root" && n.mode == "drwx------" && n.owner != sh.User {
+			output.WriteString("ls: cannot open directory '" + operand + "': " + errPermission.Error() + "\n")
+			status = 2
+			continue
+		}
+		if len(operands) > 1 {
+			output.WriteString(operand + ":\n")
+		}
+		var names []string
+		if all {
+			names = append(names, ".", "..")
+		}
+		for _, name := range n.names() {
+			if all || !strings.HasPrefix(name, ".") {
+				names = append(names, name)
+			}
+		}
+		if long {
+			fmt.Fprintf(&output, "total %d\n", 4*len(names))
+			for _, name := range names {
+				child := n.children[name]
+				switch name {
+				case ".":
+					child = n
+				case "..":
+					child = sh.FS.lookup(path.Dir(dir))
+				}
+				output.WriteString(entry(name, child, true))
+			}
+		} else if len(names) > 0 {
+			output.WriteString(strings.Join(names, "  ") + "\n")
+		}
+	}
+	return output.String(), status
+}
+
+func entry(name string, n *node, long bool) string {
+	if !long {
+		return name + "\n"
+	}
+	links := 1
+	if n.dir {
+		links = 2 + len(n.children)
+	}
+	return fmt.Sprintf("%s %d %s %s %5d %s %s\n", n.mode, links, n.owner, n.owner, n.size(), n.modTime.Format("Jan _2 15:04"), name)
+}
+
+func mkdir(sh *Shell, args []string, stdin string) (string, int) {
+	letters, operands := flags(args)
+	var output strings.Builder
+	status := 0
+	for _, operand := range operands {
+		err := sh.FS.mkdir(sh.abs(operand), sh.User)
+		if err == errExists && strings.Contains(letters, "p") {
+			continue
+		}
+		if err != nil {
+			output.WriteString("mkdir: cannot create directory '" + operand + "': " + err.Error() + "\n")
+			status = 1
+		}
+	}
+	return output.String(), status
+}
+
+func ps(sh *Shell, args []string, stdin string) (string, int) {
+	letters, _ := flags(args)
+	if len(letters) == 0 && !strings.Contains(strings.Join(args[1:], ""), "aux") {
+		return "    PID TTY          TIME CMD\n   2841 pts/0    00:00:00 bash\n   2907 pts/0    00:00:00 ps\n", 0
+	}
+	return "USER         PID %CPU %MEM    VSZ   RSS TTY      STAT START   TIME COMMAND\n" +
+		"root           1  0.0  0.5 169880 11520 ?        Ss   " + bootTime.Format("Jan02") + "   0:42 /sbin/init\n" +
+		"root         412  0.0  0.2  30028  5124 ?        Ss   " + bootTime.Format("Jan02") + "   0:03 /usr/sbin/cron -f\n" +
+		"root         688  0.0  0.3  12176  7052 ?        Ss   " + bootTime.Format("Jan02") + "   0:00 /usr/sbin/sshd -D\n" +
+		"root         702  0.0  0.1   8540  2988 ?        Ss   " + bootTime.Format("Jan02") + "   0:00 /usr/sbin/inetd\n" +
+		fmt.Sprintf("%-12s 2841  0.0  0.2  10040  5032 pts/0    Ss   %s   0:00 -bash\n", sh.User, time.Now().Format("15:04")) +
+		fmt.Sprintf("%-12s 2907  0.0  0.1  10612  3288 pts/0    R+   %s   0:00 ps %s\n", sh.User, time.Now().Format("15:04"), strings.Join(args[1:], " ")), 0
+}
+
+func pwd(sh *Shell, args []string, stdin string) (string, int) {
+	return sh.Cwd + "\n", 0
+}
+
+func rm(sh *Shell, args []string, stdin string) (string, int) {
+	letters, operands := flags(args)
+	var output strings.Builder
+	status := 0
+	for _, operand := range operands {
+		p := sh.abs(operand)
+		n := sh.FS.lookup(p)
+		if n == nil {
+			if !strings.Contains(letters, "f") {
+				output.WriteString("rm: cannot remove '" + operand + "': " + errNotFound.Error() + "\n")
+				status = 1
+			}
+			continue
+		}
+		if n.dir && !strings.ContainsAny(letters, "rR") {
+			output.WriteString("rm: cannot remove '" + operand + "': " + errIsDir.Error() + "\n")
+			status = 1
+			continue
+		}
+		sh.FS.remove(p)
+	}
+	return output.String(), status
+}
+
+func touch(sh *Shell, args []string, stdin string) (string, int) {
+	_, operands := flags(args)
+	var output strings.Builder
+	status := 0
+	for _, operand := range operands {
+		p := sh.abs(operand)
+		if n := sh.FS.lookup(p); n != nil {
+			n.modTime = time.Now()
+			continue
+		}
+		err := sh.FS.writeFile(p, sh.User, "", false)
+		if err != nil {
+			output.WriteString("touch: cannot touch '" + operand + "': " + err.Error() + "\n")
+			status = 1
+		}
+	}
+	return output.String(), status
+}
+
+func uname(sh *Shell, args []string, stdin string) (string, int) {
+	letters, _ := flags(args)
+	fields := map[byte]string{
+		's': "Linux",
+		'n': sh.Hostname,
+		'r': kernelRelease,
+		'v': "#166-Ubuntu SMP Tue Oct 10 09:30:29 UTC 2023",
+		'm': "x86_64",
+		'p': "x86_64",
+		'i': "x86_64",
+		'o': "GNU/Linux",
+	}
+	if len(letters) == 0 {
+		letters = "s"
+	}
+	if strings.Contains(letters, "a") {
+		letters = "snrvmpio"
+	}
+	var output []string
+	for _, c := range []byte("snrvmpio") {
+		if strings.IndexByte(letters, c) >= 0 {
+			output = append(output, fields[c])
+		}
+	}
+	return strings.Join(output, " ") + "\n", 0
+}
+
+// Uptime line shared by uptime and w
+func uptimeLine() string {
+	up := time.Since(bootTime)
+	days := int(up.Hours()) / 24
+	return fmt.Sprintf(" %s up %d days, %2d:%02d,  1 user,  load average: 0.08, 0.03, 0.01\n", time.Now().Format("15:04:05"), days, int(up.Hours())%24, int(up.Minutes())%60)
+}
+
+func uptime(sh *Shell, args []string, stdin string) (string, int) {
+	return uptimeLine(), 0
+}
+
+func w(sh *Shell, args []string, stdin string) (string, int) {
+	return uptimeLine() +
+		"USER     TTY      FROM             LOGIN@   IDLE   JCPU   PCPU WHAT\n" +
+		fmt.Sprintf("%-8s pts/0    -                %s    0.00s  0.01s  0.00s w\n", sh.User, time.Now().Format("15:04")), 0
+}
+
+func which(sh *Shell, args []string, stdin string) (string, int) {
+	var output strings.Builder
+	status := 0
+	for _, name := range args[1:] {
+		switch {
+		case sh.FS.lookup("/bin/"+name) != nil:
+			output.WriteString("/usr/bin/" + name + "\n")
+		case sh.FS.lookup("/usr/bin/"+name) != nil:
+			output.WriteString("/usr/bin/" + name + "\n")
+		default:
+			status = 1
+		}
+	}
+	return output.String(), status
+}
+
+func whoami(sh *Shell, args []string, stdin string) (string, int) {
+	return sh.User + "\n", 0
+}
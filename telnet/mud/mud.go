@@ -0,0 +1,210 @@
+package mud
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	cmd "telnet/command"
+	opt "telnet/option"
+)
+
+// MSDP markers
+const (
+	MSDP_VAR         byte = 1
+	MSDP_VAL         byte = 2
+	MSDP_TABLE_OPEN  byte = 3
+	MSDP_TABLE_CLOSE byte = 4
+	MSDP_ARRAY_OPEN  byte = 5
+	MSDP_ARRAY_CLOSE byte = 6
+)
+
+// GMCP message such as Char.Vitals {"hp": 10}
+type GMCP struct {
+	Package string
+	// JSON value, empty if the message has no data
+	Data json.RawMessage
+}
+
+// MSDP variables with string, []interface{} or map[string]interface{} values
+type MSDP map[string]interface{}
+
+// Receives out-of-band messages from the peer
+type Handler struct {
+	GMCP func(GMCP)
+	MSDP func(MSDP)
+}
+
+// Dispatches a GMCP or MSDP subnegotiation
+func (h *Handler) Handle(option byte, data []byte) {
+	if h == nil {
+		return
+	}
+	switch option {
+	case opt.GMCP:
+		if h.GMCP != nil {
+			h.GMCP(ParseGMCP(data))
+		}
+	case opt.MSDP:
+		if h.MSDP != nil {
+			h.MSDP(ParseMSDP(data))
+		}
+	}
+}
+
+func ParseGMCP(data []byte) GMCP {
+	i := bytes.IndexAny(data, " \t\r\n")
+	if i < 0 {
+		return GMCP{Package: string(data)}
+	}
+	return GMCP{Package: string(data[:i]), Data: json.RawMessage(bytes.TrimSpace(data[i+1:]))}
+}
+
+// Builds IAC SB GMCP package json IAC SE, omitting nil data
+func BuildGMCP(pkg string, data interface{}) ([]byte, error) {
+	message := []byte(pkg)
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		message = append(append(message, ' '), b...)
+	}
+	return build(opt.GMCP, message), nil
+}
+
+func ParseMSDP(data []byte) MSDP {
+	variables := MSDP{}
+	p := &msdpParser{data: data}
+	p.table(variables, false)
+	return variables
+}
+
+type msdpParser struct {
+	data []byte
+	pos  int
+}
+
+// Reads VAR name VAL value pairs until TABLE_CLOSE or end
+func (p *msdpParser) table(variables MSDP, nested bool) {
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case MSDP_TABLE_CLOSE:
+			p.pos++
+			if nested {
+				return
+			}
+		case MSDP_VAR:
+			p.pos++
+			name := p.text()
+			var values []interface{}
+			for p.pos < len(p.data) && p.data[p.pos] == MSDP_VAL {
+				p.pos++
+				values = append(values, p.value())
+			}
+			switch len(values) {
+			case 0:
+				variables[name] = ""
+			case 1:
+				variables[name] = values[0]
+			default:
+				// Several values of one variable form an array
+				variables[name] = values
+			}
+		default:
+			p.pos++
+		}
+	}
+}
+
+func (p *msdpParser) value() interface{} {
+	if p.pos >= len(p.data) {
+		return ""
+	}
+	switch p.data[p.pos] {
+	case MSDP_TABLE_OPEN:
+		p.pos++
+		table := MSDP{}
+		p.table(table, true)
+		return map[string]interface{}(table)
+	case MSDP_ARRAY_OPEN:
+		p.pos++
+		array := []interface{}{}
+		for p.pos < len(p.data) {
+			b := p.data[p.pos]
+			p.pos++
+			if b == MSDP_ARRAY_CLOSE {
+				break
+			} else if b == MSDP_VAL {
+				array = append(array, p.value())
+			}
+		}
+		return array
+	}
+	return p.text()
+}
+
+// Reads up to the next marker
+func (p *msdpParser) text() string {
+	start := p.pos
+	for p.pos < len(p.data) && p.data[p.pos] > MSDP_ARRAY_CLOSE {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// Builds IAC SB MSDP VAR name VAL value ... IAC SE with names in sorted order
+func BuildMSDP(variables MSDP) []byte {
+	buf := new(bytes.Buffer)
+	writeTable(buf, variables)
+	return build(opt.MSDP, buf.Bytes())
+}
+
+func writeTable(buf *bytes.Buffer, variables map[string]interface{}) {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf.WriteByte(MSDP_VAR)
+		buf.WriteString(name)
+		buf.WriteByte(MSDP_VAL)
+		writeValue(buf, variables[name])
+	}
+}
+
+func writeValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case MSDP:
+		writeValue(buf, map[string]interface{}(v))
+	case map[string]interface{}:
+		buf.WriteByte(MSDP_TABLE_OPEN)
+		writeTable(buf, v)
+		buf.WriteByte(MSDP_TABLE_CLOSE)
+	case []interface{}:
+		buf.WriteByte(MSDP_ARRAY_OPEN)
+		for _, item := range v {
+			buf.WriteByte(MSDP_VAL)
+			writeValue(buf, item)
+		}
+		buf.WriteByte(MSDP_ARRAY_CLOSE)
+	case []string:
+		buf.WriteByte(MSDP_ARRAY_OPEN)
+		for _, item := range v {
+			buf.WriteByte(MSDP_VAL)
+			buf.WriteString(item)
+		}
+		buf.WriteByte(MSDP_ARRAY_CLOSE)
+	case nil:
+	default:
+		fmt.Fprint(buf, v)
+	}
+}
+
+func build(option byte, message []byte) []byte {
+	buf := bytes.NewBuffer([]byte{cmd.IAC, cmd.SB, option})
+	buf.Write(cmd.Escape(message))
+	buf.Write([]byte{cmd.IAC, cmd.SE})
+	return buf.Bytes()
+}
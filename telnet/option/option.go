@@ -1,9 +1,68 @@
 package option
 
+import (
+	"strconv"
+	"strings"
+)
+
 const (
+	BINARY                      byte = 0
 	ECHO                        byte = 1
 	SUPPRESS_GO_AHEAD           byte = 3
+	TIMING_MARK                 byte = 6
 	TERMINAL_TYPE               byte = 24
+	END_OF_RECORD               byte = 25
 	NEGOTIATE_ABOUT_WINDOW_SIZE byte = 31
 	TERMINAL_SPEED              byte = 32
+	LFLOW                       byte = 33
+	LINEMODE                    byte = 34
+	CHARSET                     byte = 42
+	COM_PORT_OPTION             byte = 44
+	TN3270E                     byte = 40
+	START_TLS                   byte = 46
+	MSDP                        byte = 69
+	MCCP2                       byte = 86
+	GMCP                        byte = 201
 )
+
+var names = map[byte]string{
+	BINARY:                      "BINARY",
+	ECHO:                        "ECHO",
+	SUPPRESS_GO_AHEAD:           "SGA",
+	TIMING_MARK:                 "TM",
+	TERMINAL_TYPE:               "TTYPE",
+	END_OF_RECORD:               "EOR",
+	NEGOTIATE_ABOUT_WINDOW_SIZE: "NAWS",
+	TERMINAL_SPEED:              "TSPEED",
+	LFLOW:                       "LFLOW",
+	LINEMODE:                    "LINEMODE",
+	CHARSET:                     "CHARSET",
+	COM_PORT_OPTION:             "COM-PORT",
+	TN3270E:                     "TN3270E",
+	START_TLS:                   "START-TLS",
+	MSDP:                        "MSDP",
+	MCCP2:                       "MCCP2",
+	GMCP:                        "GMCP",
+}
+
+func Name(option byte) string {
+	name, ok := names[option]
+	if !ok {
+		return strconv.Itoa(int(option))
+	}
+	return name
+}
+
+// Returns option by name or number
+func Parse(name string) (byte, bool) {
+	for option, v := range names {
+		if strings.EqualFold(name, v) {
+			return option, true
+		}
+	}
+	option, err := strconv.Atoi(name)
+	if err != nil || option < 0 || option > 255 {
+		return 0, false
+	}
+	return byte(option), true
+}
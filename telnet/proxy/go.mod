@@ -0,0 +1,5 @@
+module telnet/proxy
+
+go 1.18
+
+require golang.org/x/net v0.0.0-20220722155237-a158d28d115b
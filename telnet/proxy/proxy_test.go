@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Greeting written by the target before echoing input
+const greeting = "hello\r\n"
+
+// Starts a target that sends the greeting and echoes input
+func listenTarget(t *testing.T) string {
+	return listen(t, func(conn net.Conn) {
+		conn.Write([]byte(greeting))
+		io.Copy(conn, conn)
+	})
+}
+
+// Serves each connection with handle until the test ends
+func listen(t *testing.T, handle func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// Relays both ways between the client and a dialed target
+func relay(client net.Conn, target net.Conn) {
+	defer target.Close()
+	go io.Copy(target, client)
+	io.Copy(client, target)
+}
+
+// SOCKS5 stand-in requiring username and password (RFC 1928, RFC 1929)
+func serveSOCKS5(conn net.Conn, username string, password string) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return
+	}
+	if !strings.ContainsRune(string(methods), 2) {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	// Username and password
+	version, _ := reader.ReadByte()
+	user := readString(reader)
+	pass := readString(reader)
+	if version != 1 || user != username || pass != password {
+		conn.Write([]byte{1, 1})
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// CONNECT request
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(reader, ip)
+		host = net.IP(ip).String()
+	case 3:
+		host = readString(reader)
+	default:
+		conn.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	port := make([]byte, 2)
+	io.ReadFull(reader, port)
+	target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	relay(conn, target)
+}
+
+// Reads a string prefixed by its length byte
+func readString(reader *bufio.Reader) string {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return ""
+	}
+	b := make([]byte, length)
+	io.ReadFull(reader, b)
+	return string(b)
+}
+
+// HTTP CONNECT stand-in requiring basic authorization, writing the response
+// and the target's first bytes together
+func serveConnect(conn net.Conn, username string, password string) {
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	credential := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	if req.Header.Get("Proxy-Authorization") != "Basic "+credential {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	first := make([]byte, len(greeting))
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(target, first); err != nil {
+		target.Close()
+		return
+	}
+	target.SetReadDeadline(time.Time{})
+	conn.Write(append([]byte("HTTP/1.1 200 Connection established\r\n\r\n"), first...))
+	relay(conn, target)
+}
+
+// Dials the target through rawURL and checks the greeting and an echo
+func checkDial(t *testing.T, rawURL string, target string) {
+	dialer, err := New(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil || line != greeting {
+		t.Fatalf("greeting %q, %v", line, err)
+	}
+	_, err = io.WriteString(conn, "ping\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err = reader.ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("echo %q, %v", line, err)
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	target := listenTarget(t)
+	proxyAddr := listen(t, func(conn net.Conn) {
+		serveSOCKS5(conn, "user", "pass")
+	})
+	checkDial(t, "socks5://user:pass@"+proxyAddr, target)
+
+	dialer, err := New("socks5://user:wrong@" + proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := dialer.Dial("tcp", target); err == nil {
+		conn.Close()
+		t.Error("dial succeeded with a wrong password")
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	target := listenTarget(t)
+	proxyAddr := listen(t, func(conn net.Conn) {
+		serveConnect(conn, "user", "pass")
+	})
+	checkDial(t, "http://user:pass@"+proxyAddr, target)
+
+	dialer, err := New("http://user:wrong@" + proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", target)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dial succeeded with a wrong password")
+	}
+	if !strings.Contains(err.Error(), "407") {
+		t.Errorf("error %q, want 407 status", err)
+	}
+}
@@ -0,0 +1,3 @@
+module telnet/record
+
+go 1.18
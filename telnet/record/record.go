@@ -0,0 +1,188 @@
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Writes terminal session in asciicast v2 format
+type Recorder struct {
+	file    *os.File
+	start   time.Time
+	started bool
+	// Incomplete UTF-8 sequence at the end of last data for each event type
+	pending map[string][]byte
+	mu      sync.Mutex
+}
+
+type header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+func New(path string) (*Recorder, error) {
+	// Recordings may hold anything shown on screen
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := new(Recorder)
+	r.file = file
+	r.pending = map[string][]byte{}
+	return r, nil
+}
+
+// Writes header, events before Start are dropped
+func (r *Recorder) Start(width int, height int, terminalType string) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started {
+		return nil
+	}
+	r.start = time.Now()
+	r.started = true
+	h := header{
+		Version:   2,
+		Width:     width,
+		Height:    height,
+		Timestamp: r.start.Unix(),
+		Env:       map[string]string{"TERM": terminalType},
+	}
+	return r.writeLine(h)
+}
+
+func (r *Recorder) Output(b []byte) error {
+	return r.event("o", b)
+}
+
+func (r *Recorder) Input(b []byte) error {
+	return r.event("i", b)
+}
+
+func (r *Recorder) Resize(width int, height int) error {
+	return r.event("r", []byte(fmt.Sprintf("%dx%d", width, height)))
+}
+
+func (r *Recorder) event(eventType string, b []byte) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.started {
+		return nil
+	}
+	// Keep multibyte character split across reads for next event
+	data := append(r.pending[eventType], b...)
+	end := validEnd(data)
+	r.pending[eventType] = append([]byte(nil), data[end:]...)
+	if end == 0 {
+		return nil
+	}
+	return r.writeLine([]interface{}{time.Since(r.start).Seconds(), eventType, string(data[:end])})
+}
+
+func (r *Recorder) writeLine(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// Returns length of data without trailing incomplete UTF-8 sequence
+func validEnd(data []byte) int {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(data[i]) {
+			continue
+		}
+		if !utf8.FullRune(data[i:]) {
+			return i
+		}
+		break
+	}
+	return len(data)
+}
+
+// Plays recording to stdout, speed 2 means twice as fast
+func Replay(path string, speed float64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if speed <= 0 {
+		return fmt.Errorf("invalid speed %v", speed)
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+		return io.ErrUnexpectedEOF
+	}
+	var h header
+	err = json.Unmarshal(scanner.Bytes(), &h)
+	if err != nil {
+		return err
+	}
+	if h.Version != 2 {
+		return fmt.Errorf("unsupported asciicast version %d", h.Version)
+	}
+	// Resize terminal (xterm window manipulation)
+	fmt.Printf("\x1b[8;%d;%dt", h.Height, h.Width)
+
+	start := time.Now()
+	for scanner.Scan() {
+		var event []interface{}
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			return err
+		}
+		if len(event) != 3 {
+			return fmt.Errorf("invalid event %s", scanner.Text())
+		}
+		offset, ok1 := event[0].(float64)
+		eventType, ok2 := event[1].(string)
+		data, ok3 := event[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return fmt.Errorf("invalid event %s", scanner.Text())
+		}
+		time.Sleep(time.Until(start.Add(time.Duration(offset / speed * float64(time.Second)))))
+		switch eventType {
+		case "o":
+			fmt.Print(data)
+		case "r":
+			var width, height int
+			_, err = fmt.Sscanf(data, "%dx%d", &width, &height)
+			if err == nil {
+				fmt.Printf("\x1b[8;%d;%dt", height, width)
+			}
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,417 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"telnet/client"
+	cmd "telnet/command"
+	"telnet/connection"
+	opt "telnet/option"
+	"telnet/server"
+	"telnet/terminal"
+)
+
+type Config struct {
+	// Upstream TELNET server (host:port)
+	Upstream string
+	// Forward negotiation unchanged instead of negotiating with each side
+	Passthrough bool
+	Rules       []Rule
+}
+
+// Rewrites WILL/DO of an option sent from a side
+type Rule struct {
+	// "client" or "upstream"
+	From   string
+	Option byte
+	// "refuse" answers with WONT/DONT, "drop" discards the command
+	Action string
+}
+
+type Relay struct {
+	ID       int
+	Config   Config
+	Client   *connection.Connection
+	Upstream *connection.Connection
+}
+
+// Direction markers for logging (C: client, U: upstream, P: proxy)
+const (
+	fromClient   = "C>P"
+	toClient     = "P>C"
+	fromUpstream = "U>P"
+	toUpstream   = "P>U"
+)
+
+// Parses comma separated rules such as "upstream:LINEMODE=refuse"
+func ParseRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if len(field) == 0 {
+			continue
+		}
+		var rule Rule
+		sideOption, action, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule %q", field)
+		}
+		from, optionName, ok := strings.Cut(sideOption, ":")
+		if !ok || (from != "client" && from != "upstream") {
+			return nil, fmt.Errorf("invalid rule %q", field)
+		}
+		rule.From = from
+		rule.Option, ok = opt.Parse(optionName)
+		if !ok {
+			return nil, fmt.Errorf("unknown option %q", optionName)
+		}
+		if action != "refuse" && action != "drop" {
+			return nil, fmt.Errorf("unknown action %q", action)
+		}
+		rule.Action = action
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func New(id int, config Config) *Relay {
+	r := new(Relay)
+	r.ID = id
+	r.Config = config
+	// Terminal info learned from client is reported to upstream
+	t := terminal.New()
+	t.Type = "vt100"
+
+	r.Client = new(connection.Connection)
+	r.Client.IsServer = true
+	r.Client.SupportOptions = []byte{opt.ECHO, opt.SUPPRESS_GO_AHEAD, opt.TERMINAL_TYPE, opt.NEGOTIATE_ABOUT_WINDOW_SIZE, opt.TERMINAL_SPEED}
+	r.Client.EnableOptions = map[byte]bool{}
+	r.Client.Terminal = t
+	r.Client.BuildCmdRes = r.buildCmdRes("client", server.BuildCmdRes)
+	r.Client.OnCommand = func(command []byte) {
+		r.log(fromClient, command)
+	}
+
+	r.Upstream = new(connection.Connection)
+	r.Upstream.SupportOptions = []byte{opt.ECHO, opt.NEGOTIATE_ABOUT_WINDOW_SIZE, opt.TERMINAL_SPEED, opt.TERMINAL_TYPE, opt.SUPPRESS_GO_AHEAD}
+	r.Upstream.EnableOptions = map[byte]bool{}
+	r.Upstream.Terminal = t
+	r.Upstream.BuildCmdRes = r.buildCmdRes("upstream", client.BuildCmdRes)
+	r.Upstream.OnCommand = func(command []byte) {
+		r.log(fromUpstream, command)
+	}
+	return r
+}
+
+func (r *Relay) Handle() {
+	defer r.Client.Conn.Close()
+	log.Printf("Relay %d: Client Connected from %s", r.ID, r.Client.Conn.RemoteAddr())
+
+	// Dial upstream
+	host, port, err := net.SplitHostPort(r.Config.Upstream)
+	if err != nil {
+		log.Printf("Relay %d: Error: %s", r.ID, err)
+		return
+	}
+	r.Upstream.IP = host
+	r.Upstream.Port, err = strconv.Atoi(port)
+	if err != nil {
+		log.Printf("Relay %d: Error: %s", r.ID, err)
+		return
+	}
+	err = r.Upstream.Dial()
+	if err != nil {
+		log.Printf("Relay %d: Error: %s", r.ID, err)
+		return
+	}
+	defer r.Upstream.Conn.Close()
+	log.Printf("Relay %d: Connected to %s", r.ID, r.Config.Upstream)
+
+	// Negotiate with each side
+	if !r.Config.Passthrough {
+		err = r.request(r.Client, toClient)
+		if err == nil {
+			err = r.request(r.Upstream, toUpstream)
+		}
+		if err != nil {
+			log.Printf("Relay %d: Error: %s", r.ID, err)
+			return
+		}
+	}
+
+	// Relay data until either side closes
+	pipe := r.pipe
+	if r.Config.Passthrough {
+		pipe = r.passthrough
+	}
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- pipe(r.Client, r.Upstream)
+	}()
+	go func() {
+		errChan <- pipe(r.Upstream, r.Client)
+	}()
+	err = <-errChan
+	r.Client.Conn.Close()
+	r.Upstream.Conn.Close()
+	<-errChan
+	if err != nil && err != io.EOF && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Relay %d: Error: %s", r.ID, err)
+	}
+	log.Printf("Relay %d: Closed", r.ID)
+}
+
+func (r *Relay) request(c *connection.Connection, marker string) error {
+	r.log(marker, c.BuildReqCmds(c.SupportOptions))
+	return c.ReqCmds(c.SupportOptions)
+}
+
+func (r *Relay) pipe(from *connection.Connection, to *connection.Connection) error {
+	for {
+		byteMessage, err := from.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if len(byteMessage) == 0 {
+			continue
+		}
+		err = to.WriteBytes(cmd.Escape(byteMessage))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Forwards bytes in their original order, only rules change the stream
+func (r *Relay) passthrough(from *connection.Connection, to *connection.Connection) error {
+	side, fromMarker, forwardMarker := "client", fromClient, toUpstream
+	if from == r.Upstream {
+		side, fromMarker, forwardMarker = "upstream", fromUpstream, toClient
+	}
+	var pending []byte
+	raw := false
+	for {
+		byteMessage, err := from.ReadAll()
+		if len(byteMessage) > 0 && raw {
+			if err := to.WriteBytes(byteMessage); err != nil {
+				return err
+			}
+		} else if len(byteMessage) > 0 {
+			byteMessage = append(pending, byteMessage...)
+			bufForward := new(bytes.Buffer)
+			bufReply := new(bytes.Buffer)
+			i := 0
+			for i < len(byteMessage) {
+				if byteMessage[i] != cmd.IAC {
+					bufForward.WriteByte(byteMessage[i])
+					i++
+					continue
+				}
+				n := cmd.Length(byteMessage[i:])
+				if n == 0 {
+					break
+				}
+				byteCmd := byteMessage[i : i+n]
+				i += n
+				if byteCmd[1] == cmd.IAC {
+					bufForward.Write(byteCmd)
+					continue
+				}
+				r.log(fromMarker, byteCmd)
+				if byteCmdRes, ok := r.applyRule(side, byteCmd); ok {
+					bufReply.Write(byteCmdRes)
+					continue
+				}
+				r.log(forwardMarker, byteCmd)
+				bufForward.Write(byteCmd)
+				// Following bytes are compressed or TLS records
+				if byteCmd[1] == cmd.SB && (byteCmd[2] == opt.MCCP2 || (byteCmd[2] == opt.START_TLS && n > 5 && byteCmd[3] == startTLSFollows)) {
+					raw = true
+					bufForward.Write(byteMessage[i:])
+					i = len(byteMessage)
+				}
+			}
+			// Incomplete command is completed by the next read
+			pending = append([]byte{}, byteMessage[i:]...)
+			if len(pending) > maxPending {
+				bufForward.Write(pending)
+				pending = nil
+			}
+			if bufReply.Len() > 0 {
+				if err := from.WriteBytes(bufReply.Bytes()); err != nil {
+					return err
+				}
+			}
+			if bufForward.Len() > 0 {
+				if err := to.WriteBytes(bufForward.Bytes()); err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// START_TLS FOLLOWS before the TLS handshake
+const startTLSFollows = 1
+
+// Bytes held for a subnegotiation without IAC SE before forwarding as is
+const maxPending = 64 * 1024
+
+// Answers or drops WILL/DO from a side by the first matching rule
+func (r *Relay) applyRule(from string, byteCmd []byte) ([]byte, bool) {
+	mainCmd := byteCmd[1]
+	if mainCmd != cmd.WILL && mainCmd != cmd.DO {
+		return nil, false
+	}
+	subCmd := byteCmd[2]
+	replyMarker := toClient
+	if from == "upstream" {
+		replyMarker = toUpstream
+	}
+	for _, rule := range r.Config.Rules {
+		if rule.From != from || rule.Option != subCmd {
+			continue
+		}
+		r.logf("rule %s:%s=%s", rule.From, opt.Name(rule.Option), rule.Action)
+		if rule.Action == "drop" {
+			return nil, true
+		}
+		byteCmdRes := []byte{cmd.IAC, cmd.DONT, subCmd}
+		if mainCmd == cmd.DO {
+			byteCmdRes[1] = cmd.WONT
+		}
+		r.log(replyMarker, byteCmdRes)
+		return byteCmdRes, true
+	}
+	return nil, false
+}
+
+type buildCmdResFunc func(c connection.Connection, mainCmd byte, subCmd byte, options ...byte) ([]byte, error)
+
+// Forwards, rewrites or answers commands from a side, logged by OnCommand
+func (r *Relay) buildCmdRes(from string, local buildCmdResFunc) buildCmdResFunc {
+	replyMarker, forwardMarker := toClient, toUpstream
+	if from == "upstream" {
+		replyMarker, forwardMarker = toUpstream, toClient
+	}
+	return func(c connection.Connection, mainCmd byte, subCmd byte, options ...byte) ([]byte, error) {
+		// End of subnegotiation is handled with SB
+		if mainCmd == cmd.SE {
+			return nil, nil
+		}
+		byteCmd := encode(mainCmd, subCmd, options...)
+		other := r.Upstream
+		if from == "upstream" {
+			other = r.Client
+		}
+
+		// Commands such as IP, AYT, BRK and AO are for the other side, sent at
+		// once like urgent data, ahead of data read with them
+		if !cmd.IsNeedOption(mainCmd) && mainCmd != cmd.SB {
+			r.log(forwardMarker, byteCmd)
+			return nil, other.WriteBytes(byteCmd)
+		}
+
+		// Rewrite rules
+		if byteCmdRes, ok := r.applyRule(from, byteCmd); ok {
+			return byteCmdRes, nil
+		}
+
+		// Negotiate locally
+		byteCmdRes, err := local(c, mainCmd, subCmd, options...)
+		if err != nil {
+			return nil, err
+		}
+		r.log(replyMarker, byteCmdRes)
+		// Report new window size of client to upstream
+		if from == "client" && mainCmd == cmd.SB && subCmd == opt.NEGOTIATE_ABOUT_WINDOW_SIZE && other.EnableOptions[subCmd] {
+			height, width, _ := c.Terminal.GetSize()
+			byteNAWS := client.BuildNAWS(width, height)
+			r.log(forwardMarker, byteNAWS)
+			err = other.WriteBytes(byteNAWS)
+		}
+		return byteCmdRes, err
+	}
+}
+
+func (r *Relay) log(marker string, byteCmds []byte) {
+	for _, s := range describe(byteCmds) {
+		r.logf("%s %s", marker, s)
+	}
+}
+
+func (r *Relay) logf(format string, v ...interface{}) {
+	log.Printf("Relay %d: "+format, append([]interface{}{r.ID}, v...)...)
+}
+
+// Builds raw bytes of a command
+func encode(mainCmd byte, subCmd byte, options ...byte) []byte {
+	switch {
+	case mainCmd == cmd.SB:
+		bufCmd := bytes.NewBuffer([]byte{cmd.IAC, cmd.SB, subCmd})
+		bufCmd.Write(cmd.Escape(options))
+		bufCmd.Write([]byte{cmd.IAC, cmd.SE})
+		return bufCmd.Bytes()
+	case cmd.IsNeedOption(mainCmd):
+		return []byte{cmd.IAC, mainCmd, subCmd}
+	}
+	return []byte{cmd.IAC, mainCmd}
+}
+
+// Returns readable form of each command in bytes
+func describe(byteCmds []byte) []string {
+	var descriptions []string
+	for i := 0; i < len(byteCmds); i++ {
+		if byteCmds[i] != cmd.IAC || i+1 >= len(byteCmds) {
+			continue
+		}
+		i++
+		mainCmd := byteCmds[i]
+		switch {
+		case mainCmd == cmd.SB && i+1 < len(byteCmds):
+			subCmd := byteCmds[i+1]
+			end := bytes.Index(byteCmds[i+2:], []byte{cmd.IAC, cmd.SE})
+			if end < 0 {
+				end = len(byteCmds) - i - 2
+			}
+			options := cmd.Unescape(byteCmds[i+2 : i+2+end])
+			descriptions = append(descriptions, fmt.Sprintf("SB %s %q SE", opt.Name(subCmd), options))
+			i += end + 3
+		case cmd.IsNeedOption(mainCmd) && i+1 < len(byteCmds):
+			i++
+			descriptions = append(descriptions, cmd.Name(mainCmd)+" "+opt.Name(byteCmds[i]))
+		default:
+			descriptions = append(descriptions, cmd.Name(mainCmd))
+		}
+	}
+	return descriptions
+}
+
+func Run(ip string, port int, config Config) {
+	// Listen TCP
+	ln, err := net.Listen("tcp", ip+":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatal("Error:", err)
+	}
+	defer ln.Close()
+	fmt.Printf("Relay %s:%d to %s...\n", ip, port, config.Upstream)
+
+	for id := 1; ; id++ {
+		r := New(id, config)
+		err := r.Client.Accept(ln)
+		if err != nil {
+			log.Println("Error:", err)
+			continue
+		}
+		go r.Handle()
+	}
+}
@@ -0,0 +1,13 @@
+module telnet/scan
+
+go 1.18
+
+replace (
+	telnet/command => ../command
+	telnet/option => ../option
+)
+
+require (
+	telnet/command v0.0.0-00010101000000-000000000000
+	telnet/option v0.0.0-00010101000000-000000000000
+)
@@ -0,0 +1,353 @@
+package scan
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	cmd "telnet/command"
+	opt "telnet/option"
+	"time"
+)
+
+// Built-in sample of banner signatures; fingerprints for real use come from a
+// user-supplied file given as SignatureFile
+//
+//go:embed signatures.json
+var defaultSignatures []byte
+
+type Config struct {
+	Ports []int
+	// Concurrent connections
+	Parallel int
+	// Deadline for each target including banner
+	Timeout time.Duration
+	// User-supplied JSON signature file (empty for built-in sample)
+	SignatureFile string
+	// Largest number of addresses accepted in one CIDR range
+	MaxHosts int
+}
+
+// Fingerprint matched when all given patterns match
+type Signature struct {
+	Name        string `json:"name"`
+	Negotiation string `json:"negotiation,omitempty"`
+	Banner      string `json:"banner,omitempty"`
+	negotiation *regexp.Regexp
+	banner      *regexp.Regexp
+}
+
+type Result struct {
+	Host        string    `json:"host"`
+	Port        int       `json:"port"`
+	Time        time.Time `json:"time"`
+	Open        bool      `json:"open"`
+	Error       string    `json:"error,omitempty"`
+	Negotiation []string  `json:"negotiation,omitempty"`
+	Banner      string    `json:"banner,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+}
+
+// Silence after banner data that ends reading
+const bannerIdle = time.Second
+
+// Limit of banner bytes kept
+const maxBanner = 4096
+
+// Host limit of a CIDR range when none is configured
+const defaultMaxHosts = 65536
+
+func LoadSignatures(path string) ([]Signature, error) {
+	data := defaultSignatures
+	if len(path) > 0 {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var signatures []Signature
+	err := json.Unmarshal(data, &signatures)
+	if err != nil {
+		return nil, err
+	}
+	for i := range signatures {
+		s := &signatures[i]
+		if len(s.Negotiation) > 0 {
+			if s.negotiation, err = regexp.Compile(s.Negotiation); err != nil {
+				return nil, fmt.Errorf("signature %q: %w", s.Name, err)
+			}
+		}
+		if len(s.Banner) > 0 {
+			if s.banner, err = regexp.Compile(s.Banner); err != nil {
+				return nil, fmt.Errorf("signature %q: %w", s.Name, err)
+			}
+		}
+	}
+	return signatures, nil
+}
+
+// Returns name of first signature matching negotiation and banner
+func Match(signatures []Signature, negotiation []string, banner string) string {
+	sequence := strings.Join(negotiation, ", ")
+	for _, s := range signatures {
+		if s.negotiation == nil && s.banner == nil {
+			continue
+		}
+		if s.negotiation != nil && !s.negotiation.MatchString(sequence) {
+			continue
+		}
+		if s.banner != nil && !s.banner.MatchString(banner) {
+			continue
+		}
+		return s.Name
+	}
+	return ""
+}
+
+// Expands hosts, IP addresses and CIDR ranges
+func expand(target string, maxHosts int, hosts chan<- string) error {
+	if !strings.Contains(target, "/") {
+		hosts <- target
+		return nil
+	}
+	ip, ipNet, err := net.ParseCIDR(target)
+	if err != nil {
+		return err
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones >= 31 || 1<<(bits-ones) > maxHosts {
+		return fmt.Errorf("range has more than %d hosts", maxHosts)
+	}
+	for ip := ip.Mask(ipNet.Mask); ipNet.Contains(ip); ip = next(ip) {
+		hosts <- ip.String()
+	}
+	return nil
+}
+
+func next(ip net.IP) net.IP {
+	ip = append(net.IP(nil), ip...)
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			break
+		}
+	}
+	return ip
+}
+
+// Scans targets and writes results to w as JSON lines
+func Run(targets []string, config Config, w io.Writer) error {
+	signatures, err := LoadSignatures(config.SignatureFile)
+	if err != nil {
+		return err
+	}
+	if config.Parallel < 1 {
+		config.Parallel = 1
+	}
+	if config.MaxHosts < 1 {
+		config.MaxHosts = defaultMaxHosts
+	}
+
+	hosts := make(chan string)
+	expandErr := make(chan error, 1)
+	go func() {
+		defer close(hosts)
+		for _, target := range targets {
+			err := expand(target, config.MaxHosts, hosts)
+			if err != nil {
+				expandErr <- fmt.Errorf("target %s: %w", target, err)
+				return
+			}
+		}
+	}()
+
+	type job struct {
+		host string
+		port int
+	}
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		for host := range hosts {
+			for _, port := range config.Ports {
+				jobs <- job{host, port}
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	encoder := json.NewEncoder(w)
+	for i := 0; i < config.Parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				result := Probe(j.host, j.port, config.Timeout)
+				result.Fingerprint = Match(signatures, result.Negotiation, result.Banner)
+				mu.Lock()
+				encoder.Encode(result)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-expandErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// Connects to one target, refusing every option to reach the login banner
+func Probe(host string, port int, timeout time.Duration) Result {
+	result := Result{Host: host, Port: port, Time: time.Now()}
+	deadline := time.Now().Add(timeout)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	result.Open = true
+
+	p := parser{}
+	reader := bufio.NewReader(conn)
+	buf := make([]byte, 1024)
+	for {
+		readDeadline := deadline
+		if p.banner.Len() > 0 && time.Now().Add(bannerIdle).Before(deadline) {
+			readDeadline = time.Now().Add(bannerIdle)
+		}
+		conn.SetReadDeadline(readDeadline)
+		n, err := reader.Read(buf)
+		reply := p.feed(buf[:n])
+		if len(reply) > 0 {
+			conn.SetWriteDeadline(deadline)
+			conn.Write(reply)
+			p.replied = true
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); !(ok && netErr.Timeout()) && err != io.EOF {
+				result.Error = err.Error()
+			}
+			break
+		}
+		if p.banner.Len() >= maxBanner {
+			break
+		}
+	}
+	result.Negotiation = p.negotiation
+	result.Banner = strings.TrimSpace(p.banner.String())
+	return result
+}
+
+// Splits server output into commands and banner text
+type parser struct {
+	// Commands sent before our first reply
+	negotiation []string
+	replied     bool
+	banner      strings.Builder
+	state       int
+	command     byte
+	sb          []byte
+}
+
+const (
+	stateData = iota
+	stateIAC
+	stateOption
+	stateSB
+	stateSBIAC
+)
+
+func (p *parser) feed(b []byte) []byte {
+	var reply []byte
+	for _, c := range b {
+		switch p.state {
+		case stateData:
+			switch {
+			case c == cmd.IAC:
+				p.state = stateIAC
+			case c == '\r' || c == 0:
+			case c == '\n' || c == '\t' || c >= 0x20:
+				if p.banner.Len() < maxBanner {
+					p.banner.WriteByte(c)
+				}
+			}
+		case stateIAC:
+			switch {
+			case c == cmd.IAC:
+				p.banner.WriteByte(c)
+				p.state = stateData
+			case c == cmd.SB:
+				p.sb = p.sb[:0]
+				p.state = stateSB
+			case cmd.IsNeedOption(c):
+				p.command = c
+				p.state = stateOption
+			default:
+				p.record(cmd.Name(c))
+				p.state = stateData
+			}
+		case stateOption:
+			p.record(cmd.Name(p.command) + " " + opt.Name(c))
+			switch p.command {
+			case cmd.DO:
+				reply = append(reply, cmd.IAC, cmd.WONT, c)
+			case cmd.WILL:
+				reply = append(reply, cmd.IAC, cmd.DONT, c)
+			}
+			p.state = stateData
+		case stateSB:
+			if c == cmd.IAC {
+				p.state = stateSBIAC
+			} else {
+				p.sb = append(p.sb, c)
+			}
+		case stateSBIAC:
+			switch c {
+			case cmd.SE:
+				p.record(describeSB(p.sb))
+				p.state = stateData
+			case cmd.IAC:
+				p.sb = append(p.sb, c)
+				p.state = stateSB
+			default:
+				p.state = stateData
+			}
+		}
+	}
+	return reply
+}
+
+func (p *parser) record(command string) {
+	if !p.replied {
+		p.negotiation = append(p.negotiation, command)
+	}
+}
+
+func describeSB(sb []byte) string {
+	if len(sb) == 0 {
+		return "SB"
+	}
+	s := "SB " + opt.Name(sb[0])
+	if len(sb) >= 2 {
+		s += " " + strconv.Itoa(int(sb[1]))
+	}
+	if sb[0] == opt.NEGOTIATE_ABOUT_WINDOW_SIZE && len(sb) == 5 {
+		s = fmt.Sprintf("SB NAWS %dx%d", binary.BigEndian.Uint16(sb[1:3]), binary.BigEndian.Uint16(sb[3:5]))
+	}
+	return s
+}
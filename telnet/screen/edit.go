@@ -0,0 +1,223 @@
+package screen
+
+// DEC Special Graphics used for line drawing
+var lineDrawing = map[rune]rune{
+	'`': '◆', 'a': '▒', 'f': '°', 'g': '±', 'j': '┘', 'k': '┐', 'l': '┌', 'm': '└',
+	'n': '┼', 'o': '⎺', 'p': '⎻', 'q': '─', 'r': '⎼', 's': '⎽', 't': '├', 'u': '┤',
+	'v': '┴', 'w': '┬', 'x': '│', 'y': '≤', 'z': '≥', '{': 'π', '|': '≠', '}': '£',
+	'~': '·',
+}
+
+func (s *Screen) print(r rune) {
+	if s.charsets[s.shift] == '0' {
+		if graphic, ok := lineDrawing[r]; ok {
+			r = graphic
+		}
+	}
+	if s.wrapNext && s.autowrap {
+		s.cursor.x = 0
+		s.lineFeed()
+	}
+	s.wrapNext = false
+	if s.insert {
+		s.insertCells(1)
+	}
+	s.lines[s.cursor.y][s.cursor.x] = Cell{Rune: r, Attr: s.cursor.attr}
+	s.lastRune = r
+	if s.cursor.x == s.width-1 {
+		s.wrapNext = true
+	} else {
+		s.cursor.x++
+	}
+}
+
+func (s *Screen) moveTo(x int, y int) {
+	s.cursor.x = clamp(x, 0, s.width-1)
+	s.cursor.y = clamp(y, 0, s.height-1)
+	s.wrapNext = false
+}
+
+// Moves relative to the scrolling region in origin mode
+func (s *Screen) moveOrigin(x int, y int) {
+	if s.cursor.origin {
+		s.moveTo(x, clamp(y+s.top, s.top, s.bottom))
+		return
+	}
+	s.moveTo(x, y)
+}
+
+// Moves n tab stops forward, or backward when negative
+func (s *Screen) tab(n int) {
+	x := s.cursor.x
+	for ; n > 0 && x < s.width-1; n-- {
+		x = (x/8 + 1) * 8
+	}
+	for ; n < 0 && x > 0; n++ {
+		x = (x - 1) / 8 * 8
+	}
+	s.moveTo(x, s.cursor.y)
+}
+
+func (s *Screen) lineFeed() {
+	if s.cursor.y == s.bottom {
+		s.scrollUp(s.top, 1)
+	} else if s.cursor.y < s.height-1 {
+		s.cursor.y++
+	}
+	s.wrapNext = false
+}
+
+func (s *Screen) reverseIndex() {
+	if s.cursor.y == s.top {
+		s.scrollDown(s.top, 1)
+	} else if s.cursor.y > 0 {
+		s.cursor.y--
+	}
+	s.wrapNext = false
+}
+
+// Scrolls lines from top of the region up by n
+func (s *Screen) scrollUp(top int, n int) {
+	n = clamp(n, 0, s.bottom-top+1)
+	copy(s.lines[top:s.bottom+1], s.lines[top+n:s.bottom+1])
+	for y := s.bottom - n + 1; y <= s.bottom; y++ {
+		s.lines[y] = s.blankLine()
+	}
+}
+
+// Scrolls lines from top of the region down by n
+func (s *Screen) scrollDown(top int, n int) {
+	n = clamp(n, 0, s.bottom-top+1)
+	copy(s.lines[top+n:s.bottom+1], s.lines[top:s.bottom+1-n])
+	for y := top; y < top+n; y++ {
+		s.lines[y] = s.blankLine()
+	}
+}
+
+func (s *Screen) insertLines(n int) {
+	if s.cursor.y < s.top || s.cursor.y > s.bottom {
+		return
+	}
+	s.scrollDown(s.cursor.y, n)
+	s.moveTo(0, s.cursor.y)
+}
+
+func (s *Screen) deleteLines(n int) {
+	if s.cursor.y < s.top || s.cursor.y > s.bottom {
+		return
+	}
+	s.scrollUp(s.cursor.y, n)
+	s.moveTo(0, s.cursor.y)
+}
+
+// Erases cells from x0 to x1 of line y
+func (s *Screen) erase(y int, x0 int, x1 int) {
+	blank := s.blank()
+	line := s.lines[y]
+	for x := clamp(x0, 0, s.width); x < clamp(x1, 0, s.width); x++ {
+		line[x] = blank
+	}
+}
+
+// ED: 0 below cursor, 1 above cursor, 2 and 3 whole screen
+func (s *Screen) eraseDisplay(mode int) {
+	switch mode {
+	case 0:
+		s.erase(s.cursor.y, s.cursor.x, s.width)
+		for y := s.cursor.y + 1; y < s.height; y++ {
+			s.erase(y, 0, s.width)
+		}
+	case 1:
+		for y := 0; y < s.cursor.y; y++ {
+			s.erase(y, 0, s.width)
+		}
+		s.erase(s.cursor.y, 0, s.cursor.x+1)
+	case 2, 3:
+		for y := 0; y < s.height; y++ {
+			s.erase(y, 0, s.width)
+		}
+	}
+	s.wrapNext = false
+}
+
+// EL: 0 right of cursor, 1 left of cursor, 2 whole line
+func (s *Screen) eraseLine(mode int) {
+	switch mode {
+	case 0:
+		s.erase(s.cursor.y, s.cursor.x, s.width)
+	case 1:
+		s.erase(s.cursor.y, 0, s.cursor.x+1)
+	case 2:
+		s.erase(s.cursor.y, 0, s.width)
+	}
+	s.wrapNext = false
+}
+
+func (s *Screen) eraseCells(n int) {
+	s.erase(s.cursor.y, s.cursor.x, s.cursor.x+n)
+	s.wrapNext = false
+}
+
+func (s *Screen) insertCells(n int) {
+	line := s.lines[s.cursor.y]
+	n = clamp(n, 0, s.width-s.cursor.x)
+	copy(line[s.cursor.x+n:], line[s.cursor.x:])
+	s.erase(s.cursor.y, s.cursor.x, s.cursor.x+n)
+	s.wrapNext = false
+}
+
+func (s *Screen) deleteCells(n int) {
+	line := s.lines[s.cursor.y]
+	n = clamp(n, 0, s.width-s.cursor.x)
+	copy(line[s.cursor.x:], line[s.cursor.x+n:])
+	s.erase(s.cursor.y, s.width-n, s.width)
+	s.wrapNext = false
+}
+
+// DECSTBM sets the scrolling region and homes the cursor
+func (s *Screen) setRegion(top int, bottom int) {
+	top = clamp(top, 0, s.height-1)
+	bottom = clamp(bottom, 0, s.height-1)
+	if top >= bottom {
+		return
+	}
+	s.top = top
+	s.bottom = bottom
+	s.moveOrigin(0, 0)
+}
+
+func (s *Screen) saveCursor() {
+	s.saved = s.cursor
+}
+
+func (s *Screen) restoreCursor() {
+	s.cursor = s.saved
+	s.wrapNext = false
+}
+
+// Switches to a cleared alternate screen or back to the primary screen
+func (s *Screen) useAlternate(on bool) {
+	if on == s.isAlternate {
+		return
+	}
+	s.isAlternate = on
+	if on {
+		s.alternate = s.newBuffer()
+		s.lines = s.alternate
+	} else {
+		s.lines = s.primary
+	}
+	s.wrapNext = false
+}
+
+// DECALN fills the screen with E
+func (s *Screen) alignmentTest() {
+	for _, line := range s.lines {
+		for x := range line {
+			line[x] = Cell{Rune: 'E', Attr: defaultAttr}
+		}
+	}
+	s.top = 0
+	s.bottom = s.height - 1
+	s.moveTo(0, 0)
+}
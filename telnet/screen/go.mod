@@ -0,0 +1,3 @@
+module telnet/screen
+
+go 1.18
@@ -0,0 +1,425 @@
+package screen
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	stateGround = iota
+	stateEscape
+	stateEscapeIntermediate
+	stateCSI
+	stateOSC
+	stateOSCEscape
+	// DCS, SOS, PM and APC strings are ignored
+	stateString
+	stateStringEscape
+)
+
+// Limits guarding against hostile sequences
+const (
+	maxParams   = 32
+	maxParam    = 65535
+	maxSequence = 4096
+)
+
+// Escape sequence parser state
+type parser struct {
+	state        int
+	intermediate byte
+	sequence     []byte
+	// Incomplete UTF-8 sequence
+	utf8 []byte
+}
+
+func (s *Screen) feed(c byte) {
+	p := &s.parser
+	// Controls are executed in the middle of sequences
+	if c < 0x20 && p.state != stateOSC && p.state != stateString {
+		switch c {
+		case 0x1b:
+			s.flushUTF8()
+			p.state = stateEscape
+			p.intermediate = 0
+		case 0x18, 0x1a:
+			// CAN and SUB abort the sequence
+			p.state = stateGround
+		default:
+			s.execute(c)
+		}
+		return
+	}
+
+	switch p.state {
+	case stateGround:
+		s.printByte(c)
+	case stateEscape:
+		s.escape(c)
+	case stateEscapeIntermediate:
+		if c >= 0x20 && c <= 0x2f {
+			return
+		}
+		s.designate(p.intermediate, c)
+		p.state = stateGround
+	case stateCSI:
+		switch {
+		case c >= 0x40 && c <= 0x7e:
+			s.csi(string(p.sequence), c)
+			p.state = stateGround
+		case len(p.sequence) < maxSequence:
+			p.sequence = append(p.sequence, c)
+		}
+	case stateOSC:
+		switch {
+		case c == 0x07:
+			s.osc(string(p.sequence))
+			p.state = stateGround
+		case c == 0x1b:
+			p.state = stateOSCEscape
+		case len(p.sequence) < maxSequence:
+			p.sequence = append(p.sequence, c)
+		}
+	case stateOSCEscape:
+		if c == '\\' {
+			s.osc(string(p.sequence))
+		}
+		p.state = stateGround
+	case stateString:
+		if c == 0x1b {
+			p.state = stateStringEscape
+		}
+	case stateStringEscape:
+		if c == '\\' {
+			p.state = stateGround
+		} else {
+			p.state = stateString
+		}
+	}
+}
+
+// Decodes UTF-8 and prints complete characters
+func (s *Screen) printByte(c byte) {
+	p := &s.parser
+	if c < 0x80 {
+		s.flushUTF8()
+		if c != 0x7f {
+			s.print(rune(c))
+		}
+		return
+	}
+	if utf8.RuneStart(c) {
+		s.flushUTF8()
+	}
+	p.utf8 = append(p.utf8, c)
+	if utf8.FullRune(p.utf8) {
+		r, _ := utf8.DecodeRune(p.utf8)
+		p.utf8 = p.utf8[:0]
+		s.print(r)
+	}
+}
+
+// Prints a replacement for an incomplete UTF-8 sequence
+func (s *Screen) flushUTF8() {
+	if len(s.parser.utf8) > 0 {
+		s.parser.utf8 = s.parser.utf8[:0]
+		s.print(utf8.RuneError)
+	}
+}
+
+func (s *Screen) execute(c byte) {
+	switch c {
+	case '\b':
+		s.moveTo(s.cursor.x-1, s.cursor.y)
+	case '\t':
+		s.tab(1)
+	case '\n', '\v', '\f':
+		s.lineFeed()
+	case '\r':
+		s.moveTo(0, s.cursor.y)
+	case 0x0e:
+		s.shift = 1
+	case 0x0f:
+		s.shift = 0
+	}
+}
+
+func (s *Screen) escape(c byte) {
+	p := &s.parser
+	p.state = stateGround
+	switch c {
+	case '[':
+		p.sequence = p.sequence[:0]
+		p.state = stateCSI
+	case ']':
+		p.sequence = p.sequence[:0]
+		p.state = stateOSC
+	case 'P', 'X', '^', '_':
+		p.state = stateString
+	case '(', ')', '*', '+', '#', ' ', '%':
+		p.intermediate = c
+		p.state = stateEscapeIntermediate
+	case '7':
+		s.saveCursor()
+	case '8':
+		s.restoreCursor()
+	case 'D':
+		s.lineFeed()
+	case 'E':
+		s.moveTo(0, s.cursor.y)
+		s.lineFeed()
+	case 'M':
+		s.reverseIndex()
+	case 'c':
+		s.reset()
+	}
+}
+
+// Handles ESC with intermediate byte such as charset designation
+func (s *Screen) designate(intermediate byte, c byte) {
+	switch intermediate {
+	case '(':
+		s.charsets[0] = c
+	case ')':
+		s.charsets[1] = c
+	case '#':
+		if c == '8' {
+			s.alignmentTest()
+		}
+	}
+}
+
+func (s *Screen) osc(sequence string) {
+	command, text, _ := strings.Cut(sequence, ";")
+	switch command {
+	case "0", "2":
+		s.title = text
+	}
+}
+
+func (s *Screen) csi(sequence string, final byte) {
+	var private byte
+	if len(sequence) > 0 && strings.IndexByte("<=>?", sequence[0]) >= 0 {
+		private = sequence[0]
+		sequence = sequence[1:]
+	}
+	// Intermediates such as in DECSCUSR are not supported
+	if strings.IndexFunc(sequence, func(r rune) bool { return r >= 0x20 && r <= 0x2f }) >= 0 {
+		return
+	}
+	params := parseParams(sequence)
+	n := param(params, 0, 1)
+
+	if private != 0 && private != '?' {
+		return
+	}
+	if private == '?' {
+		switch final {
+		case 'h':
+			s.setModes(params, true, true)
+		case 'l':
+			s.setModes(params, false, true)
+		}
+		return
+	}
+
+	switch final {
+	case 'A':
+		s.moveTo(s.cursor.x, s.cursor.y-n)
+	case 'B', 'e':
+		s.moveTo(s.cursor.x, s.cursor.y+n)
+	case 'C', 'a':
+		s.moveTo(s.cursor.x+n, s.cursor.y)
+	case 'D':
+		s.moveTo(s.cursor.x-n, s.cursor.y)
+	case 'E':
+		s.moveTo(0, s.cursor.y+n)
+	case 'F':
+		s.moveTo(0, s.cursor.y-n)
+	case 'G', '`':
+		s.moveTo(n-1, s.cursor.y)
+	case 'H', 'f':
+		s.moveOrigin(param(params, 1, 1)-1, n-1)
+	case 'd':
+		s.moveOrigin(s.cursor.x, n-1)
+	case 'I':
+		s.tab(n)
+	case 'Z':
+		s.tab(-n)
+	case 'J':
+		s.eraseDisplay(param(params, 0, 0))
+	case 'K':
+		s.eraseLine(param(params, 0, 0))
+	case 'L':
+		s.insertLines(n)
+	case 'M':
+		s.deleteLines(n)
+	case '@':
+		s.insertCells(n)
+	case 'P':
+		s.deleteCells(n)
+	case 'X':
+		s.eraseCells(n)
+	case 'S':
+		s.scrollUp(s.top, n)
+	case 'T':
+		s.scrollDown(s.top, n)
+	case 'b':
+		for i := 0; i < n && i < s.width*s.height; i++ {
+			s.print(s.lastRune)
+		}
+	case 'r':
+		s.setRegion(param(params, 0, 1)-1, param(params, 1, s.height)-1)
+	case 'm':
+		s.sgr(params)
+	case 's':
+		s.saveCursor()
+	case 'u':
+		s.restoreCursor()
+	case 'h':
+		s.setModes(params, true, false)
+	case 'l':
+		s.setModes(params, false, false)
+	}
+}
+
+func parseParams(sequence string) []int {
+	if len(sequence) == 0 {
+		return nil
+	}
+	fields := strings.FieldsFunc(sequence, func(r rune) bool { return r == ';' || r == ':' })
+	if strings.HasPrefix(sequence, ";") {
+		fields = append([]string{""}, fields...)
+	}
+	if len(fields) > maxParams {
+		fields = fields[:maxParams]
+	}
+	params := make([]int, len(fields))
+	for i, field := range fields {
+		v, _ := strconv.Atoi(field)
+		params[i] = clamp(v, 0, maxParam)
+	}
+	return params
+}
+
+// Returns parameter i or def when missing or zero
+func param(params []int, i int, def int) int {
+	if i < len(params) && params[i] > 0 {
+		return params[i]
+	}
+	return def
+}
+
+func (s *Screen) setModes(params []int, set bool, private bool) {
+	for _, mode := range params {
+		if !private {
+			if mode == 4 {
+				s.insert = set
+			}
+			continue
+		}
+		switch mode {
+		case 6:
+			s.cursor.origin = set
+			s.moveOrigin(0, 0)
+		case 7:
+			s.autowrap = set
+		case 25:
+			s.cursorVisible = set
+		case 47, 1047:
+			s.useAlternate(set)
+		case 1048:
+			if set {
+				s.saveCursor()
+			} else {
+				s.restoreCursor()
+			}
+		case 1049:
+			if set {
+				s.savedPrimary = s.cursor
+				s.useAlternate(true)
+			} else {
+				s.useAlternate(false)
+				s.cursor = s.savedPrimary
+				s.wrapNext = false
+			}
+		}
+	}
+}
+
+// Applies Select Graphic Rendition parameters
+func (s *Screen) sgr(params []int) {
+	attr := &s.cursor.attr
+	if len(params) == 0 {
+		params = []int{0}
+	}
+	for i := 0; i < len(params); i++ {
+		p := params[i]
+		switch {
+		case p == 0:
+			*attr = defaultAttr
+		case p == 1:
+			attr.Bold = true
+		case p == 2:
+			attr.Dim = true
+		case p == 3:
+			attr.Italic = true
+		case p == 4:
+			attr.Underline = true
+		case p == 5 || p == 6:
+			attr.Blink = true
+		case p == 7:
+			attr.Reverse = true
+		case p == 8:
+			attr.Hidden = true
+		case p == 21 || p == 22:
+			attr.Bold = false
+			attr.Dim = false
+		case p == 23:
+			attr.Italic = false
+		case p == 24:
+			attr.Underline = false
+		case p == 25:
+			attr.Blink = false
+		case p == 27:
+			attr.Reverse = false
+		case p == 28:
+			attr.Hidden = false
+		case p >= 30 && p <= 37:
+			attr.Fg = Color(p - 30)
+		case p == 38:
+			attr.Fg, i = extendedColor(params, i)
+		case p == 39:
+			attr.Fg = DefaultColor
+		case p >= 40 && p <= 47:
+			attr.Bg = Color(p - 40)
+		case p == 48:
+			attr.Bg, i = extendedColor(params, i)
+		case p == 49:
+			attr.Bg = DefaultColor
+		case p >= 90 && p <= 97:
+			attr.Fg = Color(p - 90 + 8)
+		case p >= 100 && p <= 107:
+			attr.Bg = Color(p - 100 + 8)
+		}
+	}
+}
+
+// Parses 38;5;n and 38;2;r;g;b, returning the index of the last parameter used
+func extendedColor(params []int, i int) (Color, int) {
+	if i+1 >= len(params) {
+		return DefaultColor, i
+	}
+	switch params[i+1] {
+	case 5:
+		if i+2 < len(params) {
+			return Color(clamp(params[i+2], 0, 255)), i + 2
+		}
+	case 2:
+		if i+4 < len(params) {
+			return RGB(uint8(params[i+2]), uint8(params[i+3]), uint8(params[i+4])), i + 4
+		}
+	}
+	return DefaultColor, len(params)
+}
@@ -0,0 +1,307 @@
+package screen
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Palette index 0-255, RGB value or DefaultColor
+type Color int32
+
+const DefaultColor Color = -1
+
+// Flag distinguishing 24-bit colors from palette indexes
+const rgbFlag = 1 << 24
+
+func RGB(r uint8, g uint8, b uint8) Color {
+	return Color(rgbFlag | int32(r)<<16 | int32(g)<<8 | int32(b))
+}
+
+func (c Color) IsRGB() bool {
+	return c >= rgbFlag
+}
+
+// SGR attributes of a cell
+type Attr struct {
+	Fg        Color
+	Bg        Color
+	Bold      bool
+	Dim       bool
+	Italic    bool
+	Underline bool
+	Blink     bool
+	Reverse   bool
+	Hidden    bool
+}
+
+var defaultAttr = Attr{Fg: DefaultColor, Bg: DefaultColor}
+
+type Cell struct {
+	Rune rune
+	Attr Attr
+}
+
+var ErrTimeout = errors.New("timed out waiting for screen")
+
+// Cursor state saved by DECSC
+type cursor struct {
+	x      int
+	y      int
+	attr   Attr
+	origin bool
+}
+
+// Virtual VT100/xterm screen fed with server output
+type Screen struct {
+	width     int
+	height    int
+	primary   [][]Cell
+	alternate [][]Cell
+	// Active buffer
+	lines       [][]Cell
+	isAlternate bool
+	cursor      cursor
+	saved       cursor
+	// Cursor saved when entering alternate screen
+	savedPrimary cursor
+	// Cursor is past the last column until next character
+	wrapNext      bool
+	autowrap      bool
+	insert        bool
+	cursorVisible bool
+	// Scrolling region
+	top    int
+	bottom int
+	// G0 and G1 character sets and the one shifted in
+	charsets [2]byte
+	shift    int
+	lastRune rune
+	title    string
+	parser   parser
+	// Closed and replaced on every change
+	changed chan struct{}
+	mu      sync.Mutex
+}
+
+// Contents of the screen at one point in time
+type Snapshot struct {
+	Width         int
+	Height        int
+	CursorX       int
+	CursorY       int
+	CursorVisible bool
+	Alternate     bool
+	Title         string
+	Cells         [][]Cell
+}
+
+// Size taken when the one given is not positive, such as without a tty
+const (
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+func New(width int, height int) *Screen {
+	if width < 1 || height < 1 {
+		width, height = defaultWidth, defaultHeight
+	}
+	s := new(Screen)
+	s.width = width
+	s.height = height
+	s.changed = make(chan struct{})
+	s.reset()
+	return s
+}
+
+// Feeds output such as the bytes returned by ReadMessage
+func (s *Screen) Write(b []byte) (int, error) {
+	if s == nil {
+		return len(b), nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range b {
+		s.feed(c)
+	}
+	s.notify()
+	return len(b), nil
+}
+
+// Sets the size reported to the server through NAWS
+func (s *Screen) Resize(width int, height int) {
+	if s == nil || width < 1 || height < 1 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if width == s.width && height == s.height {
+		return
+	}
+	s.width = width
+	s.height = height
+	s.primary = s.reshape(s.primary)
+	s.alternate = s.reshape(s.alternate)
+	s.lines = s.primary
+	if s.isAlternate {
+		s.lines = s.alternate
+	}
+	s.top = 0
+	s.bottom = height - 1
+	s.wrapNext = false
+	for _, c := range []*cursor{&s.cursor, &s.saved, &s.savedPrimary} {
+		c.x = clamp(c.x, 0, width-1)
+		c.y = clamp(c.y, 0, height-1)
+	}
+	s.notify()
+}
+
+func (s *Screen) Size() (width int, height int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.width, s.height
+}
+
+func (s *Screen) Snapshot() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot()
+}
+
+// Blocks until cond holds for the screen or timeout elapses
+func (s *Screen) WaitUntil(cond func(Snapshot) bool, timeout time.Duration) (Snapshot, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		snapshot := s.snapshot()
+		changed := s.changed
+		s.mu.Unlock()
+		if cond(snapshot) {
+			return snapshot, nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return snapshot, ErrTimeout
+		}
+	}
+}
+
+// Blocks until text appears on the screen or timeout elapses
+func (s *Screen) WaitFor(text string, timeout time.Duration) (Snapshot, error) {
+	return s.WaitUntil(func(snapshot Snapshot) bool {
+		return snapshot.Contains(text)
+	}, timeout)
+}
+
+func (s *Screen) snapshot() Snapshot {
+	cells := make([][]Cell, len(s.lines))
+	for y, line := range s.lines {
+		cells[y] = append([]Cell(nil), line...)
+	}
+	return Snapshot{
+		Width:         s.width,
+		Height:        s.height,
+		CursorX:       s.cursor.x,
+		CursorY:       s.cursor.y,
+		CursorVisible: s.cursorVisible,
+		Alternate:     s.isAlternate,
+		Title:         s.title,
+		Cells:         cells,
+	}
+}
+
+func (s *Screen) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Returns text of line y without trailing spaces
+func (snapshot Snapshot) Line(y int) string {
+	if y < 0 || y >= len(snapshot.Cells) {
+		return ""
+	}
+	line := make([]rune, len(snapshot.Cells[y]))
+	for x, cell := range snapshot.Cells[y] {
+		line[x] = cell.Rune
+	}
+	return strings.TrimRight(string(line), " ")
+}
+
+// Returns all lines separated by newlines
+func (snapshot Snapshot) Text() string {
+	lines := make([]string, len(snapshot.Cells))
+	for y := range snapshot.Cells {
+		lines[y] = snapshot.Line(y)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (snapshot Snapshot) Contains(text string) bool {
+	return strings.Contains(snapshot.Text(), text)
+}
+
+// Restores power-on state (RIS)
+func (s *Screen) reset() {
+	s.cursor = cursor{attr: defaultAttr}
+	s.primary = s.newBuffer()
+	s.alternate = s.newBuffer()
+	s.lines = s.primary
+	s.isAlternate = false
+	s.saved = s.cursor
+	s.savedPrimary = s.cursor
+	s.wrapNext = false
+	s.autowrap = true
+	s.insert = false
+	s.cursorVisible = true
+	s.top = 0
+	s.bottom = s.height - 1
+	s.charsets = [2]byte{'B', 'B'}
+	s.shift = 0
+	s.title = ""
+}
+
+func (s *Screen) newBuffer() [][]Cell {
+	lines := make([][]Cell, s.height)
+	for y := range lines {
+		lines[y] = s.blankLine()
+	}
+	return lines
+}
+
+// Copies buffer into current size keeping the top left corner
+func (s *Screen) reshape(old [][]Cell) [][]Cell {
+	lines := s.newBuffer()
+	for y := 0; y < len(old) && y < s.height; y++ {
+		copy(lines[y], old[y])
+	}
+	return lines
+}
+
+// Erased cells keep the current background color
+func (s *Screen) blank() Cell {
+	attr := defaultAttr
+	attr.Bg = s.cursor.attr.Bg
+	return Cell{Rune: ' ', Attr: attr}
+}
+
+func (s *Screen) blankLine() []Cell {
+	line := make([]Cell, s.width)
+	blank := s.blank()
+	for x := range line {
+		line[x] = blank
+	}
+	return line
+}
+
+func clamp(v int, low int, high int) int {
+	if v < low {
+		return low
+	}
+	if v > high {
+		return high
+	}
+	return v
+}
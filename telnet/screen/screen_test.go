@@ -0,0 +1,144 @@
+package screen
+
+import (
+	"testing"
+	"time"
+)
+
+// Output sequences and the resulting screen of a 10x4 terminal
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name    string
+		writes  []string
+		lines   []string
+		cursorX int
+		cursorY int
+	}{
+		{
+			name:    "print and wrap",
+			writes:  []string{"0123456789ab"},
+			lines:   []string{"0123456789", "ab", "", ""},
+			cursorX: 2,
+			cursorY: 1,
+		},
+		{
+			name:    "cursor position",
+			writes:  []string{"\x1b[2;3Hx\x1b[Hy"},
+			lines:   []string{"y", "  x", "", ""},
+			cursorX: 1,
+			cursorY: 0,
+		},
+		{
+			name:    "erase display below",
+			writes:  []string{"aaa\r\nbbb\r\nccc\x1b[2;2H\x1b[J"},
+			lines:   []string{"aaa", "b", "", ""},
+			cursorX: 1,
+			cursorY: 1,
+		},
+		{
+			name:    "erase display above",
+			writes:  []string{"aaa\r\nbbb\r\nccc\x1b[2;2H\x1b[1J"},
+			lines:   []string{"", "  b", "ccc", ""},
+			cursorX: 1,
+			cursorY: 1,
+		},
+		{
+			name:    "erase line",
+			writes:  []string{"abcdef\x1b[3G\x1b[K\r\nghijkl\x1b[3G\x1b[1K\r\nmnopqr\x1b[2K"},
+			lines:   []string{"ab", "   jkl", "", ""},
+			cursorX: 6,
+			cursorY: 2,
+		},
+		{
+			name:    "scroll region",
+			writes:  []string{"1\r\n2\r\n3\r\n4\x1b[2;3r\x1b[3H\nx"},
+			lines:   []string{"1", "3", "x", "4"},
+			cursorX: 1,
+			cursorY: 2,
+		},
+		{
+			name:    "reverse index in scroll region",
+			writes:  []string{"1\r\n2\r\n3\r\n4\x1b[2;3r\x1b[2H\x1bM"},
+			lines:   []string{"1", "", "2", "4"},
+			cursorX: 0,
+			cursorY: 1,
+		},
+		{
+			name:    "alternate screen restored",
+			writes:  []string{"main\x1b[?1049h\x1b[2;1Halt\x1b[?1049l"},
+			lines:   []string{"main", "", "", ""},
+			cursorX: 4,
+			cursorY: 0,
+		},
+		{
+			name:    "UTF-8 split across writes",
+			writes:  []string{"\xc3", "\xa9t\xe2\x82", "\xac"},
+			lines:   []string{"ét€", "", "", ""},
+			cursorX: 3,
+			cursorY: 0,
+		},
+		{
+			name:    "CSI split across writes",
+			writes:  []string{"ab\x1b[", "1;", "5Hc"},
+			lines:   []string{"ab  c", "", "", ""},
+			cursorX: 5,
+			cursorY: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New(10, 4)
+			for _, w := range test.writes {
+				s.Write([]byte(w))
+			}
+			snapshot := s.Snapshot()
+			for y, want := range test.lines {
+				if got := snapshot.Line(y); got != want {
+					t.Errorf("line %d = %q, want %q", y, got, want)
+				}
+			}
+			if snapshot.CursorX != test.cursorX || snapshot.CursorY != test.cursorY {
+				t.Errorf("cursor at %d,%d, want %d,%d", snapshot.CursorX, snapshot.CursorY, test.cursorX, test.cursorY)
+			}
+		})
+	}
+}
+
+// Alternate screen content is drawn apart from the primary buffer
+func TestAlternateScreen(t *testing.T) {
+	s := New(10, 4)
+	s.Write([]byte("main\x1b[?1049h\x1b[Halt"))
+	snapshot := s.Snapshot()
+	if !snapshot.Alternate || snapshot.Line(0) != "alt" {
+		t.Fatalf("alternate %v, line %q", snapshot.Alternate, snapshot.Line(0))
+	}
+	s.Write([]byte("\x1b[?1049l"))
+	snapshot = s.Snapshot()
+	if snapshot.Alternate || snapshot.Line(0) != "main" {
+		t.Fatalf("alternate %v, line %q", snapshot.Alternate, snapshot.Line(0))
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	s := New(10, 4)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.Write([]byte("\x1b[3;2Hlogin:"))
+	}()
+	snapshot, err := s.WaitFor("login:", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Line(2) != " login:" {
+		t.Errorf("line 2 = %q", snapshot.Line(2))
+	}
+
+	start := time.Now()
+	_, err = s.WaitFor("password:", 50*time.Millisecond)
+	if err != ErrTimeout {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("returned after %v", elapsed)
+	}
+}
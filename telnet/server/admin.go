@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"telnet/mud"
+	opt "telnet/option"
+	"text/tabwriter"
+	"time"
+)
+
+// Serves admin commands on a Unix socket
+func (m *Manager) ServeAdmin(path string) error {
+	err := removeStaleSocket(path)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	go func() {
+		defer ln.Close()
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				log.Println("Admin Error:", err)
+				continue
+			}
+			go m.handleAdmin(conn)
+		}
+	}()
+	return nil
+}
+
+// Removes a socket left by a server that exited, refusing one still served or another file
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("admin socket %s exists and is not a socket", path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("admin socket %s is in use by another server", path)
+	}
+	return os.Remove(path)
+}
+
+func (m *Manager) handleAdmin(conn net.Conn) {
+	defer conn.Close()
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		log.Println("Admin Error:", err)
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		fmt.Fprintln(conn, "Error: no command")
+		return
+	}
+	log.Println("Admin:", strings.TrimSpace(line))
+	err = m.execAdmin(conn, args[0], args[1:])
+	if err != nil {
+		fmt.Fprintln(conn, "Error:", err)
+	}
+}
+
+func (m *Manager) execAdmin(w io.Writer, command string, args []string) error {
+	switch command {
+	case "list":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tPEER\tUSER\tTERM\tSIZE\tIDLE\tOPTIONS")
+		for _, s := range m.List() {
+			info := s.Info()
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%dx%d\t%s\t%s\n", info.ID, info.RemoteAddr, orDash(info.User), info.TerminalType, info.Width, info.Height, s.IdleTime().Truncate(time.Second), strings.Join(s.Options(), ","))
+		}
+		return tw.Flush()
+	case "kill":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: kill <id>")
+		}
+		s, err := m.session(args[0])
+		if err != nil {
+			return err
+		}
+		s.Notify("Session killed by administrator.")
+		s.Kill()
+		fmt.Fprintf(w, "Killed session %d\n", s.ID)
+	case "wall":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: wall <message>")
+		}
+		m.Broadcast("Broadcast message from administrator: " + strings.Join(args, " "))
+		fmt.Fprintf(w, "Sent to %d sessions\n", len(m.List()))
+	case "gmcp":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: gmcp <id> <package> [json]")
+		}
+		s, err := m.session(args[0])
+		if err != nil {
+			return err
+		}
+		var data interface{}
+		if len(args) > 2 {
+			raw := json.RawMessage(strings.Join(args[2:], " "))
+			if !json.Valid(raw) {
+				return fmt.Errorf("invalid JSON %s", raw)
+			}
+			data = raw
+		}
+		return s.SendGMCP(args[1], data)
+	case "msdp":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: msdp <id> <variable> <value>")
+		}
+		s, err := m.session(args[0])
+		if err != nil {
+			return err
+		}
+		return s.SendMSDP(mud.MSDP{args[1]: strings.Join(args[2:], " ")})
+	case "pace":
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			return fmt.Errorf("usage: pace <id> on|off")
+		}
+		s, err := m.session(args[0])
+		if err != nil {
+			return err
+		}
+		s.SetPacing(args[1] == "on")
+		if cps := s.PaceRate(); cps > 0 {
+			fmt.Fprintf(w, "Pacing session %d at %d characters per second\n", s.ID, cps)
+		} else {
+			fmt.Fprintf(w, "Not pacing session %d\n", s.ID)
+		}
+	case "drain":
+		m.Drain()
+		fmt.Fprintf(w, "Draining, exiting once %d sessions end\n", len(m.List()))
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+	return nil
+}
+
+// Returns session by ID argument
+func (m *Manager) session(arg string) (*Server, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, err
+	}
+	s := m.Get(id)
+	if s == nil {
+		return nil, fmt.Errorf("no session %d", id)
+	}
+	return s, nil
+}
+
+// Returns names of enabled options
+func (s *Server) Options() []string {
+	enableOptions, _ := s.options.Load().(map[byte]bool)
+	var options []byte
+	for option, enabled := range enableOptions {
+		if enabled {
+			options = append(options, option)
+		}
+	}
+	sort.Slice(options, func(i, j int) bool {
+		return options[i] < options[j]
+	})
+	names := make([]string, len(options))
+	for i, option := range options {
+		names[i] = opt.Name(option)
+	}
+	return names
+}
+
+// Publishes a copy of enabled options for admin
+func (s *Server) storeOptions() {
+	enableOptions := make(map[byte]bool, len(s.EnableOptions))
+	for option, enabled := range s.EnableOptions {
+		enableOptions[option] = enabled
+	}
+	s.options.Store(enableOptions)
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+// Sends a command to admin socket and prints the response
+func RunAdmin(path string, args []string) {
+	if len(args) == 0 {
+		log.Fatalln("Error: usage: admin list|kill <id>|wall <message>|gmcp <id> <package> [json]|msdp <id> <variable> <value>|pace <id> on|off|drain")
+	}
+	if len(path) == 0 {
+		log.Fatalln("Error: admin requires -admin-socket")
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+	defer conn.Close()
+	_, err = fmt.Fprintln(conn, strings.Join(args, " "))
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+	_, err = io.Copy(os.Stdout, conn)
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+}
@@ -0,0 +1,630 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"telnet/connection"
+	opt "telnet/option"
+	"telnet/terminal"
+	"time"
+)
+
+// Client attached to another client's session
+type Viewer struct {
+	connection.Connection
+	Session *Server
+	// Number shown to the owner, input is guarded by Session.viewersMu
+	ID       int
+	CanWrite bool
+	// Owner reattached to a detached session
+	Owner bool
+	// Output waiting for a viewer other than the owner
+	queue   chan []byte
+	left    chan struct{}
+	dropped int32
+}
+
+// Keys shown to the session owner for sharing the session
+type AttachKeys struct {
+	ReadOnly  string
+	ReadWrite string
+}
+
+// Wait time for a viewer to accept output before it is disconnected
+const viewerWriteTimeout = 5 * time.Second
+
+// Wait time for su to check a viewer's password
+const authTimeout = 10 * time.Second
+
+// Output chunks queued for a viewer before it is disconnected as too slow
+const viewerQueueSize = 64
+
+// Escape at the start of a line for owner commands, as in ssh
+const shareEscape = '~'
+
+// States of owner command input
+const (
+	shareNone byte = iota
+	shareEscaped
+	shareGrant
+	shareRevoke
+	// Skips LF or NUL after CR that ended a command
+	shareDone
+)
+
+func newAttachKeys() (AttachKeys, error) {
+	var keys AttachKeys
+	for _, key := range []*string{&keys.ReadOnly, &keys.ReadWrite} {
+		b := make([]byte, 8)
+		_, err := rand.Read(b)
+		if err != nil {
+			return keys, err
+		}
+		*key = hex.EncodeToString(b)
+	}
+	return keys, nil
+}
+
+// Serves clients attaching to live sessions by ID and key, with TLS as configured for sessions
+func (m *Manager) ListenAttach(ip string, port int, config Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	if config.ImplicitTLS {
+		ln = tls.NewListener(ln, config.TLS)
+	}
+	go func() {
+		defer ln.Close()
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				log.Println("Attach Error:", err)
+				continue
+			}
+			go m.handleAttach(conn, config)
+		}
+	}()
+	return ln, nil
+}
+
+func (m *Manager) handleAttach(conn net.Conn, config Config) {
+	v := new(Viewer)
+	v.IsServer = true
+	v.Conn = conn
+	v.Reader = bufio.NewReader(conn)
+	v.SupportOptions = []byte{opt.ECHO, opt.SUPPRESS_GO_AHEAD, opt.TERMINAL_TYPE, opt.NEGOTIATE_ABOUT_WINDOW_SIZE}
+	v.EnableOptions = map[byte]bool{}
+	v.BuildCmdRes = BuildCmdRes
+	v.ErrChan = make(chan error, 8)
+	// Holds viewer's own window size, no pty is opened
+	v.Terminal = terminal.New()
+	defer conn.Close()
+
+	err := v.secure(config)
+	if err != nil {
+		log.Printf("Attach Error: %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	err = v.ReqCmds(v.SupportOptions)
+	if err != nil {
+		log.Println("Attach Error:", err)
+		return
+	}
+	line, err := v.prompt("Session ID: ", true)
+	if err != nil {
+		return
+	}
+	username, err := v.prompt("Login: ", true)
+	if err != nil {
+		return
+	}
+	password, err := v.prompt("Password: ", false)
+	if err != nil {
+		return
+	}
+	key, err := v.prompt("Key: ", false)
+	if err != nil {
+		return
+	}
+	id, _ := strconv.Atoi(strings.TrimSpace(line))
+	username = strings.TrimSpace(username)
+	s := m.Get(id)
+	reason := ""
+	if ok, err := terminal.Authenticate(username, password, authTimeout); err != nil || !ok {
+		reason = "login incorrect for " + strconv.Quote(username)
+		if err != nil {
+			reason += ": " + err.Error()
+		}
+	} else if s == nil || !s.isLoggedIn() {
+		reason = "no such session"
+	} else if !s.mayAttach(username) {
+		reason = strconv.Quote(username) + " is not the owner or an allowed user"
+	} else if !s.checkKey(v, strings.TrimSpace(key)) {
+		reason = "wrong key"
+	}
+	if len(reason) > 0 {
+		log.Printf("Attach from %s to session %s denied: %s", conn.RemoteAddr(), strings.TrimSpace(line), reason)
+		v.WriteBytes([]byte("\r\nAccess denied.\r\n"))
+		return
+	}
+
+	mode := "read-only"
+	if v.CanWrite {
+		mode = "read-write"
+	}
+	log.Printf("Session %d: Attached %s as %s from %s", s.ID, mode, username, conn.RemoteAddr())
+	v.WriteBytes([]byte("\r\nAttached to session " + strconv.Itoa(s.ID) + " (" + mode + ").\r\n"))
+	v.Session = s
+	s.attach(v)
+	s.Notify(fmt.Sprintf("Viewer %d attached as %s from %s (%s).", v.ID, username, conn.RemoteAddr(), mode))
+	v.relay()
+	s.detach(v)
+	log.Printf("Session %d: Viewer left %s", s.ID, conn.RemoteAddr())
+}
+
+// Relays input from viewer if allowed until it disconnects
+func (v *Viewer) relay() {
+	s := v.Session
+	go func() {
+		for err := range v.ErrChan {
+			log.Printf("Session %d: Viewer Error: %s", s.ID, err)
+		}
+	}()
+	defer close(v.ErrChan)
+	for {
+		byteMessage, err := v.ReadMessage()
+		if err == io.EOF || errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			v.ErrChan <- err
+			return
+		}
+		s.resize()
+		if v.Owner {
+			s.touch()
+			byteMessage = s.ownerInput(byteMessage)
+		}
+		if len(byteMessage) == 0 || !v.canWrite() {
+			continue
+		}
+		s.input(byteMessage)
+	}
+}
+
+func (v *Viewer) canWrite() bool {
+	v.Session.viewersMu.Lock()
+	defer v.Session.viewersMu.Unlock()
+	return v.CanWrite
+}
+
+// Queues output for a viewer, disconnecting it if the queue is full
+func (v *Viewer) send(b []byte) {
+	select {
+	case v.queue <- b:
+	default:
+		if atomic.CompareAndSwapInt32(&v.dropped, 0, 1) {
+			log.Printf("Session %d: Viewer %d too slow, disconnecting", v.Session.ID, v.ID)
+			v.Conn.Close()
+		}
+	}
+}
+
+// Writes queued output until the viewer leaves
+func (v *Viewer) writeQueue() {
+	for {
+		select {
+		case b := <-v.queue:
+			v.write(b)
+		case <-v.left:
+			return
+		}
+	}
+}
+
+// Reads a line from viewer, echoing it if echo is true
+func (v *Viewer) prompt(message string, echo bool) (string, error) {
+	err := v.WriteBytes([]byte(message))
+	if err != nil {
+		return "", err
+	}
+	var line []byte
+	for {
+		byteMessage, err := v.ReadMessage()
+		if err != nil {
+			return "", err
+		}
+		for _, b := range byteMessage {
+			switch b {
+			case '\r', '\n':
+				return string(line), v.WriteBytes([]byte("\r\n"))
+			case '\b', '\177':
+				if len(line) > 0 {
+					line = line[:len(line)-1]
+					if echo {
+						v.WriteBytes([]byte("\b \b"))
+					}
+				}
+			case 0:
+			default:
+				line = append(line, b)
+				if echo {
+					v.WriteBytes([]byte{b})
+				}
+			}
+		}
+	}
+}
+
+// Writes to viewer, disconnecting it if it does not keep up
+func (v *Viewer) write(b []byte) {
+	v.Conn.SetWriteDeadline(time.Now().Add(viewerWriteTimeout))
+	err := v.WriteBytes(b)
+	if err != nil {
+		v.Conn.Close()
+	}
+}
+
+// Reports whether a user may attach: the owner or a configured user
+func (s *Server) mayAttach(username string) bool {
+	if username == s.LoginUser() {
+		return true
+	}
+	for _, allowed := range s.Config.AttachUsers {
+		if username == strings.TrimSpace(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs implicit TLS handshake or START_TLS before the prompts, as for sessions
+func (v *Viewer) secure(config Config) error {
+	tlsConn, implicit := v.Conn.(*tls.Conn)
+	if !implicit && len(config.StartTLS) == 0 {
+		return nil
+	}
+	v.Conn.SetDeadline(time.Now().Add(config.NegotiationTimeout))
+	defer v.Conn.SetDeadline(time.Time{})
+	if implicit {
+		return tlsConn.Handshake()
+	}
+	err := v.StartTLS(config.TLS)
+	if err == connection.ErrStartTLSRefused && config.StartTLS == "offer" {
+		return nil
+	} else if err == connection.ErrStartTLSRefused {
+		v.WriteBytes([]byte("Connection refused: START_TLS is required\r\n"))
+	}
+	return err
+}
+
+// Sets viewer permission by the key it sent
+func (s *Server) checkKey(v *Viewer, key string) bool {
+	if len(s.AttachKeys.ReadOnly) == 0 {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(s.AttachKeys.ReadWrite)) == 1 {
+		v.CanWrite = true
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(s.AttachKeys.ReadOnly)) == 1
+}
+
+func (s *Server) attach(v *Viewer) {
+	// Owner gets output directly so a slow owner slows the pty as before
+	if !v.Owner {
+		v.queue = make(chan []byte, viewerQueueSize)
+		v.left = make(chan struct{})
+		go v.writeQueue()
+	}
+	s.viewersMu.Lock()
+	if s.viewers == nil {
+		s.viewers = map[*Viewer]bool{}
+	}
+	s.nextViewer++
+	v.ID = s.nextViewer
+	s.viewers[v] = true
+	s.viewersMu.Unlock()
+	s.resize()
+}
+
+func (s *Server) detach(v *Viewer) {
+	s.viewersMu.Lock()
+	delete(s.viewers, v)
+	s.viewersMu.Unlock()
+	if v.left != nil {
+		close(v.left)
+	}
+	s.resize()
+}
+
+// Keeps the user who logged in and closes loggedIn, serial devices need no login
+func (s *Server) watchLogin() {
+	ticker := time.NewTicker(loginPollInterval)
+	defer ticker.Stop()
+	user := ""
+	for s.ComPort == nil && len(user) == 0 {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		user = s.Terminal.User()
+	}
+	s.loginUser = user
+	close(s.loggedIn)
+}
+
+// Returns the user who logged in, empty before login
+func (s *Server) LoginUser() string {
+	if !s.isLoggedIn() {
+		return ""
+	}
+	return s.loginUser
+}
+
+func (s *Server) isLoggedIn() bool {
+	select {
+	case <-s.loggedIn:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shows attach keys to the owner after login
+func (s *Server) announceAttach() {
+	select {
+	case <-s.loggedIn:
+	case <-s.done:
+		return
+	}
+	s.Notify(fmt.Sprintf("Share session %d on port %d with key %s (read-only) or %s (read-write).\r\nViewers log in as you or a user allowed to attach.\r\nType %c? at the start of a line for sharing commands.", s.ID, s.Config.AttachPort, s.AttachKeys.ReadOnly, s.AttachKeys.ReadWrite, shareEscape))
+}
+
+// Handles owner commands after ~ at the start of a line and returns the other input
+func (s *Server) ownerInput(b []byte) []byte {
+	if len(s.AttachKeys.ReadOnly) == 0 || !s.isLoggedIn() {
+		return b
+	}
+	var input []byte
+	for _, c := range b {
+		state := s.shareState
+		if state == shareDone {
+			s.shareState = shareNone
+			if c == '\n' || c == 0 {
+				continue
+			}
+			state = shareNone
+		}
+		switch state {
+		case shareNone:
+			if c == shareEscape && !s.midLine {
+				s.shareState = shareEscaped
+				continue
+			}
+			input = append(input, c)
+			s.midLine = c != '\r' && c != '\n' && c != 0 && c != 0x03 && c != 0x15
+		case shareEscaped:
+			s.shareState = shareNone
+			switch c {
+			case shareEscape:
+				input = append(input, c)
+				s.midLine = true
+			case '?':
+				s.Notify(fmt.Sprintf("Sharing commands: %[1]cl list viewers, %[1]cg grant input, %[1]cr revoke input, %[1]c%[1]c send %[1]c.", shareEscape))
+			case 'l':
+				s.Notify(s.viewerList())
+			case 'g', 'r':
+				s.shareState = shareGrant
+				prompt := "Grant input to viewer: "
+				if c == 'r' {
+					s.shareState = shareRevoke
+					prompt = "Revoke input of viewer: "
+				}
+				s.shareArg = nil
+				s.writeOwner([]byte("\r\n" + prompt))
+			default:
+				input = append(input, shareEscape, c)
+				s.midLine = true
+			}
+		case shareGrant, shareRevoke:
+			switch {
+			case c == '\r' || c == '\n':
+				s.writeOwner([]byte("\r\n"))
+				id, _ := strconv.Atoi(string(s.shareArg))
+				s.setViewerInput(id, state == shareGrant)
+				s.shareState = shareDone
+				s.midLine = false
+			case c == '\b' || c == '\177':
+				if len(s.shareArg) > 0 {
+					s.shareArg = s.shareArg[:len(s.shareArg)-1]
+					s.writeOwner([]byte("\b \b"))
+				}
+			case c >= '0' && c <= '9':
+				s.shareArg = append(s.shareArg, c)
+				s.writeOwner([]byte{c})
+			}
+		}
+	}
+	return input
+}
+
+// Writes to the owner without a line break
+func (s *Server) writeOwner(b []byte) error {
+	if v := s.owner(); v != nil {
+		return v.WriteBytes(b)
+	}
+	return s.WriteBytes(b)
+}
+
+// Returns attached viewers and their input rights
+func (s *Server) viewerList() string {
+	s.viewersMu.Lock()
+	defer s.viewersMu.Unlock()
+	lines := []string{}
+	for v := range s.viewers {
+		if v.Owner {
+			continue
+		}
+		mode := "read-only"
+		if v.CanWrite {
+			mode = "read-write"
+		}
+		lines = append(lines, fmt.Sprintf("  %d  %s  %s", v.ID, v.Conn.RemoteAddr(), mode))
+	}
+	if len(lines) == 0 {
+		return "No viewers attached."
+	}
+	sort.Strings(lines)
+	return "Viewers:\r\n" + strings.Join(lines, "\r\n")
+}
+
+// Grants or revokes input of a viewer by the owner
+func (s *Server) setViewerInput(id int, canWrite bool) {
+	s.viewersMu.Lock()
+	var viewer *Viewer
+	for v := range s.viewers {
+		if v.ID == id && !v.Owner {
+			viewer = v
+			viewer.CanWrite = canWrite
+		}
+	}
+	s.viewersMu.Unlock()
+	if viewer == nil {
+		s.Notify(fmt.Sprintf("No viewer %d.", id))
+		return
+	}
+	message := fmt.Sprintf("Viewer %d is read-only.", id)
+	if canWrite {
+		message = fmt.Sprintf("Viewer %d can type.", id)
+	}
+	log.Printf("Session %d: %s", s.ID, message)
+	s.Notify(message)
+	if canWrite {
+		viewer.send([]byte("\r\nThe owner granted you input.\r\n"))
+	} else {
+		viewer.send([]byte("\r\nThe owner revoked your input.\r\n"))
+	}
+}
+
+// Disconnects all viewers when the session ends
+func (s *Server) detachAll() {
+	for _, v := range s.Viewers() {
+		v.WriteBytes([]byte("\r\nSession ended.\r\n"))
+		v.Conn.Close()
+	}
+}
+
+// Returns the client reattached to this session
+func (s *Server) owner() *Viewer {
+	for _, v := range s.Viewers() {
+		if v.Owner {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *Server) Viewers() []*Viewer {
+	s.viewersMu.Lock()
+	defer s.viewersMu.Unlock()
+	viewers := make([]*Viewer, 0, len(s.viewers))
+	for v := range s.viewers {
+		viewers = append(viewers, v)
+	}
+	return viewers
+}
+
+// Sends pty output to owner and all viewers, or to scrollback while detached
+func (s *Server) broadcast(b []byte) error {
+	if s.isHandedOff() {
+		return nil
+	}
+	s.detachMu.Lock()
+	defer s.detachMu.Unlock()
+	var queued []byte
+	for _, v := range s.Viewers() {
+		if v.Owner {
+			v.write(b)
+			continue
+		}
+		// Queued output outlives the pty read buffer
+		if queued == nil {
+			queued = append([]byte(nil), b...)
+		}
+		v.send(queued)
+	}
+	if s.detached {
+		s.scrollback.Write(b)
+		return nil
+	}
+	return s.WriteBytes(b)
+}
+
+// Writes input from owner or viewer to the session
+func (s *Server) input(b []byte) {
+	s.inputMu.Lock()
+	defer s.inputMu.Unlock()
+	b = s.FlowControl.Input(b)
+	if len(b) == 0 {
+		return
+	}
+	// Keystrokes typed with echo off, such as passwords, are not recorded
+	echoOff := s.Terminal.IsEchoOff()
+	local := s.Charset.ToLocal(b)
+	if !echoOff {
+		s.Recorder.Input(s.Charset.InputToUTF8(local))
+	}
+	s.Audit.Input(b, echoOff)
+	s.Terminal.Write(local)
+}
+
+// Applies owner's window size, or the smallest of attached clients
+func (s *Server) resize() {
+	if s.ComPort != nil || !s.Terminal.IsStarted() {
+		return
+	}
+	s.viewersMu.Lock()
+	defer s.viewersMu.Unlock()
+	width, height := s.Terminal.Size()
+	for v := range s.viewers {
+		if v.Owner {
+			width, height = v.Terminal.Size()
+		}
+	}
+	if s.Config.AttachSize == "smallest" {
+		for v := range s.viewers {
+			w, h := v.Terminal.Size()
+			if w > 0 && w < width {
+				width = w
+			}
+			if h > 0 && h < height {
+				height = h
+			}
+		}
+	}
+	rows, cols, err := s.Terminal.GetSize()
+	if err != nil || (rows == int(height) && cols == int(width)) {
+		return
+	}
+	err = s.Terminal.Resize(width, height)
+	if err != nil {
+		return
+	}
+	s.Recorder.Resize(int(width), int(height))
+}
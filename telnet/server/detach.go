@@ -0,0 +1,258 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	cmd "telnet/command"
+	"telnet/connection"
+	opt "telnet/option"
+	"telnet/terminal"
+	"time"
+)
+
+// Interval for checking whether login succeeded
+const loginPollInterval = 500 * time.Millisecond
+
+// Ring buffer keeping the latest output of a detached session
+type Scrollback struct {
+	Size int
+	buf  []byte
+}
+
+func (r *Scrollback) Write(b []byte) {
+	r.buf = append(r.buf, b...)
+	if len(r.buf) > r.Size {
+		r.buf = append([]byte(nil), r.buf[len(r.buf)-r.Size:]...)
+	}
+}
+
+// Returns buffered output and empties the buffer
+func (r *Scrollback) Flush() []byte {
+	b := r.buf
+	r.buf = nil
+	return b
+}
+
+// Keeps the session running after disconnect until reattached or timed out
+func (s *Server) WaitReattach() {
+	user := s.LoginUser()
+	if len(user) == 0 {
+		// Not logged in
+		return
+	}
+	for {
+		// Login process may exit while the client was reattached
+		select {
+		case <-s.ptyDone:
+			return
+		case <-s.killed:
+			return
+		default:
+		}
+		s.detachMu.Lock()
+		s.detached = true
+		s.detachedAt = time.Now()
+		s.detachedUser = user
+		s.detachMu.Unlock()
+		log.Printf("Session %d: Detached, kept for %s", s.ID, s.Config.DetachTimeout)
+
+		timer := time.NewTimer(s.Config.DetachTimeout)
+		select {
+		case <-s.reattached:
+			timer.Stop()
+		case <-timer.C:
+			// A reattach may have won the race with the timer
+			s.detachMu.Lock()
+			if !s.detached {
+				s.detachMu.Unlock()
+				<-s.reattached
+				break
+			}
+			// Later reattach fails as the session is no longer detached
+			s.detached = false
+			s.detachMu.Unlock()
+			log.Printf("Session %d: Detach timed out", s.ID)
+			return
+		case <-s.ptyDone:
+			timer.Stop()
+			s.setDetached(false)
+			return
+		case <-s.killed:
+			timer.Stop()
+			s.setDetached(false)
+			return
+		}
+
+		// Detach again when the reattached client leaves
+		select {
+		case <-s.ownerLeft:
+		case <-s.ptyDone:
+			return
+		case <-s.killed:
+			return
+		}
+	}
+}
+
+func (s *Server) setDetached(detached bool) {
+	s.detachMu.Lock()
+	defer s.detachMu.Unlock()
+	s.detached = detached
+}
+
+// Returns a channel closed when the connection of the current owner ends
+func (s *Server) ownerDone() <-chan struct{} {
+	s.detachMu.Lock()
+	defer s.detachMu.Unlock()
+	return s.ownerClosed
+}
+
+func (s *Server) IsDetached() bool {
+	s.detachMu.Lock()
+	defer s.detachMu.Unlock()
+	return s.detached
+}
+
+// Takes over the client connection of another session as its owner
+func (s *Server) reattach(c connection.Connection) bool {
+	width, height := c.Terminal.Size()
+	v := new(Viewer)
+	v.Connection = c
+	v.Session = s
+	v.CanWrite = true
+	v.Owner = true
+	v.Terminal = terminal.New()
+	v.Terminal.SetSize(width, height)
+	v.Recorder = nil
+	v.ErrChan = make(chan error, 8)
+
+	s.detachMu.Lock()
+	if !s.detached {
+		s.detachMu.Unlock()
+		return false
+	}
+	s.detached = false
+	// Replay output missed while detached
+	v.WriteBytes(s.scrollback.Flush())
+	s.attach(v)
+	ownerClosed := make(chan struct{})
+	s.ownerClosed = ownerClosed
+	s.detachMu.Unlock()
+	s.reattached <- struct{}{}
+	log.Printf("Session %d: Reattached from %s", s.ID, c.Conn.RemoteAddr())
+
+	// Renegotiate window size
+	v.WriteBytes([]byte{cmd.IAC, cmd.DO, opt.NEGOTIATE_ABOUT_WINDOW_SIZE})
+	v.relay()
+	close(ownerClosed)
+	s.detach(v)
+	log.Printf("Session %d: Client Disconnected", s.ID)
+	s.ownerLeft <- struct{}{}
+	return true
+}
+
+// Offers detached sessions of the same user once login succeeded
+func (s *Server) OfferReattach() {
+	select {
+	case <-s.loggedIn:
+	case <-s.done:
+		return
+	}
+	user := s.LoginUser()
+	if len(user) == 0 {
+		return
+	}
+	sessions := s.Manager.Detached(user)
+	if len(sessions) == 0 {
+		return
+	}
+	menu := new(strings.Builder)
+	fmt.Fprintf(menu, "\r\nDetached sessions for %s:\r\n", user)
+	for _, detached := range sessions {
+		width, height := detached.Terminal.Size()
+		fmt.Fprintf(menu, "  %d  detached %s ago  %s %dx%d\r\n", detached.ID, time.Since(detached.detachedAt).Truncate(time.Second), detached.Terminal.Type, width, height)
+	}
+	menu.WriteString("Reattach session ID (Enter for new session): ")
+	s.offer.Store(sessions)
+	s.WriteBytes([]byte(menu.String()))
+}
+
+// Reads the answer to the reattach menu and returns true when input was consumed
+func (s *Server) chooseReattach(b []byte) bool {
+	sessions, _ := s.offer.Load().([]*Server)
+	if len(sessions) == 0 {
+		return false
+	}
+	for _, c := range b {
+		switch c {
+		case '\r', '\n':
+			s.offer.Store([]*Server(nil))
+			s.WriteBytes([]byte("\r\n"))
+			answer := strings.TrimSpace(string(s.choice))
+			s.choice = nil
+			id, err := strconv.Atoi(answer)
+			for _, detached := range sessions {
+				if err == nil && detached.ID == id && s.handOff(detached) {
+					return true
+				}
+			}
+			if len(answer) > 0 {
+				s.Notify("Cannot reattach session " + answer + ".")
+			}
+			// Redraw the prompt of the new session
+			s.Terminal.Write([]byte("\r"))
+			return true
+		case '\b', '\177':
+			if len(s.choice) > 0 {
+				s.choice = s.choice[:len(s.choice)-1]
+				s.WriteBytes([]byte("\b \b"))
+			}
+		case 0:
+		default:
+			s.choice = append(s.choice, c)
+			s.WriteBytes([]byte{c})
+		}
+	}
+	return true
+}
+
+// Ends this session and moves its client to a detached session
+func (s *Server) handOff(target *Server) bool {
+	if !target.IsDetached() {
+		return false
+	}
+	log.Printf("Session %d: Reattach to session %d", s.ID, target.ID)
+	atomic.StoreInt32(&s.handedOff, 1)
+	s.Manager.Remove(s)
+	// The reattached client is served from this goroutine, so hang up meanwhile
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.Hangup()
+	}()
+	if !target.reattach(s.Connection) {
+		s.Notify("Cannot reattach session " + strconv.Itoa(target.ID) + ".")
+	}
+	s.Conn.Close()
+	return true
+}
+
+func (s *Server) isHandedOff() bool {
+	return atomic.LoadInt32(&s.handedOff) == 1
+}
+
+// Returns detached sessions of user
+func (m *Manager) Detached(user string) []*Server {
+	var sessions []*Server
+	for _, s := range m.List() {
+		s.detachMu.Lock()
+		if s.detached && s.detachedUser == user {
+			sessions = append(sessions, s)
+		}
+		s.detachMu.Unlock()
+	}
+	return sessions
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"telnet/audit"
+	"time"
+)
+
+type Manager struct {
+	// Session Limits (0 means unlimited)
+	MaxSessions      int
+	MaxSessionsPerIP int
+	// Live Sessions
+	sessions map[int]*Server
+	nextID   int
+	draining bool
+	mu       sync.Mutex
+	// Closed when all sessions ended while draining
+	drained chan struct{}
+	// Shared input audit log (nil if disabled)
+	Audit *audit.Logger
+}
+
+type SessionInfo struct {
+	ID           int       `json:"id"`
+	RemoteAddr   string    `json:"remote_addr"`
+	StartTime    time.Time `json:"start_time"`
+	User         string    `json:"user"`
+	TerminalType string    `json:"terminal_type"`
+	Width        uint16    `json:"width"`
+	Height       uint16    `json:"height"`
+	Idle         float64   `json:"idle_seconds"`
+	Detached     bool      `json:"detached"`
+}
+
+func NewManager(maxSessions int, maxSessionsPerIP int) *Manager {
+	m := new(Manager)
+	m.MaxSessions = maxSessions
+	m.MaxSessionsPerIP = maxSessionsPerIP
+	m.sessions = map[int]*Server{}
+	m.drained = make(chan struct{})
+	return m
+}
+
+// Registers a session and assigns its ID if limits allow
+func (m *Manager) Add(s *Server) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.draining {
+		return fmt.Errorf("server is shutting down")
+	}
+	if m.MaxSessions > 0 && len(m.sessions) >= m.MaxSessions {
+		return fmt.Errorf("too many sessions")
+	}
+	if m.MaxSessionsPerIP > 0 {
+		ip := hostOf(s.Conn.RemoteAddr())
+		count := 0
+		for _, session := range m.sessions {
+			if hostOf(session.Conn.RemoteAddr()) == ip {
+				count++
+			}
+		}
+		if count >= m.MaxSessionsPerIP {
+			return fmt.Errorf("too many sessions from %s", ip)
+		}
+	}
+	m.nextID++
+	s.ID = m.nextID
+	s.StartTime = time.Now()
+	m.sessions[s.ID] = s
+	return nil
+}
+
+func (m *Manager) Remove(s *Server) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, s.ID)
+	if m.draining && len(m.sessions) == 0 {
+		select {
+		case <-m.drained:
+		default:
+			close(m.drained)
+		}
+	}
+}
+
+func (m *Manager) Get(id int) *Server {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sessions[id]
+}
+
+// Returns live sessions ordered by ID
+func (m *Manager) List() []*Server {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sessions := make([]*Server, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// Sends message to all sessions
+func (m *Manager) Broadcast(message string) {
+	for _, s := range m.List() {
+		s.Notify(message)
+	}
+}
+
+// Stops accepting new sessions while keeping live ones
+func (m *Manager) Drain() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.draining = true
+	if len(m.sessions) == 0 {
+		select {
+		case <-m.drained:
+		default:
+			close(m.drained)
+		}
+	}
+}
+
+// Closed when all sessions ended while draining
+func (m *Manager) Drained() <-chan struct{} {
+	return m.drained
+}
+
+func (m *Manager) IsDraining() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.draining
+}
+
+// Drains with notice and disconnects sessions left after timeout
+func (m *Manager) Shutdown(notice string, timeout time.Duration) {
+	m.Drain()
+	if len(notice) > 0 {
+		m.Broadcast(notice)
+	}
+	select {
+	case <-m.drained:
+		return
+	case <-time.After(timeout):
+	}
+	for _, s := range m.List() {
+		log.Printf("Session %d: Disconnect on shutdown", s.ID)
+		s.Kill()
+	}
+	<-m.drained
+}
+
+func (s *Server) Info() SessionInfo {
+	width, height := s.Terminal.Size()
+	return SessionInfo{
+		ID:           s.ID,
+		RemoteAddr:   s.Conn.RemoteAddr().String(),
+		StartTime:    s.StartTime,
+		User:         s.LoginUser(),
+		TerminalType: s.Terminal.Type,
+		Width:        width,
+		Height:       height,
+		Idle:         s.IdleTime().Seconds(),
+		Detached:     s.IsDetached(),
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"fmt"
+	"telnet/mud"
+	opt "telnet/option"
+)
+
+// Reports whether option is enabled on the client connection
+func (s *Server) IsEnabled(option byte) bool {
+	enableOptions, _ := s.options.Load().(map[byte]bool)
+	return enableOptions[option]
+}
+
+// Sends a GMCP message such as Char.Vitals {"hp": 10}, data is encoded as JSON
+func (s *Server) SendGMCP(pkg string, data interface{}) error {
+	if !s.IsEnabled(opt.GMCP) {
+		return fmt.Errorf("GMCP is not enabled by session %d", s.ID)
+	}
+	message, err := mud.BuildGMCP(pkg, data)
+	if err != nil {
+		return err
+	}
+	return s.WriteBytes(message)
+}
+
+// Sends MSDP variables
+func (s *Server) SendMSDP(variables mud.MSDP) error {
+	if !s.IsEnabled(opt.MSDP) {
+		return fmt.Errorf("MSDP is not enabled by session %d", s.ID)
+	}
+	return s.WriteBytes(mud.BuildMSDP(variables))
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Slices of paced output per second
+const paceSlices = 20
+
+// Turns output pacing on or off for this session
+func (s *Server) SetPacing(on bool) {
+	pacing := int32(0)
+	if on {
+		pacing = 1
+	}
+	atomic.StoreInt32(&s.pacing, pacing)
+}
+
+// Returns characters per second output is paced to, 0 if not paced
+func (s *Server) PaceRate() int {
+	if atomic.LoadInt32(&s.pacing) == 0 || s.Terminal == nil {
+		return 0
+	}
+	baud := s.Terminal.OutputSpeed()
+	if s.Config.PaceMaxBaud > 0 && (baud == 0 || baud > s.Config.PaceMaxBaud) {
+		baud = s.Config.PaceMaxBaud
+	}
+	return baud / s.Terminal.BitsPerChar()
+}
+
+// Broadcasts output in slices no faster than the paced rate, stopping between them on XOFF
+func (s *Server) pacedBroadcast(output []byte) {
+	for len(output) > 0 {
+		// Rate is checked for every slice, so pace off applies at once
+		cps := s.PaceRate()
+		if cps == 0 {
+			s.broadcast(output)
+			return
+		}
+		n := cps / paceSlices
+		if n < 1 {
+			n = 1
+		}
+		if n > len(output) {
+			n = len(output)
+		}
+		s.FlowControl.WaitResume()
+		s.broadcast(output[:n])
+		output = output[n:]
+
+		// Line is busy until the slice has been sent
+		now := time.Now()
+		if s.paceNext.Before(now) {
+			s.paceNext = now
+		}
+		s.paceNext = s.paceNext.Add(time.Duration(n) * time.Second / time.Duration(cps))
+		select {
+		case <-time.After(time.Until(s.paceNext)):
+		case <-s.ownerDone():
+			// Nobody is waiting for a detached session
+			s.broadcast(output)
+			return
+		}
+	}
+}
@@ -2,51 +2,312 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"telnet/audit"
+	"telnet/charset"
 	cmd "telnet/command"
+	"telnet/comport"
 	"telnet/connection"
+	"telnet/mud"
 	opt "telnet/option"
+	"telnet/record"
 	"telnet/terminal"
+	"telnet/ttype"
+	"time"
 )
 
 type Server struct {
 	connection.Connection
 	BufEchoMessage bytes.Buffer
+	Config         Config
+	Manager        *Manager
+	Audit          *audit.Session
+	// Session Info
+	ID         int
+	StartTime  time.Time
+	lastActive int64
+	// Copy of EnableOptions readable from other goroutines
+	options atomic.Value
+	// Closed when client disconnected
+	done chan struct{}
+	// Closed when TLS is established or skipped
+	secured chan struct{}
+	wg      sync.WaitGroup
+	// Attached clients
+	AttachKeys AttachKeys
+	viewers    map[*Viewer]bool
+	viewersMu  sync.Mutex
+	inputMu    sync.Mutex
+	nextViewer int
+	// Owner commands for sharing typed after ~ at the start of a line
+	shareState byte
+	shareArg   []byte
+	midLine    bool
+	// Closed when login succeeded, after loginUser is set
+	loggedIn  chan struct{}
+	loginUser string
+	// Detached session kept for reattach
+	detached     bool
+	detachedAt   time.Time
+	detachedUser string
+	scrollback   Scrollback
+	detachMu     sync.Mutex
+	reattached   chan struct{}
+	ownerLeft    chan struct{}
+	// Closed when the connection of the current owner ends
+	ownerClosed chan struct{}
+	// Closed when the login process exited
+	ptyDone chan struct{}
+	// Closed to end the session without keeping it detached
+	killed   chan struct{}
+	killOnce sync.Once
+	// Hangup runs once, on disconnect or when the client moves to another session
+	hangupOnce sync.Once
+	// Set when the client moved to a detached session
+	handedOff int32
+	offer     atomic.Value
+	choice    []byte
+	// Output pacing, switched per session by admin
+	pacing   int32
+	paceNext time.Time
 }
 
-func (s *Server) Handle(ln net.Listener) {
+type Config struct {
+	// Deadline for TERMINAL-TYPE negotiation before starting pty with defaults
+	NegotiationTimeout time.Duration
+	DefaultType        string
+	DefaultWidth       uint16
+	DefaultHeight      uint16
+	// Message sent to client when the login process exits
+	ExitMessage string
+	// Wait time between SIGHUP and SIGKILL after client disconnect
+	HangupTimeout time.Duration
+	// Session Limits (0 means unlimited)
+	MaxSessions      int
+	MaxSessionsPerIP int
+	// Disconnect after no input for IdleTimeout, warning IdleWarning before
+	IdleTimeout time.Duration
+	IdleWarning time.Duration
+	// Notice sent on SIGTERM and wait time for sessions to end
+	ShutdownNotice  string
+	ShutdownTimeout time.Duration
+	// Unix socket path for admin commands (empty to disable)
+	AdminSocket string
+	// Directory for asciicast session recordings (empty to disable)
+	RecordDir string
+	// JSON lines file for input audit log ("-" for stdout, empty to disable)
+	AuditLog string
+	// Serial device relayed with RFC 2217 COM port control instead of login (empty to disable)
+	Device string
+	// Port for clients attaching to live sessions (0 to disable)
+	AttachPort int
+	// Window size of shared sessions: "owner" or "smallest"
+	AttachSize string
+	// Users who may attach to any session besides its owner
+	AttachUsers []string
+	// Keep sessions after disconnect for reattach (0 to disable)
+	DetachTimeout time.Duration
+	// Bytes of output buffered while detached
+	Scrollback int
+	// Server certificate for TLS (nil to disable)
+	TLS *tls.Config
+	// Wrap connections in TLS before negotiation (telnets)
+	ImplicitTLS bool
+	// START_TLS mode: "offer" falls back to plaintext, "require" disconnects (empty to disable)
+	StartTLS string
+	// Charset of the pty, converted to the one agreed with CHARSET (empty to disable)
+	Charset string
+	// MUD extensions offered to clients
+	MCCP2 bool
+	GMCP  bool
+	MSDP  bool
+	// Called with GMCP and MSDP messages from client (nil to ignore)
+	OnGMCP func(s *Server, message mud.GMCP)
+	OnMSDP func(s *Server, variables mud.MSDP)
+	// Pace output to the TERMINAL-SPEED of the client
+	Pace bool
+	// Fastest baud rate paced to, also used without TERMINAL-SPEED (0 for no cap)
+	PaceMaxBaud int
+}
+
+// Wait time for pty output after the login process exits
+const drainTimeout = time.Second
+
+func (s *Server) Handle(ln net.Listener) error {
 	err := s.Accept(ln)
 	if err != nil {
-		s.ErrChan <- err
-		return
+		return err
+	}
+	s.Terminal = terminal.New()
+	s.Terminal.EnvChan = make(chan []string, 1)
+	s.Terminal.Type = s.Config.DefaultType
+	s.TermCycle = ttype.NewCycle()
+	s.Terminal.SetSize(s.Config.DefaultWidth, s.Config.DefaultHeight)
+	s.done = make(chan struct{})
+	s.secured = make(chan struct{})
+	s.ptyDone = make(chan struct{})
+	s.loggedIn = make(chan struct{})
+	s.killed = make(chan struct{})
+	s.reattached = make(chan struct{}, 1)
+	s.ownerLeft = make(chan struct{}, 1)
+	s.ownerClosed = s.done
+	s.scrollback.Size = s.Config.Scrollback
+	s.touch()
+	err = s.Manager.Add(s)
+	if err != nil {
+		log.Printf("Reject %s: %s", s.Conn.RemoteAddr(), err)
+		s.WriteBytes([]byte("Connection refused: " + err.Error() + "\r\n"))
+		s.Conn.Close()
+		return nil
+	}
+	log.Printf("Session %d: Client Connected from %s", s.ID, s.Conn.RemoteAddr())
+
+	// Open serial device
+	if len(s.Config.Device) > 0 {
+		err = s.Terminal.OpenDevice(s.Config.Device)
+		if err != nil {
+			log.Printf("Session %d: Error: %s", s.ID, err)
+			s.WriteBytes([]byte("Connection refused: " + err.Error() + "\r\n"))
+			s.Conn.Close()
+			s.Manager.Remove(s)
+			return nil
+		}
+		s.ComPort = comport.New(s.Terminal.StdFile)
+	}
+
+	// Charsets offered to client
+	if len(s.Config.Charset) > 0 {
+		s.Charset, err = charset.New(s.Config.Charset, charsetOffer(s.Config.Charset))
+		if err != nil {
+			log.Printf("Session %d: Error: %s", s.ID, err)
+		}
+	}
+
+	s.SetPacing(s.Config.Pace)
+
+	// XON/XOFF handled once the client turns it on
+	s.FlowControl = connection.NewFlowControl(false, false)
+
+	// MUD extensions
+	if s.Config.MCCP2 {
+		s.Compressor = new(connection.Compressor)
+	}
+	s.MUD = &mud.Handler{}
+	if s.Config.OnGMCP != nil {
+		s.MUD.GMCP = func(message mud.GMCP) {
+			s.Config.OnGMCP(s, message)
+		}
+	}
+	if s.Config.OnMSDP != nil {
+		s.MUD.MSDP = func(variables mud.MSDP) {
+			s.Config.OnMSDP(s, variables)
+		}
+	}
+
+	// Keys for attaching to this session
+	if s.Config.AttachPort > 0 {
+		s.AttachKeys, err = newAttachKeys()
+		if err != nil {
+			log.Printf("Session %d: Error: %s", s.ID, err)
+		}
+	}
+
+	// Audit input lines
+	s.Audit = s.Manager.Audit.Session(s.ID, s.Conn.RemoteAddr().String(), func() (string, string) {
+		return s.LoginUser(), s.Terminal.Type
+	})
+
+	// Record session
+	if len(s.Config.RecordDir) > 0 {
+		path := filepath.Join(s.Config.RecordDir, fmt.Sprintf("session-%d-%s.cast", s.ID, s.StartTime.Format("20060102-150405")))
+		s.Recorder, err = record.New(path)
+		if err != nil {
+			log.Printf("Session %d: Error: %s", s.ID, err)
+		}
 	}
-	log.Println("Client Connected")
+
+	// Logging errors
+	s.ErrChan = make(chan error, 8)
+	go func() {
+		for err := range s.ErrChan {
+			log.Printf("Session %d: Error: %s", s.ID, err)
+		}
+	}()
 
 	// Start pty
-	s.Terminal = terminal.New()
+	s.wg.Add(2)
 	go func() {
-		s.Terminal.EnvChan = make(chan []string)
-		defer close(s.Terminal.EnvChan)
-		for env := range s.Terminal.EnvChan {
-			err = s.Terminal.StartPty(env)
+		defer s.wg.Done()
+		defer close(s.ptyDone)
+		// No output before the connection is secured
+		select {
+		case <-s.secured:
+		case <-s.done:
+			return
+		}
+		if s.ComPort == nil {
+			env, ok := s.Negotiate()
+			if !ok {
+				return
+			}
+			err := s.Terminal.StartPty(env)
 			if err != nil {
 				s.ErrChan <- err
+				s.Conn.Close()
+				return
+			}
+			if bits := s.TermCycle.MTTS(); bits != 0 {
+				log.Printf("Session %d: MTTS %s", s.ID, strings.Join(ttype.Names(bits), ", "))
 			}
-			// Relay output from pty to client
-			s.ReadPty()
+			if remote := s.Charset.Remote(); len(remote) > 0 && remote != s.Charset.Local {
+				log.Printf("Session %d: Convert %s to %s", s.ID, s.Charset.Local, remote)
+			}
+		}
+		if len(s.AttachKeys.ReadOnly) > 0 {
+			go s.announceAttach()
+		}
+		s.Audit.Start()
+		width, height := s.Terminal.Size()
+		err := s.Recorder.Start(int(width), int(height), s.Terminal.Type)
+		if err != nil {
+			s.ErrChan <- err
 		}
+		if s.ComPort != nil {
+			s.RunDevice()
+			return
+		}
+		s.RunPty()
 	}()
 
 	// Read client message
 	go func() {
+		defer s.wg.Done()
 		defer s.Conn.Close()
 		defer s.Terminal.Close()
+		defer s.Hangup()
+		defer s.ComPort.Close()
+		defer s.FlowControl.Close()
+		defer close(s.done)
+
+		err := s.secure()
+		if err != nil {
+			s.ErrChan <- err
+			return
+		}
 
 		// Request TELNET Commands
 		err = s.ReqCmds(s.SupportOptions)
@@ -54,23 +315,234 @@ func (s *Server) Handle(ln net.Listener) {
 			s.ErrChan <- err
 			return
 		}
+		s.storeOptions()
 
 		// Relay input from client to pty
 		for {
 			byteMessage, err := s.ReadMessage()
-			if err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				log.Printf("Session %d: Client Disconnected", s.ID)
+				break
+			} else if err != nil {
 				s.ErrChan <- err
 				break
 			}
+			s.touch()
+			s.storeOptions()
+			if len(s.AttachKeys.ReadOnly) > 0 {
+				s.resize()
+			}
 			if byteMessage == nil {
 				continue
 			}
+			if s.chooseReattach(byteMessage) {
+				if s.isHandedOff() {
+					return
+				}
+				continue
+			}
+			byteMessage = s.ownerInput(byteMessage)
+			if len(byteMessage) == 0 {
+				continue
+			}
 			if !s.EnableOptions[opt.ECHO] {
 				s.BufEchoMessage.Write(byteMessage)
 			}
-			s.Terminal.Write(byteMessage)
+			s.input(byteMessage)
+		}
+
+		// Keep session for reattach
+		if s.Config.DetachTimeout > 0 {
+			s.WaitReattach()
 		}
 	}()
+
+	// Watch for login to share or keep the session
+	go s.watchLogin()
+
+	// Offer detached sessions after login
+	if s.Config.DetachTimeout > 0 {
+		go s.OfferReattach()
+	}
+
+	// Disconnect idle session
+	if s.Config.IdleTimeout > 0 {
+		go s.WatchIdle()
+	}
+
+	// Unregister after all goroutines end
+	go func() {
+		s.wg.Wait()
+		close(s.ErrChan)
+		s.Manager.Remove(s)
+		s.detachAll()
+		s.Recorder.Close()
+		s.Audit.End()
+		log.Printf("Session %d: Ended after %s", s.ID, time.Since(s.StartTime).Round(time.Second))
+	}()
+	return nil
+}
+
+// Records client activity for idle timeout
+func (s *Server) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *Server) IdleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActive)))
+}
+
+func (s *Server) WatchIdle() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	warned := false
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		if s.IsDetached() {
+			s.touch()
+			warned = false
+			continue
+		}
+		idle := s.IdleTime()
+		if idle >= s.Config.IdleTimeout {
+			log.Printf("Session %d: Idle timeout", s.ID)
+			s.Notify("Idle timeout, disconnecting.")
+			s.Disconnect()
+			s.touch()
+			continue
+		}
+		if idle < s.Config.IdleTimeout-s.Config.IdleWarning {
+			warned = false
+		} else if !warned && s.Config.IdleWarning > 0 {
+			s.Notify(fmt.Sprintf("Idle for %s, disconnecting in %s.", idle.Truncate(time.Second), (s.Config.IdleTimeout - idle).Round(time.Second)))
+			warned = true
+		}
+	}
+}
+
+// Writes a message to client on its own line
+func (s *Server) Notify(message string) error {
+	b := []byte("\r\n" + message + "\r\n")
+	if v := s.owner(); v != nil {
+		return v.WriteBytes(b)
+	}
+	return s.WriteBytes(b)
+}
+
+// Closes the client connection, which detaches the session if enabled
+func (s *Server) Disconnect() {
+	s.Conn.Close()
+	if v := s.owner(); v != nil {
+		v.Conn.Close()
+	}
+}
+
+// Closes the client connection and ends the session
+func (s *Server) Kill() {
+	s.killOnce.Do(func() {
+		close(s.killed)
+	})
+	s.Disconnect()
+}
+
+// Waits for terminal type from client until negotiation timeout
+func (s *Server) Negotiate() ([]string, bool) {
+	timer := time.NewTimer(s.Config.NegotiationTimeout)
+	defer timer.Stop()
+	select {
+	case env := <-s.Terminal.EnvChan:
+		return env, true
+	case <-timer.C:
+		log.Printf("Session %d: Negotiation timed out, start with %s", s.ID, s.Terminal.Type)
+		s.Terminal.SetType(s.Terminal.Type)
+		return <-s.Terminal.EnvChan, true
+	case <-s.done:
+		return nil, false
+	}
+}
+
+// Runs implicit TLS handshake or START_TLS before negotiation as configured
+func (s *Server) secure() error {
+	defer close(s.secured)
+	tlsConn, implicit := s.Conn.(*tls.Conn)
+	if !implicit && len(s.Config.StartTLS) == 0 {
+		return nil
+	}
+	s.Conn.SetDeadline(time.Now().Add(s.Config.NegotiationTimeout))
+	defer s.Conn.SetDeadline(time.Time{})
+	var err error
+	if implicit {
+		err = tlsConn.Handshake()
+	} else {
+		err = s.StartTLS(s.Config.TLS)
+		tlsConn, _ = s.Conn.(*tls.Conn)
+	}
+	if err == connection.ErrStartTLSRefused && s.Config.StartTLS == "offer" {
+		log.Printf("Session %d: START_TLS refused, continue in plaintext", s.ID)
+		return nil
+	} else if err == connection.ErrStartTLSRefused {
+		s.WriteBytes([]byte("Connection refused: START_TLS is required\r\n"))
+		return err
+	} else if err != nil {
+		return err
+	}
+	log.Printf("Session %d: TLS established with %s", s.ID, tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite))
+	return nil
+}
+
+// Relays pty output until the login process exits, then closes the connection
+func (s *Server) RunPty() {
+	relayDone := make(chan struct{})
+	go func() {
+		defer close(relayDone)
+		s.ReadPty()
+	}()
+
+	// Reap child process
+	state, err := s.Terminal.Wait()
+	if err != nil {
+		s.ErrChan <- err
+	} else {
+		log.Printf("Session %d: Process exited: %s", s.ID, state)
+	}
+
+	// Flush remaining output before closing
+	select {
+	case <-relayDone:
+	case <-time.After(drainTimeout):
+	}
+	s.Terminal.Close()
+	<-relayDone
+	// Client moved to another session
+	if s.isHandedOff() {
+		return
+	}
+	if len(s.Config.ExitMessage) > 0 {
+		s.Notify(s.Config.ExitMessage)
+	}
+	s.Disconnect()
+}
+
+// Relays serial device output until the client disconnects
+func (s *Server) RunDevice() {
+	go s.ComPort.Watch(s.done, s.WriteBytes)
+	s.ReadPty()
+	s.Conn.Close()
+}
+
+// Hangs up the session's process group after client disconnect, called
+// only from goroutines in s.wg so that ErrChan is still open
+func (s *Server) Hangup() {
+	s.hangupOnce.Do(func() {
+		err := s.Terminal.Hangup(s.Config.HangupTimeout)
+		if err != nil {
+			s.ErrChan <- err
+		}
+	})
 }
 
 func (s *Server) ReadPty() {
@@ -78,9 +550,11 @@ func (s *Server) ReadPty() {
 	byteResult := make([]byte, 4096)
 	for {
 		n, err := s.Terminal.Read(byteResult)
-		if err != nil {
+		// EIO is returned after all processes close the tty
+		if errors.Is(err, syscall.EIO) || errors.Is(err, os.ErrClosed) {
+			return
+		} else if err != nil {
 			s.ErrChan <- err
-			s.Conn.Close()
 			return
 		}
 		// Exclude client input if echo option is not enabled
@@ -96,7 +570,6 @@ func (s *Server) ReadPty() {
 					break
 				} else if err != nil {
 					s.ErrChan <- err
-					s.Conn.Close()
 					return
 				}
 				if strings.Contains("\r\n", string(b)) && strings.Contains("\r\n", string(byteResult[i])) {
@@ -109,11 +582,28 @@ func (s *Server) ReadPty() {
 			s.BufEchoMessage.Reset()
 		}
 		if startIndex < n {
-			s.WriteBytes(byteResult[startIndex:n])
+			s.ComPort.WaitResume()
+			s.FlowControl.WaitResume()
+			// Recordings hold the pty output as UTF-8, not the client's charset
+			s.Recorder.Output(s.Charset.OutputToUTF8(byteResult[startIndex:n]))
+			output := s.Charset.ToRemote(byteResult[startIndex:n])
+			if len(output) == 0 {
+				continue
+			}
+			s.pacedBroadcast(output)
 		}
 	}
 }
 
+// Charsets offered in REQUEST: UTF-8 first, then the pty charset
+func charsetOffer(local string) []string {
+	_, canonical, err := charset.Lookup(local)
+	if err != nil || canonical == "UTF-8" {
+		return []string{"UTF-8"}
+	}
+	return []string{"UTF-8", canonical}
+}
+
 func New(ip string, port int, supportOptions []byte) *Server {
 	s := new(Server)
 	s.IsServer = true
@@ -126,30 +616,111 @@ func New(ip string, port int, supportOptions []byte) *Server {
 	return s
 }
 
-func Run(ip string, port int) {
+func Run(ip string, port int, config Config) {
 	// Listen TCP
 	ln, err := net.Listen("tcp", ip+":"+strconv.Itoa(port))
 	if err != nil {
 		log.Fatal("Error:", err)
 	}
 	defer ln.Close()
+	if config.ImplicitTLS {
+		ln = tls.NewListener(ln, config.TLS)
+	}
 	fmt.Printf("Listen on %s:%d...\n", ip, port)
+	Serve(ln, config)
+}
 
-	// Logging errors
-	errChan := make(chan error, 2)
-	defer close(errChan)
+// Handles connections from listener until shutdown
+func Serve(ln net.Listener, config Config) {
+	var err error
+	ip, port := "", 0
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		ip, port = addr.IP.String(), addr.Port
+	}
+
+	// Serial device allows one session at a time
+	if len(config.Device) > 0 {
+		config.MaxSessions = 1
+	}
+
+	// Session manager
+	m := NewManager(config.MaxSessions, config.MaxSessionsPerIP)
+	if len(config.AuditLog) > 0 {
+		m.Audit, err = audit.New(config.AuditLog)
+		if err != nil {
+			log.Fatal("Error:", err)
+		}
+		defer m.Audit.Close()
+	}
+
+	// Admin socket
+	if len(config.AdminSocket) > 0 {
+		err = m.ServeAdmin(config.AdminSocket)
+		if err != nil {
+			log.Fatal("Error:", err)
+		}
+		defer os.Remove(config.AdminSocket)
+	}
+
+	// Attach listener
+	var attachLn net.Listener
+	if config.AttachPort > 0 {
+		attachLn, err = m.ListenAttach(ip, config.AttachPort, config)
+		if err != nil {
+			log.Fatal("Error:", err)
+		}
+		defer attachLn.Close()
+	}
+
+	// Graceful shutdown
+	shutdownDone := make(chan struct{})
 	go func() {
-		for err := range errChan {
-			log.Println("Error:", err)
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, syscall.SIGTERM)
+		select {
+		case <-signalChan:
+			log.Println("Shutting down...")
+		case <-m.Drained():
+			log.Println("Drained, shutting down...")
 		}
+		ln.Close()
+		if attachLn != nil {
+			attachLn.Close()
+		}
+		m.Shutdown(config.ShutdownNotice, config.ShutdownTimeout)
+		close(shutdownDone)
 	}()
 
 	// Handle connections
-	supportOptions := []byte{opt.ECHO, opt.SUPPRESS_GO_AHEAD, opt.TERMINAL_TYPE, opt.NEGOTIATE_ABOUT_WINDOW_SIZE, opt.TERMINAL_SPEED}
+	supportOptions := []byte{opt.ECHO, opt.SUPPRESS_GO_AHEAD, opt.TERMINAL_TYPE, opt.NEGOTIATE_ABOUT_WINDOW_SIZE, opt.TERMINAL_SPEED, opt.LFLOW}
+	if len(config.Device) > 0 {
+		supportOptions = append(supportOptions, opt.COM_PORT_OPTION)
+	}
+	if len(config.Charset) > 0 {
+		supportOptions = append(supportOptions, opt.CHARSET)
+	}
+	if config.MCCP2 {
+		supportOptions = append(supportOptions, opt.MCCP2)
+	}
+	if config.GMCP {
+		supportOptions = append(supportOptions, opt.GMCP)
+	}
+	if config.MSDP {
+		supportOptions = append(supportOptions, opt.MSDP)
+	}
 	for {
 		s := New(ip, port, supportOptions)
-		s.ErrChan = errChan
-		s.Handle(ln)
+		s.Config = config
+		s.Manager = m
+		err := s.Handle(ln)
+		if errors.Is(err, net.ErrClosed) {
+			break
+		} else if err != nil {
+			log.Println("Error:", err)
+		}
+	}
+	if m.IsDraining() {
+		<-shutdownDone
 	}
 }
 
@@ -172,18 +743,32 @@ func BuildCmdRes(c connection.Connection, mainCmd byte, subCmd byte, options ...
 				if options[0] != IS {
 					break
 				}
-				if c.Terminal.StdFile != nil {
-					return nil, fmt.Errorf("pty already opened")
+				// Ignore late answer after negotiation timeout
+				if c.Terminal.IsStarted() {
+					break
+				}
+				if c.TermCycle == nil {
+					c.Terminal.SetType(strings.ToLower(string(options[1:])))
+					break
+				}
+				// Ask for the next type until one is in terminfo
+				chosen, more := c.TermCycle.Receive(string(options[1:]))
+				if more {
+					SEND := byte(1)
+					_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.SB, opt.TERMINAL_TYPE, SEND, cmd.IAC, cmd.SE})
+				} else if len(chosen) > 0 {
+					c.Terminal.SetType(chosen)
 				}
-				c.Terminal.SetType(strings.ToLower(string(options[1:])))
 			case opt.NEGOTIATE_ABOUT_WINDOW_SIZE:
 				if len(options) != 4 {
 					break
 				}
-				err := c.Terminal.SetSize(binary.BigEndian.Uint16(options[0:2]), binary.BigEndian.Uint16(options[2:4]))
+				width, height := binary.BigEndian.Uint16(options[0:2]), binary.BigEndian.Uint16(options[2:4])
+				err := c.Terminal.SetSize(width, height)
 				if err != nil {
 					return nil, err
 				}
+				c.Recorder.Resize(int(width), int(height))
 			case opt.TERMINAL_SPEED:
 				IS := byte(0)
 				if options[0] != IS {
@@ -193,6 +778,21 @@ func BuildCmdRes(c connection.Connection, mainCmd byte, subCmd byte, options ...
 				ospeed, _ := strconv.Atoi(speeds[0])
 				ispeed, _ := strconv.Atoi(speeds[1])
 				c.Terminal.SetSpeed(ospeed, ispeed)
+			case opt.COM_PORT_OPTION:
+				res, err := c.ComPort.Handle(options)
+				if err != nil {
+					// Report current settings even if the device rejected the change
+					c.ErrChan <- err
+				}
+				bufCmdsRes.Write(res)
+			case opt.CHARSET:
+				bufCmdsRes.Write(c.Charset.Handle(options))
+			case opt.GMCP, opt.MSDP:
+				c.MUD.Handle(subCmd, options)
+			case opt.LFLOW:
+				// XON and XOFF are taken out of the input, not left to the pty
+				c.FlowControl.Handle(options)
+				c.Terminal.DisableFlowControl()
 			}
 		}
 
@@ -212,14 +812,18 @@ func BuildCmdRes(c connection.Connection, mainCmd byte, subCmd byte, options ...
 		}
 		if !c.EnableOptions[subCmd] {
 			_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.DO, subCmd})
-			nextStatus = true
 		}
 		switch subCmd {
 		case opt.TERMINAL_TYPE, opt.TERMINAL_SPEED:
 			SEND := byte(1)
 			_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.SB, subCmd, SEND})
 			_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.SE})
+		case opt.CHARSET:
+			_, err = bufCmdsRes.Write(c.Charset.Request())
 		}
+		// Acknowledge of our DO also enables the option
+		c.EnableOptions[subCmd] = true
+		return bufCmdsRes.Bytes(), err
 	case cmd.WONT:
 		if subCmd == opt.ECHO {
 			_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.WILL, opt.ECHO})
@@ -229,21 +833,35 @@ func BuildCmdRes(c connection.Connection, mainCmd byte, subCmd byte, options ...
 		nextStatus = false
 		switch subCmd {
 		case opt.TERMINAL_TYPE:
-			if c.Terminal.StdFile != nil {
-				return nil, fmt.Errorf("pty already opened")
+			if c.Terminal.IsStarted() {
+				break
 			}
-			c.Terminal.SetType("vt100")
+			// Start with default type
+			c.Terminal.SetType(c.Terminal.Type)
 		}
 	case cmd.DO:
 		if !c.IsSupportOption(subCmd) {
 			_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.WONT, subCmd})
 			nextStatus = false
 			break
+		} else if subCmd == opt.MCCP2 {
+			if !c.EnableOptions[subCmd] {
+				_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.WILL, subCmd})
+			}
+			// Output is compressed right after this subnegotiation
+			_, err = bufCmdsRes.Write(c.Compressor.Begin())
+			c.EnableOptions[subCmd] = true
+			return bufCmdsRes.Bytes(), err
 		} else if subCmd != opt.ECHO {
 			_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.WILL, subCmd})
 		}
 		nextStatus = true
 	case cmd.DONT:
+		if subCmd == opt.MCCP2 {
+			if err := c.Compressor.End(); err != nil {
+				c.ErrChan <- err
+			}
+		}
 		_, err = bufCmdsRes.Write([]byte{cmd.IAC, cmd.DONT, subCmd})
 		nextStatus = false
 	}
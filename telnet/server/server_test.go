@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	cmd "telnet/command"
+	"telnet/connection"
+	opt "telnet/option"
+	"testing"
+	"time"
+)
+
+// A client that never answers negotiation gets a pty with the default type
+func TestNegotiationTimeout(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("login requires root")
+	}
+	if _, err := exec.LookPath("login"); err != nil {
+		t.Skip("login not found")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := New("127.0.0.1", 0, []byte{opt.ECHO, opt.SUPPRESS_GO_AHEAD, opt.TERMINAL_TYPE, opt.NEGOTIATE_ABOUT_WINDOW_SIZE})
+	s.Config = Config{
+		NegotiationTimeout: 500 * time.Millisecond,
+		DefaultType:        "vt100",
+		DefaultWidth:       80,
+		DefaultHeight:      24,
+		HangupTimeout:      time.Second,
+	}
+	s.Manager = NewManager(0, 0)
+	start := time.Now()
+	err = s.Handle(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read output without answering until the login prompt
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	output := []byte{}
+	buf := make([]byte, 1024)
+	for !bytes.Contains(output, []byte("login:")) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("no login prompt: %s: %q", err, output)
+		}
+		output = append(output, buf[:n]...)
+	}
+	if elapsed := time.Since(start); elapsed < s.Config.NegotiationTimeout {
+		t.Errorf("pty started after %s, before negotiation timeout", elapsed)
+	}
+	if s.Terminal.Type != "vt100" {
+		t.Errorf("terminal type %q, want vt100", s.Terminal.Type)
+	}
+	if width, height := s.Terminal.Size(); width != 80 || height != 24 {
+		t.Errorf("window size %dx%d, want 80x24", width, height)
+	}
+
+	// Session ends after the client disconnects
+	conn.Close()
+	ended := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end after disconnect")
+	}
+}
+
+// A WILL answering our DO leaves the option enabled without another DO
+func TestWillAnswersDo(t *testing.T) {
+	c := connection.Connection{
+		IsServer:       true,
+		SupportOptions: []byte{opt.SUPPRESS_GO_AHEAD, opt.NEGOTIATE_ABOUT_WINDOW_SIZE},
+		EnableOptions:  map[byte]bool{opt.NEGOTIATE_ABOUT_WINDOW_SIZE: true},
+	}
+	res, err := BuildCmdRes(c, cmd.WILL, opt.NEGOTIATE_ABOUT_WINDOW_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Errorf("reply % x to WILL answering our DO, want none", res)
+	}
+	if !c.EnableOptions[opt.NEGOTIATE_ABOUT_WINDOW_SIZE] {
+		t.Error("NAWS disabled after WILL answered our DO")
+	}
+
+	// Unrequested offer is accepted with DO
+	res, err = BuildCmdRes(c, cmd.WILL, opt.SUPPRESS_GO_AHEAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(res, []byte{cmd.IAC, cmd.DO, opt.SUPPRESS_GO_AHEAD}) {
+		t.Errorf("reply % x to WILL SGA, want IAC DO SGA", res)
+	}
+	if !c.EnableOptions[opt.SUPPRESS_GO_AHEAD] {
+		t.Error("SGA not enabled after WILL")
+	}
+}
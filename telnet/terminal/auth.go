@@ -0,0 +1,86 @@
+package terminal
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/term/termios"
+	"golang.org/x/sys/unix"
+)
+
+// Unprivileged user running su, so that su asks for the password
+const nobody = 65534
+
+// Interval to check whether su turned echo off to read the password
+const authPoll = 10 * time.Millisecond
+
+// Checks the password of a local user with su on a pty, as login would
+func Authenticate(username string, password string, timeout time.Duration) (bool, error) {
+	if len(username) == 0 || strings.HasPrefix(username, "-") || strings.ContainsAny(username, "\x00\r\n") {
+		return false, nil
+	}
+	pty, tty, err := termios.Pty()
+	if err != nil {
+		return false, err
+	}
+	defer pty.Close()
+	cmd := exec.Command("su", "-c", "true", "--", username)
+	cmd.Env = []string{"PATH=/usr/bin:/bin:/usr/sbin:/sbin"}
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:     true,
+		Setctty:    true,
+		Credential: &syscall.Credential{Uid: nobody, Gid: nobody},
+	}
+	err = cmd.Start()
+	tty.Close()
+	if err != nil {
+		return false, err
+	}
+	go io.Copy(io.Discard, pty)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	// Password typed before su turns echo off would be flushed
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(authPoll)
+	defer ticker.Stop()
+	for typed := false; ; {
+		select {
+		case err := <-exited:
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return false, nil
+			}
+			return err == nil && typed, err
+		case <-timer.C:
+			cmd.Process.Kill()
+			<-exited
+			return false, errors.New("authentication timed out")
+		case <-ticker.C:
+		}
+		if typed {
+			continue
+		}
+		var attr unix.Termios
+		if termios.Tcgetattr(pty.Fd(), &attr) != nil || attr.Lflag&unix.ECHO != 0 {
+			continue
+		}
+		_, err := pty.Write([]byte(password + "\n"))
+		if err != nil {
+			cmd.Process.Kill()
+			<-exited
+			return false, err
+		}
+		typed = true
+	}
+}
@@ -2,11 +2,17 @@ package terminal
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
+	"os/user"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/pkg/term/termios"
 	"golang.org/x/sys/unix"
@@ -24,8 +30,16 @@ type Terminal struct {
 	// Baud Rate
 	ispeed int
 	ospeed int
+	// XON/XOFF left to the caller, kept until started
+	noFlow bool
 	// StdFile Reader
 	reader *bufio.Reader
+	// Serial device opened instead of pty
+	device bool
+	// Child Process
+	cmd    *exec.Cmd
+	closed bool
+	mu     sync.Mutex
 }
 
 func New() *Terminal {
@@ -49,7 +63,59 @@ func (t *Terminal) OpenTty() error {
 	return nil
 }
 
+// Opens a tty device in raw mode to relay instead of starting login
+func (t *Terminal) OpenDevice(path string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return fmt.Errorf("terminal already closed")
+	}
+	if t.StdFile != nil {
+		return fmt.Errorf("device already opened")
+	}
+	// Nonblocking fd lets Close interrupt a pending Read
+	file, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	raw, err := file.SyscallConn()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	var attrErr error
+	err = raw.Control(func(fd uintptr) {
+		attrErr = termios.Tcgetattr(fd, &t.Termios)
+		if attrErr != nil {
+			return
+		}
+		t.backupTermios = t.Termios
+		termios.Cfmakeraw(&t.Termios)
+		t.Termios.Cflag |= unix.CREAD | unix.CLOCAL
+		attrErr = termios.Tcsetattr(fd, termios.TCSANOW, &t.Termios)
+	})
+	if err == nil {
+		err = attrErr
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	t.StdFile = file
+	t.reader = bufio.NewReader(t.StdFile)
+	t.device = true
+	return nil
+}
+
 func (t *Terminal) StartPty(env []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return fmt.Errorf("terminal already closed")
+	}
+	if t.cmd != nil {
+		return fmt.Errorf("pty already opened")
+	}
 	// Set OS command for login
 	cmd := exec.Command("login")
 	cmd.Env = env
@@ -71,15 +137,71 @@ func (t *Terminal) StartPty(env []string) error {
 	t.reader = bufio.NewReader(t.StdFile)
 	termios.Tcgetattr(t.StdFile.Fd(), &t.Termios)
 	if t.width > 0 && t.height > 0 {
-		t.setsize()
+		t.setsize(t.width, t.height)
 	}
 	if t.ospeed > 0 && t.ispeed > 0 {
 		t.setspeed()
 	}
+	if t.noFlow {
+		t.setflow()
+	}
 
 	err = cmd.Start()
 	if err != nil {
 		pty.Close()
+		t.StdFile = nil
+		t.reader = nil
+		return err
+	}
+	t.cmd = cmd
+	return nil
+}
+
+// Reaps the child process started by StartPty
+func (t *Terminal) Wait() (*os.ProcessState, error) {
+	if t.cmd == nil {
+		return nil, fmt.Errorf("Not started process in Terminal")
+	}
+	err := t.cmd.Wait()
+	if _, ok := err.(*exec.ExitError); ok {
+		err = nil
+	}
+	return t.cmd.ProcessState, err
+}
+
+// Interval to check whether the process group has gone after SIGHUP
+const hangupPoll = 50 * time.Millisecond
+
+// Sends SIGHUP to the process group, then SIGKILL to members left after timeout
+func (t *Terminal) Hangup(timeout time.Duration) error {
+	t.mu.Lock()
+	cmd := t.cmd
+	t.mu.Unlock()
+	if cmd == nil {
+		return nil
+	}
+	// Setsid makes the child the leader of its own process group, which
+	// stays signalable while any member is left even after the leader exited
+	pgid := cmd.Process.Pid
+	err := killGroup(pgid, syscall.SIGHUP)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if syscall.Kill(-pgid, 0) == syscall.ESRCH {
+			return nil
+		}
+		time.Sleep(hangupPoll)
+	}
+	return killGroup(pgid, syscall.SIGKILL)
+}
+
+// Signals the process group, ignoring one with no members left
+func killGroup(pgid int, sig syscall.Signal) error {
+	err := syscall.Kill(-pgid, sig)
+	if err == syscall.ESRCH {
+		return nil
 	}
 	return err
 }
@@ -95,10 +217,93 @@ func (t *Terminal) setRawMode() {
 
 func (t *Terminal) SetType(terminalType string) {
 	t.Type = terminalType
-	t.EnvChan <- append(os.Environ(), "TERM="+terminalType)
+	// Only the first type is used to start pty
+	select {
+	case t.EnvChan <- append(os.Environ(), "TERM="+terminalType):
+	default:
+	}
+}
+
+func (t *Terminal) IsStarted() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cmd != nil
+}
+
+// Returns the user who logged in once login started a shell
+// The shell is the child of login, su or sudo run from it do not change the user
+func (t *Terminal) User() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cmd == nil || t.closed {
+		return ""
+	}
+	pid := t.cmd.Process.Pid
+	pgrp, err := unix.IoctlGetInt(int(t.StdFile.Fd()), unix.TIOCGPGRP)
+	if err != nil || pgrp == pid {
+		return ""
+	}
+	shell := childOf(pid)
+	if shell == 0 {
+		return ""
+	}
+	info, err := os.Stat("/proc/" + strconv.Itoa(shell))
+	if err != nil {
+		return ""
+	}
+	uid := strconv.Itoa(int(info.Sys().(*syscall.Stat_t).Uid))
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return uid
+	}
+	return u.Username
+}
+
+// Returns a child process of pid, 0 if there is none
+func childOf(pid int) int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// Fields after the command name in parentheses: state ppid
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) > 1 && fields[1] == strconv.Itoa(pid) {
+			return child
+		}
+	}
+	return 0
+}
+
+// Reports whether the program on pty reads a line without echo, as for passwords
+// Line editors such as readline turn off ICANON too and echo input themselves
+func (t *Terminal) IsEchoOff() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cmd == nil || t.closed {
+		return false
+	}
+	var attr unix.Termios
+	err := termios.Tcgetattr(t.StdFile.Fd(), &attr)
+	if err != nil {
+		return false
+	}
+	return attr.Lflag&unix.ECHO == 0 && attr.Lflag&unix.ICANON != 0
 }
 
 func (t *Terminal) GetSize() (height int, width int, err error) {
+	// Size reported by peer if no tty is opened
+	if t.StdFile == nil {
+		return int(t.height), int(t.width), nil
+	}
 	ws, err := unix.IoctlGetWinsize(int(t.StdFile.Fd()), unix.TIOCGWINSZ)
 	if err != nil {
 		return 0, 0, err
@@ -106,19 +311,31 @@ func (t *Terminal) GetSize() (height int, width int, err error) {
 	return int(ws.Row), int(ws.Col), nil
 }
 
+// Returns window size requested by client
+func (t *Terminal) Size() (width uint16, height uint16) {
+	return t.width, t.height
+}
+
 func (t *Terminal) SetSize(width uint16, height uint16) error {
 	t.width = width
 	t.height = height
-	return t.setsize()
+	return t.setsize(width, height)
 }
 
-func (t *Terminal) setsize() error {
-	if t.StdFile == nil {
+// Sets pty window size without changing the size requested by client
+func (t *Terminal) Resize(width uint16, height uint16) error {
+	return t.setsize(width, height)
+}
+
+func (t *Terminal) setsize(width uint16, height uint16) error {
+	// Window size does not apply to serial devices
+	if t.StdFile == nil || t.device {
 		return nil
 	}
+	// The kernel signals SIGWINCH to the foreground job when the size changes
 	err := unix.IoctlSetWinsize(int(t.StdFile.Fd()), unix.TIOCSWINSZ, &unix.Winsize{
-		Row: t.height,
-		Col: t.width,
+		Row: height,
+		Col: width,
 	})
 	return err
 }
@@ -130,19 +347,70 @@ func (t *Terminal) SetSpeed(ospeed int, ispeed int) {
 }
 
 func (t *Terminal) setspeed() {
-	if t.StdFile == nil {
+	// Serial device speed is set by COM-PORT-OPTION
+	if t.StdFile == nil || t.device {
 		return
 	}
 	// To support both 32bit and 64bit
 	ospeedRv := reflect.ValueOf(&t.Termios.Ospeed)
 	ispeedRv := reflect.ValueOf(&t.Termios.Ispeed)
-	ospeedRv.Elem().SetUint(uint64(t.ispeed))
+	ospeedRv.Elem().SetUint(uint64(t.ospeed))
 	ispeedRv.Elem().SetUint(uint64(t.ispeed))
 	// Set new termios to StdFile
 	termios.Tcsetattr(t.StdFile.Fd(), termios.TCSANOW, &t.Termios)
 }
 
+// Returns output speed from TERMINAL-SPEED, 0 if not negotiated
+func (t *Terminal) OutputSpeed() int {
+	return t.ospeed
+}
+
+// Returns bits sent per character: start, data, parity and stop bits of the current termios
+func (t *Terminal) BitsPerChar() int {
+	current := t.Termios
+	if t.StdFile != nil {
+		termios.Tcgetattr(t.StdFile.Fd(), &current)
+	}
+	bits := 1 + 8
+	switch current.Cflag & unix.CSIZE {
+	case unix.CS5:
+		bits = 1 + 5
+	case unix.CS6:
+		bits = 1 + 6
+	case unix.CS7:
+		bits = 1 + 7
+	}
+	if current.Cflag&unix.PARENB != 0 {
+		bits++
+	}
+	if current.Cflag&unix.CSTOPB != 0 {
+		return bits + 2
+	}
+	return bits + 1
+}
+
+// Turns IXON and IXANY off so that Ctrl-S and Ctrl-Q are read as input, on the pty when started
+func (t *Terminal) DisableFlowControl() {
+	t.noFlow = true
+	t.setflow()
+}
+
+func (t *Terminal) setflow() {
+	// Serial device flow control is set by COM-PORT-OPTION
+	if t.StdFile == nil || t.device {
+		return
+	}
+	t.Termios.Iflag &^= unix.IXON | unix.IXANY
+	termios.Tcsetattr(t.StdFile.Fd(), termios.TCSANOW, &t.Termios)
+}
+
 func (t *Terminal) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
 	if t.StdFile != nil {
 		termios.Tcsetattr(t.StdFile.Fd(), termios.TCSANOW, &t.backupTermios)
 		return t.StdFile.Close()
@@ -157,6 +425,13 @@ func (t *Terminal) Read(p []byte) (n int, err error) {
 	return t.reader.Read(p)
 }
 
+func (t *Terminal) ReadByte() (byte, error) {
+	if t.reader == nil {
+		return 0, fmt.Errorf("Not set bufio.Reader in Terminal")
+	}
+	return t.reader.ReadByte()
+}
+
 func (t *Terminal) ReadRune() (r rune, size int, err error) {
 	if t.reader == nil {
 		return 0, 0, fmt.Errorf("Not set bufio.Reader in Terminal")
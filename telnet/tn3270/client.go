@@ -0,0 +1,310 @@
+package tn3270
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"telnet/connection"
+	"telnet/proxy"
+	"telnet/terminal"
+	"time"
+	"unicode/utf8"
+)
+
+type Config struct {
+	// Type sent in TERMINAL-TYPE and DEVICE-TYPE, -E suffix to request TN3270E
+	TerminalType string
+	// LU requested with TN3270E CONNECT (empty for any)
+	LU string
+	// Proxy URL for socks5:// or http:// (empty to use ALL_PROXY)
+	Proxy string
+	// Server verification and client certificate for TLS (nil to disable)
+	TLS *tls.Config
+	// Wrap the connection in TLS before negotiation
+	ImplicitTLS bool
+	// START_TLS mode: "offer" falls back to plaintext, "require" fails (empty to disable)
+	StartTLS string
+}
+
+const DefaultTerminalType = "IBM-3278-2-E"
+
+// Deadline for TLS handshake and START_TLS negotiation
+const tlsTimeout = 10 * time.Second
+
+// Keys of the local terminal besides F1-F12 and Shift-F1-F12 for PF1-PF24
+var keys = map[string]string{
+	"\r":      "ENTER",
+	"\t":      "TAB",
+	"\x1b[Z":  "BACKTAB",
+	"\x7f":    "BACKSPACE",
+	"\b":      "BACKSPACE",
+	"\x1b[3~": "DELETE",
+	"\x1b[A":  "UP",
+	"\x1b[B":  "DOWN",
+	"\x1b[C":  "RIGHT",
+	"\x1b[D":  "LEFT",
+	"\x1b[H":  "HOME",
+	"\x1b[1~": "HOME",
+	"\x03":    "CLEAR",
+	"\x01":    "PA1",
+	"\x02":    "PA2",
+	"\x05":    "ERASE-EOF",
+	"\x12":    "RESET",
+	"\x1d":    "QUIT",
+}
+
+func init() {
+	// xterm sequences of F1-F12
+	functionKeys := []string{"OP", "OQ", "OR", "OS", "[15", "[17", "[18", "[19", "[20", "[21", "[23", "[24"}
+	for i, key := range functionKeys {
+		if strings.HasPrefix(key, "O") {
+			keys["\x1b"+key] = fmt.Sprintf("PF%d", i+1)
+			keys["\x1b[1;2"+key[1:]] = fmt.Sprintf("PF%d", i+13)
+			keys[fmt.Sprintf("\x1b[%d~", 11+i)] = fmt.Sprintf("PF%d", i+1)
+			continue
+		}
+		keys["\x1b"+key+"~"] = fmt.Sprintf("PF%d", i+1)
+		keys["\x1b"+key+";2~"] = fmt.Sprintf("PF%d", i+13)
+	}
+}
+
+// Connects to a TN3270 host and runs the terminal until the host closes or Ctrl-] is pressed
+func Run(ip string, port int, config Config) {
+	if len(config.TerminalType) == 0 {
+		config.TerminalType = DefaultTerminalType
+	}
+	c := connection.Connection{IP: ip, Port: port}
+	var err error
+	c.Dialer, err = proxy.New(config.Proxy)
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+	fmt.Printf("Trying %s:%d...\n", ip, port)
+	err = c.Dial()
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+	defer c.Conn.Close()
+	if config.ImplicitTLS || len(config.StartTLS) > 0 {
+		c.Conn.SetDeadline(time.Now().Add(tlsTimeout))
+		if config.ImplicitTLS {
+			err = c.UpgradeTLS(config.TLS)
+		} else {
+			err = c.StartTLS(config.TLS)
+			if err == connection.ErrStartTLSRefused && config.StartTLS == "offer" {
+				err = nil
+			}
+		}
+		if err != nil {
+			log.Fatalln("Error:", err)
+		}
+		c.Conn.SetDeadline(time.Time{})
+	}
+	fmt.Printf("Connected to %s:%d.\n", ip, port)
+
+	tty := terminal.New()
+	err = tty.OpenTty()
+	if err != nil {
+		log.Fatalln("Error:", err)
+	}
+	s := newSession(c, config.TerminalType, config.LU)
+	rows, cols := Model(config.TerminalType)
+	t := &client{session: s, screen: NewScreen(rows, cols)}
+	// Alternate screen buffer
+	fmt.Print("\x1b[?1049h\x1b[2J")
+	err = t.run(tty)
+	fmt.Print("\x1b[?1049l")
+	tty.Close()
+	if err == io.EOF {
+		fmt.Println("Connection closed by foreign host.")
+	} else if err != nil {
+		log.Fatalln("Error:", err)
+	}
+}
+
+type client struct {
+	session *session
+	screen  *Screen
+}
+
+func (t *client) run(tty *terminal.Terminal) error {
+	records := make(chan []byte)
+	input := make(chan []byte)
+	errs := make(chan error, 2)
+	go func() {
+		for {
+			record, err := t.session.ReadRecord()
+			if err != nil {
+				errs <- err
+				return
+			}
+			records <- record
+		}
+	}()
+	// Ctrl-C raises SIGINT on the tty and means Clear
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGWINCH)
+	defer signal.Stop(signals)
+	go func() {
+		for {
+			buf := make([]byte, 256)
+			n, err := tty.Read(buf)
+			if err != nil {
+				errs <- err
+				return
+			}
+			input <- buf[:n]
+		}
+	}()
+
+	t.render()
+	for {
+		select {
+		case record := <-records:
+			reply := t.screen.Apply(record)
+			if reply != nil {
+				err := t.session.WriteRecord(reply)
+				if err != nil {
+					return err
+				}
+			}
+		case b := <-input:
+			quit, err := t.input(b)
+			if quit || err != nil {
+				return err
+			}
+		case sig := <-signals:
+			if sig == os.Interrupt {
+				_, err := t.input([]byte{0x03})
+				if err != nil {
+					return err
+				}
+			} else {
+				fmt.Print("\x1b[2J")
+			}
+		case err := <-errs:
+			return err
+		}
+		t.render()
+	}
+}
+
+func (t *client) render() {
+	fmt.Print(t.screen.Render(t.screen.Status(t.session.Mode())))
+}
+
+// Handles local key presses, sending a record for AID keys
+func (t *client) input(b []byte) (bool, error) {
+	for len(b) > 0 {
+		key, n := parseKey(b)
+		b = b[n:]
+		if len(key) == 0 {
+			continue
+		} else if key == "QUIT" {
+			return true, nil
+		}
+		aid, ok := keyAID(key)
+		if ok {
+			if t.screen.Locked {
+				continue
+			}
+			err := t.session.WriteRecord(t.screen.Submit(aid))
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+		t.edit(key)
+	}
+	return false, nil
+}
+
+func keyAID(key string) (byte, bool) {
+	switch key {
+	case "ENTER":
+		return AID_ENTER, true
+	case "CLEAR":
+		return AID_CLEAR, true
+	case "PA1":
+		return AID_PA1, true
+	case "PA2":
+		return AID_PA2, true
+	}
+	for i, pf := range AID_PF {
+		if key == fmt.Sprintf("PF%d", i+1) {
+			return pf, true
+		}
+	}
+	return 0, false
+}
+
+func (t *client) edit(key string) {
+	s := t.screen
+	switch key {
+	case "TAB":
+		s.Tab()
+	case "BACKTAB":
+		s.BackTab()
+	case "BACKSPACE":
+		s.Backspace()
+	case "DELETE":
+		s.Delete()
+	case "UP":
+		s.Move(-1, 0)
+	case "DOWN":
+		s.Move(1, 0)
+	case "LEFT":
+		s.Move(0, -1)
+	case "RIGHT":
+		s.Move(0, 1)
+	case "HOME":
+		s.Home()
+	case "ERASE-EOF":
+		s.EraseEOF()
+	case "RESET":
+		s.Locked = false
+	default:
+		r, _ := utf8.DecodeRuneInString(key)
+		if !s.Type(r) {
+			s.Alarm = true
+		}
+	}
+}
+
+// Returns the key at the start of b and its length, a printable key is returned as itself
+func parseKey(b []byte) (string, int) {
+	// Longest escape sequence first
+	n := len(b)
+	if n > 8 {
+		n = 8
+	}
+	for ; n > 0; n-- {
+		if key, ok := keys[string(b[:n])]; ok {
+			return key, n
+		}
+	}
+	if b[0] == 0x1b {
+		// Skip unknown CSI or SS3 sequence
+		n := 1
+		if n < len(b) && (b[n] == '[' || b[n] == 'O') {
+			n++
+			for n < len(b) && (b[n] < 0x40 || b[n] > 0x7E) {
+				n++
+			}
+			if n < len(b) {
+				n++
+			}
+		}
+		return "", n
+	}
+	r, n := utf8.DecodeRune(b)
+	if r < 0x20 {
+		return "", n
+	}
+	return string(r), n
+}
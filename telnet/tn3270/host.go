@@ -0,0 +1,220 @@
+package tn3270
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	cmd "telnet/command"
+	"telnet/connection"
+	opt "telnet/option"
+	"time"
+)
+
+// Serves a TN3270 session after negotiation
+type Handler interface {
+	Serve(h *HostSession) error
+}
+
+// Deadline for TN3270E or TN3270 negotiation
+const negotiationTimeout = 10 * time.Second
+
+// Host side of a negotiated session
+type HostSession struct {
+	ID      int
+	Conn    net.Conn
+	session *session
+	Rows    int
+	Cols    int
+}
+
+// Returns whether TN3270E is in effect, the terminal type and the LU name
+func (h *HostSession) Mode() (tn3270e bool, terminalType string, deviceName string) {
+	return h.session.Mode()
+}
+
+// Starts an outbound data stream sized for the terminal
+func (h *HostSession) NewBuilder(command byte, wcc byte) *Builder {
+	return NewBuilder(command, wcc, h.Cols)
+}
+
+// Sends an outbound data stream such as a Builder result
+func (h *HostSession) Write(stream []byte) error {
+	return h.session.WriteRecord(stream)
+}
+
+// Reads the next inbound record
+func (h *HostSession) Read() (Inbound, error) {
+	record, err := h.session.ReadRecord()
+	if err != nil {
+		return Inbound{}, err
+	}
+	return ParseInbound(record)
+}
+
+// Listens and serves TN3270 terminals with handler
+func RunHost(ip string, port int, handler Handler) {
+	ln, err := net.Listen("tcp", ip+":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatal("Error:", err)
+	}
+	defer ln.Close()
+	fmt.Printf("TN3270 host listen on %s:%d...\n", ip, port)
+	err = Serve(ln, handler)
+	if err != nil {
+		log.Fatal("Error:", err)
+	}
+}
+
+func Serve(ln net.Listener, handler Handler) error {
+	for id := 1; ; id++ {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go func(id int) {
+			defer conn.Close()
+			h, err := negotiate(id, conn)
+			if err != nil {
+				log.Printf("Session %d: Error: %s", id, err)
+				return
+			}
+			tn3270e, terminalType, deviceName := h.Mode()
+			if tn3270e {
+				terminalType += " with TN3270E as " + deviceName
+			}
+			log.Printf("Session %d: Terminal %s Connected", id, terminalType)
+			err = handler.Serve(h)
+			if err != nil && err != io.EOF {
+				log.Printf("Session %d: Error: %s", id, err)
+			}
+			log.Printf("Session %d: Terminal Disconnected", id)
+		}(id)
+	}
+}
+
+// Offers TN3270E, falling back to TERMINAL-TYPE, BINARY and END-OF-RECORD
+func negotiate(id int, conn net.Conn) (*HostSession, error) {
+	s := newSession(connection.Connection{Conn: conn, Reader: bufio.NewReader(conn), IsServer: true}, "", "")
+	s.assignName = func() string {
+		return fmt.Sprintf("LU%05d", id)
+	}
+	conn.SetDeadline(time.Now().Add(negotiationTimeout))
+	defer conn.SetDeadline(time.Time{})
+	err := s.WriteBytes(s.request(cmd.DO, opt.TN3270E))
+	if err != nil {
+		return nil, err
+	}
+	for !s.isReady() {
+		_, err := s.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, terminalType, _ := s.Mode()
+	rows, cols := Model(terminalType)
+	return &HostSession{ID: id, Conn: conn, session: s, Rows: rows, Cols: cols}, nil
+}
+
+// Mock host with logon and command screens for trying out TN3270 clients
+type Mock struct{}
+
+func (Mock) Serve(h *HostSession) error {
+	user, message := "", ""
+	for {
+		stream := mockLogon(h, message)
+		if len(user) > 0 {
+			stream = mockMenu(h, user, message)
+		}
+		err := h.Write(stream)
+		if err != nil {
+			return err
+		}
+		in, err := h.Read()
+		if err != nil {
+			return err
+		}
+		message = ""
+		switch in.AID {
+		case AID_CLEAR:
+		case AID_PF[2]:
+			return h.Write(mockGoodbye(h))
+		case AID_ENTER:
+			if len(user) == 0 {
+				user = strings.ToUpper(strings.TrimSpace(in.Field(mockUserAddress(h))))
+				if len(user) == 0 {
+					message = "USERID is required"
+				}
+				break
+			}
+			command := strings.ToUpper(strings.TrimSpace(in.Field(mockCommandAddress(h))))
+			switch command {
+			case "":
+			case "TIME":
+				message = "Time is " + time.Now().Format("2006-01-02 15:04:05")
+			case "LOGOFF":
+				return h.Write(mockGoodbye(h))
+			default:
+				message = "Command " + command + " not found"
+			}
+		default:
+			message = AIDName(in.AID) + " is not supported"
+		}
+	}
+}
+
+// Input field addresses
+func mockUserAddress(h *HostSession) int {
+	return 8*h.Cols + 16
+}
+
+func mockCommandAddress(h *HostSession) int {
+	return (h.Rows-4)*h.Cols + 15
+}
+
+func mockHeader(h *HostSession) *Builder {
+	_, terminalType, deviceName := h.Mode()
+	b := h.NewBuilder(CMD_EW, WCC_RESET_MDT|WCC_KEYBOARD_RESTORE)
+	b.At(1, (h.Cols-14)/2-1).Field(ATTR_PROTECTED | ATTR_INTENSIFIED).Text("MOCK 3270 HOST")
+	b.At(3, 1).Field(ATTR_PROTECTED).Text(fmt.Sprintf("Terminal %s  LU %s", terminalType, deviceName))
+	return b
+}
+
+func mockFooter(b *Builder, h *HostSession, keys string, message string) []byte {
+	b.At(h.Rows-2, 1).Field(ATTR_PROTECTED).Text(keys)
+	b.At(h.Rows-1, 1).Field(ATTR_PROTECTED | ATTR_INTENSIFIED).Text(message)
+	return b.Bytes()
+}
+
+func mockLogon(h *HostSession, message string) []byte {
+	b := mockHeader(h)
+	b.At(8, 1).Field(ATTR_PROTECTED).Text("USERID   ===>")
+	b.At(8, 15).Field(0).Cursor()
+	b.At(8, 24).Field(ATTR_PROTECTED)
+	b.At(9, 1).Field(ATTR_PROTECTED).Text("PASSWORD ===>")
+	b.At(9, 15).Field(ATTR_HIDDEN)
+	b.At(9, 24).Field(ATTR_PROTECTED)
+	return mockFooter(b, h, "ENTER=Logon  PF3=Exit  CLEAR=Refresh", message)
+}
+
+func mockMenu(h *HostSession, user string, message string) []byte {
+	b := mockHeader(h)
+	b.At(6, 1).Field(ATTR_PROTECTED).Text("Welcome, " + user + ".")
+	b.At(8, 1).Field(ATTR_PROTECTED).Text("Commands: TIME, LOGOFF")
+	b.At(h.Rows-4, 1).Field(ATTR_PROTECTED).Text("COMMAND ===>")
+	b.At(h.Rows-4, 14).Field(0).Cursor()
+	b.At(h.Rows-4, 55).Field(ATTR_PROTECTED)
+	return mockFooter(b, h, "ENTER=Run  PF3=Logoff  CLEAR=Refresh", message)
+}
+
+func mockGoodbye(h *HostSession) []byte {
+	b := mockHeader(h)
+	b.At(6, 1).Field(ATTR_PROTECTED).Text("Session ended.")
+	return b.Bytes()
+}
@@ -0,0 +1,63 @@
+package tn3270
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Renders the screen with ANSI sequences below a status line
+func (s *Screen) Render(status string) string {
+	buf := new(strings.Builder)
+	buf.WriteString("\x1b[H\x1b[0m")
+	if s.Alarm {
+		buf.WriteString("\a")
+		s.Alarm = false
+	}
+	sgr := ""
+	for row := 0; row < s.Rows; row++ {
+		fmt.Fprintf(buf, "\x1b[%d;1H", row+1)
+		for col := 0; col < s.Cols; col++ {
+			pos := row*s.Cols + col
+			if next := s.sgr(pos); next != sgr {
+				buf.WriteString("\x1b[0" + next + "m")
+				sgr = next
+			}
+			buf.WriteRune(s.runeAt(pos))
+		}
+	}
+	fmt.Fprintf(buf, "\x1b[0m\x1b[%d;1H\x1b[7m%-*s\x1b[0m", s.Rows+1, s.Cols, status)
+	fmt.Fprintf(buf, "\x1b[%d;%dH", s.Cursor/s.Cols+1, s.Cursor%s.Cols+1)
+	return buf.String()
+}
+
+// Returns SGR parameters for the field at pos: bold if intensified, underlined if input
+func (s *Screen) sgr(pos int) string {
+	start := s.fieldStart(pos)
+	if start < 0 || s.isField[pos] {
+		return ""
+	}
+	sgr := ""
+	if s.attr[start]&ATTR_DISPLAY == ATTR_INTENSIFIED {
+		sgr += ";1"
+	}
+	if s.attr[start]&ATTR_PROTECTED == 0 {
+		sgr += ";4"
+	}
+	return sgr
+}
+
+// Returns the status line: mode, terminal type, LU, input inhibited and cursor position
+func (s *Screen) Status(tn3270e bool, terminalType string, deviceName string) string {
+	mode := "TN3270"
+	if tn3270e {
+		mode = "TN3270E"
+	}
+	status := fmt.Sprintf(" %s %s", mode, terminalType)
+	if len(deviceName) > 0 {
+		status += " LU " + deviceName
+	}
+	if s.Locked {
+		status += "  X SYSTEM"
+	}
+	return fmt.Sprintf("%-*s%03d/%03d ", s.Cols-8, status, s.Cursor/s.Cols+1, s.Cursor%s.Cols+1)
+}
@@ -0,0 +1,461 @@
+package tn3270
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Returns rows and columns of a terminal type such as IBM-3278-2-E
+func Model(terminalType string) (rows int, cols int) {
+	switch {
+	case strings.HasPrefix(terminalType, "IBM-3278-3"):
+		return 32, 80
+	case strings.HasPrefix(terminalType, "IBM-3278-4"):
+		return 43, 80
+	case strings.HasPrefix(terminalType, "IBM-3278-5"):
+		return 27, 132
+	}
+	return 24, 80
+}
+
+// Field-based 3270 presentation space
+type Screen struct {
+	Rows int
+	Cols int
+	// EBCDIC characters, 0 for null
+	buffer []byte
+	// Field attributes at the positions starting fields
+	isField []bool
+	attr    []byte
+	Cursor  int
+	// Keyboard locked until the host restores it
+	Locked bool
+	// Set by WCC alarm until rendered
+	Alarm bool
+}
+
+func NewScreen(rows int, cols int) *Screen {
+	s := &Screen{Rows: rows, Cols: cols}
+	s.clear()
+	return s
+}
+
+func (s *Screen) size() int {
+	return s.Rows * s.Cols
+}
+
+func (s *Screen) clear() {
+	s.buffer = make([]byte, s.size())
+	s.isField = make([]bool, s.size())
+	s.attr = make([]byte, s.size())
+	s.Cursor = 0
+}
+
+func (s *Screen) next(pos int) int {
+	return (pos + 1) % s.size()
+}
+
+// Applies an outbound record and returns the inbound reply for read commands
+func (s *Screen) Apply(record []byte) []byte {
+	if len(record) == 0 {
+		return nil
+	}
+	command := record[0]
+	if sna, ok := snaCommands[command]; ok {
+		command = sna
+	}
+	data := record[1:]
+	switch command {
+	case CMD_EW, CMD_EWA:
+		s.clear()
+		s.write(data)
+	case CMD_W:
+		s.write(data)
+	case CMD_EAU:
+		s.eraseUnprotected()
+	case CMD_RB:
+		return s.ReadBuffer(AID_NONE)
+	case CMD_RM, CMD_RMA:
+		return s.ReadModified(AID_NONE)
+	case CMD_WSF:
+		return s.structuredFields(data)
+	}
+	return nil
+}
+
+func (s *Screen) write(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	wcc := data[0]
+	if wcc&WCC_RESET_MDT != 0 {
+		for pos := range s.attr {
+			s.attr[pos] &^= ATTR_MDT
+		}
+	}
+	pos := s.Cursor
+	cursor := -1
+	address := func(i int) int {
+		if i+1 >= len(data) {
+			return pos
+		}
+		return DecodeAddress(data[i], data[i+1]) % s.size()
+	}
+	for i := 1; i < len(data); i++ {
+		switch data[i] {
+		case ORDER_SF:
+			if i+1 < len(data) {
+				s.startField(pos, data[i+1])
+			}
+			pos = s.next(pos)
+			i++
+		case ORDER_SFE, ORDER_MF:
+			if i+1 >= len(data) {
+				break
+			}
+			n := int(data[i+1])
+			attr, found := byte(0), false
+			for j := 0; j < n && i+3+2*j < len(data); j++ {
+				if data[i+2+2*j] == xaFieldAttribute {
+					attr, found = data[i+3+2*j], true
+				}
+			}
+			if data[i] == ORDER_SFE {
+				s.startField(pos, attr)
+			} else if found && s.isField[pos] {
+				s.attr[pos] = attr & 0x3F
+			}
+			pos = s.next(pos)
+			i += 1 + 2*n
+		case ORDER_SBA:
+			pos = address(i + 1)
+			i += 2
+		case ORDER_SA:
+			// Character attributes are not rendered
+			i += 2
+		case ORDER_IC:
+			cursor = pos
+		case ORDER_PT:
+			pos = s.nextUnprotected(pos)
+		case ORDER_RA:
+			stop := address(i + 1)
+			i += 3
+			if i < len(data) && data[i] == ORDER_GE {
+				i++
+			}
+			if i >= len(data) {
+				break
+			}
+			for {
+				s.put(pos, data[i])
+				pos = s.next(pos)
+				if pos == stop {
+					break
+				}
+			}
+		case ORDER_EUA:
+			stop := address(i + 1)
+			i += 2
+			for {
+				if start := s.fieldStart(pos); !s.isField[pos] && (start < 0 || s.attr[start]&ATTR_PROTECTED == 0) {
+					s.buffer[pos] = 0
+				}
+				pos = s.next(pos)
+				if pos == stop {
+					break
+				}
+			}
+		case ORDER_GE:
+			if i+1 < len(data) {
+				s.put(pos, data[i+1])
+				pos = s.next(pos)
+			}
+			i++
+		default:
+			s.put(pos, data[i])
+			pos = s.next(pos)
+		}
+	}
+	if cursor >= 0 {
+		s.Cursor = cursor
+	}
+	if wcc&WCC_KEYBOARD_RESTORE != 0 {
+		s.Locked = false
+	}
+	if wcc&WCC_ALARM != 0 {
+		s.Alarm = true
+	}
+}
+
+func (s *Screen) startField(pos int, attr byte) {
+	s.isField[pos] = true
+	s.attr[pos] = attr & 0x3F
+	s.buffer[pos] = 0
+}
+
+// Writes a character, replacing a field attribute at pos
+func (s *Screen) put(pos int, b byte) {
+	s.isField[pos] = false
+	s.buffer[pos] = b
+}
+
+// Returns position of the attribute of the field containing pos, -1 if unformatted
+func (s *Screen) fieldStart(pos int) int {
+	for i := 0; i < s.size(); i++ {
+		p := (pos - i + s.size()) % s.size()
+		if s.isField[p] {
+			return p
+		}
+	}
+	return -1
+}
+
+func (s *Screen) isFormatted() bool {
+	return s.fieldStart(0) >= 0
+}
+
+// Returns the first character position of the next unprotected field after pos, 0 if none
+func (s *Screen) nextUnprotected(pos int) int {
+	for i := 0; i < s.size(); i++ {
+		p := (pos + i) % s.size()
+		if s.isField[p] && s.attr[p]&ATTR_PROTECTED == 0 && !s.isField[s.next(p)] {
+			return s.next(p)
+		}
+	}
+	return 0
+}
+
+// Returns positions of field contents from the character after start to the next attribute
+func (s *Screen) fieldRange(start int) []int {
+	var positions []int
+	for p := s.next(start); !s.isField[p]; p = s.next(p) {
+		positions = append(positions, p)
+		if p == start {
+			break
+		}
+	}
+	return positions
+}
+
+func (s *Screen) eraseUnprotected() {
+	for start := range s.isField {
+		if !s.isField[start] || s.attr[start]&ATTR_PROTECTED != 0 {
+			continue
+		}
+		for _, p := range s.fieldRange(start) {
+			s.buffer[p] = 0
+		}
+		s.attr[start] &^= ATTR_MDT
+	}
+	if !s.isFormatted() {
+		s.clear()
+	}
+	s.Cursor = s.nextUnprotected(0)
+	s.Locked = false
+}
+
+// Builds the reply to Read Modified: AID, cursor and modified fields
+func (s *Screen) ReadModified(aid byte) []byte {
+	buf := bytes.NewBuffer([]byte{aid})
+	if isShortRead(aid) {
+		return buf.Bytes()
+	}
+	buf.Write(EncodeAddress(s.Cursor))
+	if !s.isFormatted() {
+		for _, b := range s.buffer {
+			if b != 0 {
+				buf.WriteByte(b)
+			}
+		}
+		return buf.Bytes()
+	}
+	for start := range s.isField {
+		if !s.isField[start] || s.attr[start]&ATTR_MDT == 0 {
+			continue
+		}
+		buf.WriteByte(ORDER_SBA)
+		buf.Write(EncodeAddress(s.next(start)))
+		for _, p := range s.fieldRange(start) {
+			if s.buffer[p] != 0 {
+				buf.WriteByte(s.buffer[p])
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+// Builds the reply to Read Buffer with all characters and field attributes
+func (s *Screen) ReadBuffer(aid byte) []byte {
+	buf := bytes.NewBuffer([]byte{aid})
+	buf.Write(EncodeAddress(s.Cursor))
+	for pos, b := range s.buffer {
+		if s.isField[pos] {
+			buf.Write([]byte{ORDER_SF, addressCodes[s.attr[pos]]})
+			continue
+		}
+		buf.WriteByte(b)
+	}
+	return buf.Bytes()
+}
+
+// Answers Read Partition Query, other structured fields are ignored
+func (s *Screen) structuredFields(data []byte) []byte {
+	for len(data) >= 3 {
+		length := int(data[0])<<8 | int(data[1])
+		if length == 0 || length > len(data) {
+			length = len(data)
+		}
+		readPartition := data[2] == 0x01
+		if readPartition && length >= 5 && (data[4] == 0x02 || data[4] == 0x03) {
+			return queryReply(s.Rows, s.Cols)
+		}
+		if length < 3 {
+			break
+		}
+		data = data[length:]
+	}
+	return nil
+}
+
+// Reports whether the operator may type at pos
+func (s *Screen) isInput(pos int) bool {
+	if s.isField[pos] {
+		return false
+	}
+	start := s.fieldStart(pos)
+	return start < 0 || s.attr[start]&ATTR_PROTECTED == 0
+}
+
+// Types r at the cursor, returns false if the input is inhibited
+func (s *Screen) Type(r rune) bool {
+	if s.Locked || !s.isInput(s.Cursor) {
+		return false
+	}
+	b, ok := EBCDIC(r)
+	if !ok || b < 0x40 {
+		return false
+	}
+	start := s.fieldStart(s.Cursor)
+	if start >= 0 {
+		if s.attr[start]&ATTR_NUMERIC != 0 && !strings.ContainsRune("0123456789.-", r) {
+			return false
+		}
+		s.attr[start] |= ATTR_MDT
+	}
+	s.buffer[s.Cursor] = b
+	s.Cursor = s.next(s.Cursor)
+	// Skip to the next input field at the end of this one
+	if s.isField[s.Cursor] {
+		s.Cursor = s.nextUnprotected(s.Cursor)
+	}
+	return true
+}
+
+// Moves to the next input field
+func (s *Screen) Tab() {
+	s.Cursor = s.nextUnprotected(s.Cursor)
+}
+
+// Moves to the start of this input field, or the previous one
+func (s *Screen) BackTab() {
+	for i := 1; i <= s.size(); i++ {
+		p := (s.Cursor - i + s.size()) % s.size()
+		if s.isField[p] && s.attr[p]&ATTR_PROTECTED == 0 && s.next(p) != s.Cursor && !s.isField[s.next(p)] {
+			s.Cursor = s.next(p)
+			return
+		}
+	}
+}
+
+// Moves to the first input field
+func (s *Screen) Home() {
+	s.Cursor = s.nextUnprotected(0)
+}
+
+func (s *Screen) Move(rows int, cols int) {
+	s.Cursor = ((s.Cursor+rows*s.Cols+cols)%s.size() + s.size()) % s.size()
+}
+
+// Deletes the character at the cursor, shifting the rest of the field left
+func (s *Screen) Delete() bool {
+	if s.Locked || !s.isInput(s.Cursor) {
+		return false
+	}
+	start := s.fieldStart(s.Cursor)
+	end := len(s.buffer)
+	if start >= 0 {
+		s.attr[start] |= ATTR_MDT
+		positions := s.fieldRange(start)
+		end = positions[len(positions)-1] + 1
+		if end <= s.Cursor {
+			// Field wraps past the end of the buffer
+			end = len(s.buffer)
+		}
+	}
+	copy(s.buffer[s.Cursor:end-1], s.buffer[s.Cursor+1:end])
+	s.buffer[end-1] = 0
+	return true
+}
+
+// Moves left and deletes within the input field
+func (s *Screen) Backspace() bool {
+	prev := (s.Cursor - 1 + s.size()) % s.size()
+	if s.Locked || !s.isInput(prev) {
+		return false
+	}
+	s.Cursor = prev
+	return s.Delete()
+}
+
+// Erases from the cursor to the end of the field
+func (s *Screen) EraseEOF() bool {
+	if s.Locked || !s.isInput(s.Cursor) {
+		return false
+	}
+	start := s.fieldStart(s.Cursor)
+	if start < 0 {
+		for p := s.Cursor; p < len(s.buffer); p++ {
+			s.buffer[p] = 0
+		}
+		return true
+	}
+	s.attr[start] |= ATTR_MDT
+	for p := s.Cursor; !s.isField[p]; p = s.next(p) {
+		s.buffer[p] = 0
+	}
+	return true
+}
+
+// Builds the inbound record for an AID key and locks the keyboard
+func (s *Screen) Submit(aid byte) []byte {
+	if aid == AID_CLEAR {
+		s.clear()
+	}
+	record := s.ReadModified(aid)
+	s.Locked = true
+	return record
+}
+
+// Returns screen text, one line per row
+func (s *Screen) Text() string {
+	lines := make([]string, s.Rows)
+	for row := range lines {
+		line := make([]rune, s.Cols)
+		for col := range line {
+			line[col] = s.runeAt(row*s.Cols + col)
+		}
+		lines[row] = strings.TrimRight(string(line), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the displayed character at pos
+func (s *Screen) runeAt(pos int) rune {
+	if s.isField[pos] {
+		return ' '
+	}
+	if start := s.fieldStart(pos); start >= 0 && s.attr[start]&ATTR_DISPLAY == ATTR_HIDDEN {
+		return ' '
+	}
+	return Rune(s.buffer[pos])
+}
@@ -0,0 +1,246 @@
+package tn3270
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Commands, remote codes with the SNA codes accepted as well
+const (
+	CMD_W   byte = 0xF1
+	CMD_EW  byte = 0xF5
+	CMD_EWA byte = 0x7E
+	CMD_RB  byte = 0xF2
+	CMD_RM  byte = 0xF6
+	CMD_RMA byte = 0x6E
+	CMD_EAU byte = 0x6F
+	CMD_WSF byte = 0xF3
+)
+
+var snaCommands = map[byte]byte{
+	0x01: CMD_W,
+	0x05: CMD_EW,
+	0x0D: CMD_EWA,
+	0x02: CMD_RB,
+	0x06: CMD_RM,
+	0x0E: CMD_RMA,
+	0x0F: CMD_EAU,
+	0x11: CMD_WSF,
+}
+
+// Write control character bits
+const (
+	WCC_RESET_MDT        byte = 0x01
+	WCC_KEYBOARD_RESTORE byte = 0x02
+	WCC_ALARM            byte = 0x04
+)
+
+// Orders
+const (
+	ORDER_PT  byte = 0x05
+	ORDER_GE  byte = 0x08
+	ORDER_SBA byte = 0x11
+	ORDER_EUA byte = 0x12
+	ORDER_IC  byte = 0x13
+	ORDER_SF  byte = 0x1D
+	ORDER_SA  byte = 0x28
+	ORDER_SFE byte = 0x29
+	ORDER_MF  byte = 0x2C
+	ORDER_RA  byte = 0x3C
+)
+
+// Field attribute bits
+const (
+	ATTR_PROTECTED   byte = 0x20
+	ATTR_NUMERIC     byte = 0x10
+	ATTR_DISPLAY     byte = 0x0C
+	ATTR_INTENSIFIED byte = 0x08
+	ATTR_HIDDEN      byte = 0x0C
+	ATTR_MDT         byte = 0x01
+)
+
+// Extended attribute type of the basic field attribute in SFE and MF
+const xaFieldAttribute byte = 0xC0
+
+// Attention identifiers
+const (
+	AID_NONE       byte = 0x60
+	AID_ENTER      byte = 0x7D
+	AID_CLEAR      byte = 0x6D
+	AID_PA1        byte = 0x6C
+	AID_PA2        byte = 0x6E
+	AID_PA3        byte = 0x6B
+	AID_SYSREQ     byte = 0xF0
+	AID_STRUCTURED byte = 0x88
+)
+
+// PF1 to PF24
+var AID_PF = [24]byte{
+	0xF1, 0xF2, 0xF3, 0xF4, 0xF5, 0xF6, 0xF7, 0xF8, 0xF9, 0x7A, 0x7B, 0x7C,
+	0xC1, 0xC2, 0xC3, 0xC4, 0xC5, 0xC6, 0xC7, 0xC8, 0xC9, 0x4A, 0x4B, 0x4C,
+}
+
+// Returns name of AID such as ENTER or PF3
+func AIDName(aid byte) string {
+	switch aid {
+	case AID_NONE:
+		return "NONE"
+	case AID_ENTER:
+		return "ENTER"
+	case AID_CLEAR:
+		return "CLEAR"
+	case AID_PA1:
+		return "PA1"
+	case AID_PA2:
+		return "PA2"
+	case AID_PA3:
+		return "PA3"
+	case AID_SYSREQ:
+		return "SYSREQ"
+	case AID_STRUCTURED:
+		return "STRUCTURED-FIELD"
+	}
+	for i, pf := range AID_PF {
+		if aid == pf {
+			return fmt.Sprintf("PF%d", i+1)
+		}
+	}
+	return fmt.Sprintf("0x%02X", aid)
+}
+
+// Short read AIDs send no cursor address or fields
+func isShortRead(aid byte) bool {
+	return aid == AID_CLEAR || aid == AID_PA1 || aid == AID_PA2 || aid == AID_PA3
+}
+
+// 6-bit values of 12-bit buffer addresses
+var addressCodes = [64]byte{
+	0x40, 0xC1, 0xC2, 0xC3, 0xC4, 0xC5, 0xC6, 0xC7, 0xC8, 0xC9, 0x4A, 0x4B, 0x4C, 0x4D, 0x4E, 0x4F,
+	0x50, 0xD1, 0xD2, 0xD3, 0xD4, 0xD5, 0xD6, 0xD7, 0xD8, 0xD9, 0x5A, 0x5B, 0x5C, 0x5D, 0x5E, 0x5F,
+	0x60, 0x61, 0xE2, 0xE3, 0xE4, 0xE5, 0xE6, 0xE7, 0xE8, 0xE9, 0x6A, 0x6B, 0x6C, 0x6D, 0x6E, 0x6F,
+	0xF0, 0xF1, 0xF2, 0xF3, 0xF4, 0xF5, 0xF6, 0xF7, 0xF8, 0xF9, 0x7A, 0x7B, 0x7C, 0x7D, 0x7E, 0x7F,
+}
+
+// Decodes a 12-bit or 14-bit buffer address
+func DecodeAddress(b1 byte, b2 byte) int {
+	if b1&0xC0 == 0 {
+		return int(b1&0x3F)<<8 | int(b2)
+	}
+	return int(b1&0x3F)<<6 | int(b2&0x3F)
+}
+
+// Encodes a 12-bit buffer address
+func EncodeAddress(address int) []byte {
+	return []byte{addressCodes[(address>>6)&0x3F], addressCodes[address&0x3F]}
+}
+
+// Builds an outbound data stream
+type Builder struct {
+	buf  bytes.Buffer
+	cols int
+}
+
+// Starts a command such as CMD_EW with write control character
+func NewBuilder(command byte, wcc byte, cols int) *Builder {
+	b := &Builder{cols: cols}
+	b.buf.Write([]byte{command, wcc})
+	return b
+}
+
+// Sets buffer address to row and column from 0
+func (b *Builder) At(row int, col int) *Builder {
+	b.buf.WriteByte(ORDER_SBA)
+	b.buf.Write(EncodeAddress(row*b.cols + col))
+	return b
+}
+
+// Starts a field with attribute bits such as ATTR_PROTECTED
+func (b *Builder) Field(attr byte) *Builder {
+	b.buf.Write([]byte{ORDER_SF, addressCodes[attr&0x3F]})
+	return b
+}
+
+func (b *Builder) Text(text string) *Builder {
+	b.buf.Write(Encode(text))
+	return b
+}
+
+// Places the cursor at the current address
+func (b *Builder) Cursor() *Builder {
+	b.buf.WriteByte(ORDER_IC)
+	return b
+}
+
+func (b *Builder) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// Modified field sent by the terminal
+type InboundField struct {
+	// Address of the first character after the field attribute
+	Address int
+	Text    string
+}
+
+// Terminal input record
+type Inbound struct {
+	AID    byte
+	Cursor int
+	Fields []InboundField
+}
+
+// Returns text of the field starting at address
+func (in Inbound) Field(address int) string {
+	for _, field := range in.Fields {
+		if field.Address == address {
+			return field.Text
+		}
+	}
+	return ""
+}
+
+// Parses a Read Modified response
+func ParseInbound(record []byte) (Inbound, error) {
+	if len(record) == 0 {
+		return Inbound{}, fmt.Errorf("empty inbound record")
+	}
+	in := Inbound{AID: record[0]}
+	if isShortRead(in.AID) || len(record) < 3 {
+		return in, nil
+	}
+	in.Cursor = DecodeAddress(record[1], record[2])
+	var field *InboundField
+	for i := 3; i < len(record); i++ {
+		if record[i] == ORDER_SBA && i+2 < len(record) {
+			in.Fields = append(in.Fields, InboundField{Address: DecodeAddress(record[i+1], record[i+2])})
+			field = &in.Fields[len(in.Fields)-1]
+			i += 2
+			continue
+		}
+		if field == nil {
+			// Unformatted screen sends data without SBA
+			in.Fields = append(in.Fields, InboundField{})
+			field = &in.Fields[0]
+		}
+		field.Text += string(Rune(record[i]))
+	}
+	return in, nil
+}
+
+// Query Reply to Read Partition Query: summary and usable area of the screen
+func queryReply(rows int, cols int) []byte {
+	buf := bytes.NewBuffer([]byte{AID_STRUCTURED})
+	buf.Write([]byte{0x00, 0x06, 0x81, 0x80, 0x80, 0x81})
+	size := rows * cols
+	buf.Write([]byte{
+		0x00, 0x17, 0x81, 0x81,
+		0x01, 0x00,
+		byte(cols >> 8), byte(cols), byte(rows >> 8), byte(rows),
+		0x00,
+		0x00, 0x0A, 0x02, 0xE5,
+		0x00, 0x02, 0x00, 0x6F,
+		0x09, 0x0C,
+		byte(size >> 8), byte(size),
+	})
+	return buf.Bytes()
+}
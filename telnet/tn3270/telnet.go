@@ -0,0 +1,363 @@
+package tn3270
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	cmd "telnet/command"
+	"telnet/connection"
+	opt "telnet/option"
+)
+
+// TN3270E subnegotiation codes of RFC 2355
+const (
+	TN3270E_ASSOCIATE   byte = 0
+	TN3270E_CONNECT     byte = 1
+	TN3270E_DEVICE_TYPE byte = 2
+	TN3270E_FUNCTIONS   byte = 3
+	TN3270E_IS          byte = 4
+	TN3270E_REASON      byte = 5
+	TN3270E_REJECT      byte = 6
+	TN3270E_REQUEST     byte = 7
+	TN3270E_SEND        byte = 8
+)
+
+// TN3270E reject reasons
+const (
+	REASON_INV_DEVICE_TYPE byte = 4
+	REASON_INV_NAME        byte = 5
+)
+
+// Data type in TN3270E header of 3270 data stream records
+const dataType3270 byte = 0x00
+
+const tn3270eHeaderLength = 5
+
+// TERMINAL-TYPE subnegotiation
+const (
+	ttypeIs   byte = 0
+	ttypeSend byte = 1
+)
+
+// Telnet connection negotiating TN3270 or TN3270E, with records framed by IAC EOR
+type session struct {
+	connection.Connection
+	// Type requested by the client, -E suffix for TN3270E
+	terminalType string
+	// LU requested by the client and connected by the host
+	deviceName string
+	// Host assigns names to clients without an LU
+	assignName func() string
+	tn3270e    bool
+	// BINARY and END-OF-RECORD are needed on both sides, so our side and
+	// the peer side are kept apart instead of in EnableOptions
+	will map[byte]bool
+	do   map[byte]bool
+	// Requests sent and not yet answered
+	askedWill map[byte]bool
+	askedDo   map[byte]bool
+	// Records received and not yet read
+	records [][]byte
+	seq     uint16
+	mu      sync.Mutex
+}
+
+// Takes over a dialed or accepted connection, IsServer set for the host
+func newSession(c connection.Connection, terminalType string, deviceName string) *session {
+	s := &session{
+		Connection:   c,
+		terminalType: terminalType,
+		deviceName:   deviceName,
+		will:         map[byte]bool{},
+		do:           map[byte]bool{},
+		askedWill:    map[byte]bool{},
+		askedDo:      map[byte]bool{},
+	}
+	s.SupportOptions = []byte{opt.BINARY, opt.END_OF_RECORD, opt.TERMINAL_TYPE, opt.TN3270E}
+	s.EnableOptions = map[byte]bool{}
+	s.BuildCmdRes = s.buildCmdRes
+	s.OnRecord = s.onRecord
+	return s
+}
+
+// Returns whether TN3270E is in effect, the terminal type and the LU name
+func (s *session) Mode() (tn3270e bool, terminalType string, deviceName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tn3270e, s.terminalType, s.deviceName
+}
+
+// Reports whether 3270 records can be exchanged
+func (s *session) isReady() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tn3270e {
+		return true
+	}
+	return len(s.terminalType) > 0 && s.will[opt.BINARY] && s.do[opt.BINARY] && s.will[opt.END_OF_RECORD] && s.do[opt.END_OF_RECORD]
+}
+
+// Reads until the next complete 3270 record, answering telnet commands on the way
+func (s *session) ReadRecord() ([]byte, error) {
+	for len(s.records) == 0 {
+		_, err := s.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+	}
+	record := s.records[0]
+	s.records = s.records[1:]
+	return record, nil
+}
+
+// Queues data up to IAC EOR, without the TN3270E header
+func (s *session) onRecord(record []byte) {
+	s.mu.Lock()
+	tn3270e := s.tn3270e
+	s.mu.Unlock()
+	if tn3270e {
+		// Only 3270 data is handled, SCS and responses are dropped
+		if len(record) < tn3270eHeaderLength || record[0] != dataType3270 {
+			return
+		}
+		record = record[tn3270eHeaderLength:]
+	}
+	s.records = append(s.records, record)
+}
+
+// Answers negotiation read by ReadMessage
+func (s *session) buildCmdRes(c connection.Connection, mainCmd byte, subCmd byte, options ...byte) ([]byte, error) {
+	switch mainCmd {
+	case cmd.WILL, cmd.WONT, cmd.DO, cmd.DONT:
+		return s.negotiate(mainCmd, subCmd), nil
+	case cmd.SB:
+		return s.subnegotiate(subCmd, options), nil
+	}
+	return nil, nil
+}
+
+// Reports whether we enable option on our side (WILL) or the peer side (DO)
+func (s *session) supports(command byte, option byte) bool {
+	switch option {
+	case opt.BINARY, opt.END_OF_RECORD:
+		return true
+	case opt.TERMINAL_TYPE:
+		// Client sends its type, host receives it
+		return (command == cmd.WILL) == s.IsServer
+	case opt.TN3270E:
+		if s.IsServer {
+			return command == cmd.WILL
+		}
+		return command == cmd.DO && strings.HasSuffix(strings.ToUpper(s.terminalType), "-E")
+	}
+	return false
+}
+
+func (s *session) negotiate(command byte, option byte) []byte {
+	s.mu.Lock()
+	var reply []byte
+	enabled, disabled := false, false
+	switch command {
+	case cmd.DO:
+		if !s.supports(command, option) {
+			reply = []byte{cmd.IAC, cmd.WONT, option}
+		} else if !s.will[option] {
+			s.will[option] = true
+			enabled = true
+			if !s.askedWill[option] {
+				reply = []byte{cmd.IAC, cmd.WILL, option}
+			}
+		}
+		s.askedWill[option] = false
+	case cmd.DONT:
+		if s.will[option] {
+			s.will[option] = false
+			disabled = true
+			reply = []byte{cmd.IAC, cmd.WONT, option}
+		}
+		s.askedWill[option] = false
+	case cmd.WILL:
+		if !s.supports(command, option) {
+			reply = []byte{cmd.IAC, cmd.DONT, option}
+		} else if !s.do[option] {
+			s.do[option] = true
+			enabled = true
+			if !s.askedDo[option] {
+				reply = []byte{cmd.IAC, cmd.DO, option}
+			}
+		}
+		s.askedDo[option] = false
+	case cmd.WONT:
+		// Refusal of our request also disables
+		disabled = s.do[option] || s.askedDo[option]
+		if s.do[option] {
+			reply = []byte{cmd.IAC, cmd.DONT, option}
+		}
+		s.do[option] = false
+		s.askedDo[option] = false
+	}
+	if option == opt.TN3270E && disabled {
+		s.tn3270e = false
+	}
+	s.mu.Unlock()
+
+	if !s.IsServer {
+		return reply
+	}
+	switch {
+	case option == opt.TN3270E && enabled:
+		reply = append(reply, buildTN3270E(TN3270E_SEND, TN3270E_DEVICE_TYPE)...)
+	case option == opt.TN3270E && disabled:
+		// Fall back to TN3270
+		reply = append(reply, s.request(cmd.DO, opt.TERMINAL_TYPE)...)
+	case option == opt.TERMINAL_TYPE && enabled:
+		reply = append(reply, cmd.IAC, cmd.SB, opt.TERMINAL_TYPE, ttypeSend, cmd.IAC, cmd.SE)
+	}
+	return reply
+}
+
+// Returns WILL or DO unless already in effect or requested
+func (s *session) request(command byte, option byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	asked, enabled := s.askedDo, s.do
+	if command == cmd.WILL {
+		asked, enabled = s.askedWill, s.will
+	}
+	if asked[option] || enabled[option] {
+		return nil
+	}
+	asked[option] = true
+	return []byte{cmd.IAC, command, option}
+}
+
+func (s *session) subnegotiate(option byte, data []byte) []byte {
+	if len(data) < 1 {
+		return nil
+	}
+	switch option {
+	case opt.TERMINAL_TYPE:
+		if !s.IsServer && data[0] == ttypeSend {
+			// -E types are for TN3270E only
+			s.mu.Lock()
+			terminalType := strings.TrimSuffix(strings.ToUpper(s.terminalType), "-E")
+			s.mu.Unlock()
+			message := append([]byte{cmd.IAC, cmd.SB, opt.TERMINAL_TYPE, ttypeIs}, cmd.Escape([]byte(terminalType))...)
+			return append(message, cmd.IAC, cmd.SE)
+		}
+		if s.IsServer && data[0] == ttypeIs {
+			s.mu.Lock()
+			s.terminalType = strings.ToUpper(string(data[1:]))
+			s.mu.Unlock()
+			var reply []byte
+			for _, command := range []byte{cmd.DO, cmd.WILL} {
+				for _, option := range []byte{opt.BINARY, opt.END_OF_RECORD} {
+					reply = append(reply, s.request(command, option)...)
+				}
+			}
+			return reply
+		}
+	case opt.TN3270E:
+		if s.IsServer {
+			return s.hostTN3270E(data)
+		}
+		return s.clientTN3270E(data)
+	}
+	return nil
+}
+
+func (s *session) clientTN3270E(data []byte) []byte {
+	switch {
+	case bytes.Equal(data, []byte{TN3270E_SEND, TN3270E_DEVICE_TYPE}):
+		s.mu.Lock()
+		message := append([]byte{TN3270E_DEVICE_TYPE, TN3270E_REQUEST}, strings.ToUpper(s.terminalType)...)
+		if len(s.deviceName) > 0 {
+			message = append(append(message, TN3270E_CONNECT), s.deviceName...)
+		}
+		s.mu.Unlock()
+		return buildTN3270E(message...)
+	case len(data) >= 2 && data[0] == TN3270E_DEVICE_TYPE && data[1] == TN3270E_IS:
+		terminalType, deviceName := string(data[2:]), ""
+		if i := bytes.IndexByte(data[2:], TN3270E_CONNECT); i >= 0 {
+			terminalType, deviceName = string(data[2:2+i]), string(data[3+i:])
+		}
+		s.mu.Lock()
+		s.terminalType, s.deviceName = terminalType, deviceName
+		s.mu.Unlock()
+		// No optional functions such as responses or SYSREQ
+		return buildTN3270E(TN3270E_FUNCTIONS, TN3270E_REQUEST)
+	case len(data) >= 2 && data[0] == TN3270E_DEVICE_TYPE && data[1] == TN3270E_REJECT:
+		// Fall back to TN3270 with a plain terminal type
+		s.mu.Lock()
+		s.will[opt.TN3270E] = false
+		s.mu.Unlock()
+		return []byte{cmd.IAC, cmd.WONT, opt.TN3270E}
+	case len(data) >= 2 && data[0] == TN3270E_FUNCTIONS:
+		return s.functions(data[1], data[2:])
+	}
+	return nil
+}
+
+func (s *session) hostTN3270E(data []byte) []byte {
+	switch {
+	case len(data) >= 2 && data[0] == TN3270E_DEVICE_TYPE && data[1] == TN3270E_REQUEST:
+		terminalType, deviceName := string(data[2:]), ""
+		if i := bytes.IndexByte(data[2:], TN3270E_CONNECT); i >= 0 {
+			terminalType, deviceName = string(data[2:2+i]), string(data[3+i:])
+		}
+		terminalType = strings.ToUpper(terminalType)
+		if !strings.HasPrefix(terminalType, "IBM-327") {
+			return buildTN3270E(TN3270E_DEVICE_TYPE, TN3270E_REJECT, TN3270E_REASON, REASON_INV_DEVICE_TYPE)
+		}
+		if len(deviceName) == 0 && s.assignName != nil {
+			deviceName = s.assignName()
+		}
+		s.mu.Lock()
+		s.terminalType, s.deviceName = terminalType, deviceName
+		s.mu.Unlock()
+		message := append([]byte{TN3270E_DEVICE_TYPE, TN3270E_IS}, terminalType...)
+		message = append(append(message, TN3270E_CONNECT), deviceName...)
+		return buildTN3270E(message...)
+	case len(data) >= 2 && data[0] == TN3270E_FUNCTIONS:
+		return s.functions(data[1], data[2:])
+	}
+	return nil
+}
+
+// Agrees to no functions, counter-proposing an empty list to any other request
+func (s *session) functions(code byte, functions []byte) []byte {
+	switch code {
+	case TN3270E_REQUEST:
+		if len(functions) > 0 {
+			return buildTN3270E(TN3270E_FUNCTIONS, TN3270E_REQUEST)
+		}
+		s.mu.Lock()
+		s.tn3270e = true
+		s.mu.Unlock()
+		return buildTN3270E(TN3270E_FUNCTIONS, TN3270E_IS)
+	case TN3270E_IS:
+		s.mu.Lock()
+		s.tn3270e = true
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func buildTN3270E(data ...byte) []byte {
+	message := append([]byte{cmd.IAC, cmd.SB, opt.TN3270E}, cmd.Escape(data)...)
+	return append(message, cmd.IAC, cmd.SE)
+}
+
+// Sends a 3270 data stream record, with the TN3270E header if in effect
+func (s *session) WriteRecord(record []byte) error {
+	buf := new(bytes.Buffer)
+	s.mu.Lock()
+	if s.tn3270e {
+		// Sequence numbers only matter to hosts requesting responses
+		buf.Write([]byte{dataType3270, 0x00, 0x00, byte(s.seq >> 8), byte(s.seq)})
+		s.seq++
+	}
+	s.mu.Unlock()
+	buf.Write(record)
+	return s.WriteBytes(append(cmd.Escape(buf.Bytes()), cmd.IAC, cmd.EOR))
+}
@@ -0,0 +1,129 @@
+package tn3270
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"telnet/connection"
+	"testing"
+	"time"
+)
+
+// Terminal driven by the test instead of a tty
+type testTerminal struct {
+	t       *testing.T
+	session *session
+	screen  *Screen
+}
+
+// Connects to the mock host as terminalType
+func dialMock(t *testing.T, terminalType string) *testTerminal {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go Serve(ln, Mock{})
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	s := newSession(connection.Connection{Conn: conn, Reader: bufio.NewReader(conn)}, terminalType, "")
+	return &testTerminal{t: t, session: s, screen: NewScreen(Model(terminalType))}
+}
+
+// Applies records from the host until the screen shows text
+func (tt *testTerminal) waitFor(text string) {
+	for !strings.Contains(tt.screen.Text(), text) {
+		record, err := tt.session.ReadRecord()
+		if err != nil {
+			tt.t.Fatalf("waiting for %q: %s\n%s", text, err, tt.screen.Text())
+		}
+		reply := tt.screen.Apply(record)
+		if reply != nil {
+			tt.send(reply)
+		}
+	}
+}
+
+func (tt *testTerminal) send(record []byte) {
+	err := tt.session.WriteRecord(record)
+	if err != nil {
+		tt.t.Fatal(err)
+	}
+}
+
+// Logs on with Enter, runs an unknown command and logs off with PF3
+func (tt *testTerminal) logon() {
+	tt.waitFor("USERID")
+	for _, r := range "bob" {
+		if !tt.screen.Type(r) {
+			tt.t.Fatalf("typing %q refused at %d", r, tt.screen.Cursor)
+		}
+	}
+	tt.send(tt.screen.Submit(AID_ENTER))
+	tt.waitFor("Welcome, BOB.")
+	for _, r := range "nope" {
+		tt.screen.Type(r)
+	}
+	tt.send(tt.screen.Submit(AID_ENTER))
+	tt.waitFor("Command NOPE not found")
+	tt.send(tt.screen.Submit(AID_PF[2]))
+	tt.waitFor("Session ended.")
+}
+
+func TestTN3270(t *testing.T) {
+	tt := dialMock(t, "IBM-3278-2")
+	tt.waitFor("Terminal IBM-3278-2 ")
+	if tn3270e, _, _ := tt.session.Mode(); tn3270e {
+		t.Error("TN3270E in effect without -E type")
+	}
+	tt.logon()
+}
+
+func TestTN3270E(t *testing.T) {
+	tt := dialMock(t, "IBM-3278-2-E")
+	tt.waitFor("Terminal IBM-3278-2-E  LU LU")
+	tn3270e, terminalType, deviceName := tt.session.Mode()
+	if !tn3270e || terminalType != "IBM-3278-2-E" || !strings.HasPrefix(deviceName, "LU") {
+		t.Errorf("mode %t %s %s, want TN3270E IBM-3278-2-E with an LU", tn3270e, terminalType, deviceName)
+	}
+	tt.logon()
+}
+
+// Host rejects the device type, client falls back to TN3270 without -E
+func TestTN3270EFallback(t *testing.T) {
+	tt := dialMock(t, "IBM-3179-2-E")
+	tt.waitFor("Terminal IBM-3179-2 ")
+	if tn3270e, _, _ := tt.session.Mode(); tn3270e {
+		t.Error("TN3270E in effect after device type was rejected")
+	}
+	tt.logon()
+}
+
+// Escaped 0xFF and IAC EOR split across reads still make one record
+func TestRecordSplitAcrossReads(t *testing.T) {
+	host, conn := net.Pipe()
+	defer host.Close()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	s := newSession(connection.Connection{Conn: conn, Reader: bufio.NewReader(conn)}, "IBM-3278-2", "")
+	// Pipe writes block until read
+	go io.Copy(io.Discard, host)
+	go func() {
+		for _, b := range []byte{0xf5, 0xff, 0xff, 0x40, 0xff, 0xef} {
+			host.Write([]byte{b})
+		}
+	}()
+	record, err := s.ReadRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(record) != "\xf5\xff\x40" {
+		t.Errorf("record % x, want f5 ff 40", record)
+	}
+}
@@ -0,0 +1,3 @@
+module telnet/ttype
+
+go 1.18
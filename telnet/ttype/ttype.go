@@ -0,0 +1,206 @@
+package ttype
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MTTS capability bits
+const (
+	ANSI              = 1
+	VT100             = 2
+	UTF8              = 4
+	COLORS_256        = 8
+	MOUSE_TRACKING    = 16
+	OSC_COLOR_PALETTE = 32
+	SCREEN_READER     = 64
+	PROXY             = 128
+	TRUECOLOR         = 256
+	MNES              = 512
+	MSLP              = 1024
+	SSL               = 2048
+)
+
+var mttsNames = []string{"ANSI", "VT100", "UTF-8", "256 COLORS", "MOUSE TRACKING", "OSC COLOR PALETTE", "SCREEN READER", "PROXY", "TRUECOLOR", "MNES", "MSLP", "SSL"}
+
+// Types received before the server gives up on finding a known one
+const maxTypes = 16
+
+// Returns names of MTTS bits
+func Names(bits int) []string {
+	names := []string{}
+	for i, name := range mttsNames {
+		if bits&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Parses a "MTTS 137" entry
+func ParseMTTS(name string) (int, bool) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "MTTS ") {
+		return 0, false
+	}
+	bits, err := strconv.Atoi(strings.TrimPrefix(name, "MTTS "))
+	if err != nil {
+		return 0, false
+	}
+	return bits, true
+}
+
+// Types sent by client in turn, repeating the last to mark the end
+type List struct {
+	Types []string
+	pos   int
+	mu    sync.Mutex
+}
+
+// Appends "MTTS bits" as the last entry when bits is not 0
+func NewList(types []string, bits int) *List {
+	l := new(List)
+	for _, t := range types {
+		l.Types = append(l.Types, strings.ToUpper(t))
+	}
+	if bits != 0 {
+		l.Types = append(l.Types, "MTTS "+strconv.Itoa(bits))
+	}
+	return l
+}
+
+// Returns the type for the next SEND, cycling back to the first after the repeated last
+func (l *List) Next() string {
+	if l == nil || len(l.Types) == 0 {
+		return ""
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.pos
+	if i >= len(l.Types) {
+		i = len(l.Types) - 1
+	}
+	l.pos = (l.pos + 1) % (len(l.Types) + 1)
+	return l.Types[i]
+}
+
+// Starts again from the first type on a new connection
+func (l *List) Reset() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.pos = 0
+	l.mu.Unlock()
+}
+
+// Server side state of RFC 1091 cycling
+type Cycle struct {
+	received []string
+	chosen   string
+	mtts     int
+	done     bool
+	mu       sync.Mutex
+}
+
+func NewCycle() *Cycle {
+	return new(Cycle)
+}
+
+// Takes a TERMINAL-TYPE IS answer and returns the chosen type once cycling ends,
+// or whether to send SEND again
+func (c *Cycle) Receive(name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return "", false
+	}
+	name = strings.ToLower(name)
+
+	// Cycling back until the client is on the chosen type
+	if len(c.chosen) > 0 {
+		c.received = append(c.received, name)
+		if name == c.chosen || len(c.received) > 2*maxTypes {
+			c.done = true
+			return c.chosen, false
+		}
+		return "", true
+	}
+
+	last := len(c.received) - 1
+	end := last >= 0 && (name == c.received[last] || name == c.received[0])
+	if !end {
+		c.received = append(c.received, name)
+		if bits, ok := ParseMTTS(name); ok {
+			c.mtts = bits
+		} else if Known(name) {
+			c.done = true
+			c.chosen = name
+			return name, false
+		}
+		if len(c.received) < maxTypes {
+			return "", true
+		}
+	}
+
+	// No type in terminfo, use the first one
+	c.chosen = name
+	for _, t := range c.received {
+		if _, ok := ParseMTTS(t); !ok {
+			c.chosen = t
+			break
+		}
+	}
+	if name == c.chosen {
+		c.done = true
+		return c.chosen, false
+	}
+	return "", true
+}
+
+// Returns MTTS bits sent by client, 0 if none
+func (c *Cycle) MTTS() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mtts
+}
+
+// Reports whether name has an entry in the terminfo database
+func Known(name string) bool {
+	name = strings.ToLower(name)
+	if len(name) == 0 || strings.ContainsRune(name, '/') || name[0] == '.' {
+		return false
+	}
+	for _, dir := range terminfoDirs() {
+		for _, sub := range []string{name[:1], fmt.Sprintf("%x", name[0])} {
+			if _, err := os.Stat(filepath.Join(dir, sub, name)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Search order of ncurses
+func terminfoDirs() []string {
+	dirs := []string{}
+	if dir := os.Getenv("TERMINFO"); len(dir) > 0 {
+		dirs = append(dirs, dir)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".terminfo"))
+	}
+	for _, dir := range strings.Split(os.Getenv("TERMINFO_DIRS"), ":") {
+		if len(dir) > 0 {
+			dirs = append(dirs, dir)
+		}
+	}
+	return append(dirs, "/etc/terminfo", "/lib/terminfo", "/usr/share/terminfo", "/usr/lib/terminfo", "/usr/local/share/terminfo")
+}